@@ -0,0 +1,75 @@
+package alloctxn
+
+import (
+	"sync"
+
+	"github.com/mit-pdos/go-journal/alloc"
+)
+
+// Alloc wraps an alloc.Alloc with a count of its free numbers, which is
+// kept up to date as numbers are allocated and freed, so that reporting
+// free space doesn't require scanning the bitmap.
+type Alloc struct {
+	mu     *sync.Mutex
+	alloc  *alloc.Alloc
+	bitmap []byte // shared with alloc, which only changes it under mu
+	nfree  uint64
+}
+
+func MkAlloc(bitmap []byte) *Alloc {
+	a := alloc.MkAlloc(bitmap)
+	return &Alloc{
+		mu:     new(sync.Mutex),
+		alloc:  a,
+		bitmap: bitmap,
+		nfree:  a.NumFree(),
+	}
+}
+
+// AllocNum returns a free number, or 0 if there is none
+func (a *Alloc) AllocNum() uint64 {
+	a.mu.Lock()
+	num := a.alloc.AllocNum()
+	if num != 0 {
+		a.nfree = a.nfree - 1
+	}
+	a.mu.Unlock()
+	return num
+}
+
+// isFree reports whether num's bit is clear.  Caller must hold mu.
+func (a *Alloc) isFree(num uint64) bool {
+	return num/8 < uint64(len(a.bitmap)) && a.bitmap[num/8]&(1<<(num%8)) == 0
+}
+
+// AllocNumAt allocates num if it is free, and reports whether it did
+func (a *Alloc) AllocNumAt(num uint64) bool {
+	a.mu.Lock()
+	free := a.isFree(num)
+	if free {
+		a.alloc.MarkUsed(num)
+		a.nfree = a.nfree - 1
+	}
+	a.mu.Unlock()
+	return free
+}
+
+// FreeNum frees num.  Freeing a number that is already free, as a
+// repaired file system may, leaves the count alone.
+func (a *Alloc) FreeNum(num uint64) {
+	a.mu.Lock()
+	wasFree := a.isFree(num)
+	a.alloc.FreeNum(num)
+	if !wasFree {
+		a.nfree = a.nfree + 1
+	}
+	a.mu.Unlock()
+}
+
+// NumFree returns the number of free numbers
+func (a *Alloc) NumFree() uint64 {
+	a.mu.Lock()
+	n := a.nfree
+	a.mu.Unlock()
+	return n
+}
@@ -2,7 +2,6 @@ package alloctxn
 
 import (
 	"github.com/mit-pdos/go-journal/addr"
-	"github.com/mit-pdos/go-journal/alloc"
 	"github.com/mit-pdos/go-journal/buf"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/jrnl"
@@ -19,15 +18,15 @@ import (
 type AllocTxn struct {
 	Super      *super.FsSuper
 	Op         *jrnl.Op
-	Balloc     *alloc.Alloc
-	Ialloc     *alloc.Alloc
+	Balloc     *Alloc
+	Ialloc     *Alloc
 	allocInums []common.Inum
 	freeInums  []common.Inum
 	allocBnums []common.Bnum
 	freeBnums  []common.Bnum
 }
 
-func Begin(super *super.FsSuper, log *obj.Log, balloc *alloc.Alloc, ialloc *alloc.Alloc) *AllocTxn {
+func Begin(super *super.FsSuper, log *obj.Log, balloc *Alloc, ialloc *Alloc) *AllocTxn {
 	atxn := &AllocTxn{
 		Super:      super,
 		Op:         jrnl.Begin(log),
@@ -109,6 +108,13 @@ func (atxn *AllocTxn) PostAbort() {
 	}
 }
 
+// Modified reports whether the transaction has written or allocated
+// anything
+func (atxn *AllocTxn) Modified() bool {
+	return atxn.Op.NDirty() > 0 || len(atxn.allocInums) > 0 ||
+		len(atxn.allocBnums) > 0
+}
+
 func (atxn *AllocTxn) AssertValidBlock(blkno common.Bnum) {
 	if blkno > 0 && (blkno < atxn.Super.DataStart() ||
 		blkno >= atxn.Super.MaxBnum()) {
@@ -128,6 +134,19 @@ func (atxn *AllocTxn) AllocBlock() common.Bnum {
 	return bn
 }
 
+// AllocBlockNear allocates goal if it is free, and otherwise any free
+// block, so that a file that grows allocates a contiguous run of blocks
+// when it can.  A goal of 0 means none.
+func (atxn *AllocTxn) AllocBlockNear(goal common.Bnum) common.Bnum {
+	if goal >= atxn.Super.DataStart() && goal < atxn.Super.MaxBnum() &&
+		atxn.Balloc.AllocNumAt(goal) {
+		util.DPrintf(1, "alloc block near %v -> %v\n", goal, goal)
+		atxn.allocBnums = append(atxn.allocBnums, goal)
+		return goal
+	}
+	return atxn.AllocBlock()
+}
+
 func (atxn *AllocTxn) FreeBlock(blkno common.Bnum) {
 	util.DPrintf(1, "free block %v\n", blkno)
 	atxn.AssertValidBlock(blkno)
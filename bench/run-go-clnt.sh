@@ -9,7 +9,7 @@ DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" >/dev/null 2>&1 && pwd)"
 cd $DIR/..
 
 # taskset 0xc go run ./cmd/go-nfsd/ -disk /dev/shm/goose.img &
-go run ./cmd/go-nfsd/ -disk /dev/shm/goose.img &
+go run ./cmd/go-nfsd/ -disk /dev/shm/goose.img -format &
 sleep 1
 killall -0 go-nfsd # make sure server is running
 # taskset 0x3 $1 /mnt/nfs
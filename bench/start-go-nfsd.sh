@@ -5,7 +5,8 @@ set -eu
 #
 # Usage:  ./start-go-nfsd.sh <arguments>
 #
-# default disk is /dev/shm/goose.img but can be overriden by passing -disk again
+# default disk is /dev/shm/goose.img but can be overriden by passing -disk again;
+# the disk is formatted afresh
 #
 
 DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" >/dev/null 2>&1 && pwd)"
@@ -34,7 +35,7 @@ while [[ "$#" -gt 0 ]]; do
 done
 
 go build ./cmd/go-nfsd
-./go-nfsd -disk /dev/shm/goose.img "${extra_args[@]}" >nfs.out 2>&1 &
+./go-nfsd -disk /dev/shm/goose.img -format "${extra_args[@]}" >nfs.out 2>&1 &
 sleep 2
 killall -0 go-nfsd       # make sure server is running
 killall -SIGUSR1 go-nfsd # reset stats after recovery
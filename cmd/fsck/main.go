@@ -0,0 +1,99 @@
+package main
+
+//
+// fsck checks, and optionally repairs, a go-nfsd file system offline.
+// It writes its findings to stdout as JSON, and exits with 0 if the file
+// system is clean, 1 if it repaired everything it found, 4 if problems
+// remain, 8 if it couldn't check the file system, and 16 for bad usage.
+// Without -repair it doesn't write the disk, not even to replay the log.
+//
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fsck"
+)
+
+const (
+	EXITCLEAN    = 0
+	EXITREPAIRED = 1
+	EXITPROBLEMS = 4
+	EXITERROR    = 8
+	EXITUSAGE    = 16
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <disk>\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// diskBlocks returns the size of the file or device at path, in blocks
+func diskBlocks(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// unlike Stat, works for block devices
+	sz, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sz) / disk.BlockSize, nil
+}
+
+func check(path string, repair bool) (*fsck.Report, error) {
+	nblk, err := diskBlocks(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := disk.NewFileDisk(path, nblk)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	report, err := fsck.Check(d, repair)
+	if err != nil {
+		return nil, err
+	}
+	if repair {
+		d.Barrier()
+	}
+	return report, nil
+}
+
+func main() {
+	var repair bool
+	flag.BoolVar(&repair, "repair", false, "repair the problems found")
+
+	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(EXITUSAGE)
+	}
+
+	report, err := check(flag.Arg(0), repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+		os.Exit(EXITERROR)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if report.Clean() {
+		os.Exit(EXITCLEAN)
+	}
+	if report.Repaired() {
+		os.Exit(EXITREPAIRED)
+	}
+	os.Exit(EXITPROBLEMS)
+}
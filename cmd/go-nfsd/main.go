@@ -4,12 +4,14 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"syscall"
+	"time"
 
 	"github.com/goose-lang/goose/machine/disk"
 	"github.com/zeldovich/go-rpcgen/rfc1057"
@@ -18,10 +20,13 @@ import (
 	"github.com/mit-pdos/go-journal/util"
 	go_nfs "github.com/mit-pdos/go-nfsd/nfs"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/pmap"
+	"github.com/mit-pdos/go-nfsd/rpcsrv"
+	"github.com/mit-pdos/go-nfsd/super"
 	"github.com/mit-pdos/go-nfsd/util/timed_disk"
 )
 
-func pmap_set_unset(prog, vers, port uint32, setit bool) error {
+func pmap_set_unset(prog, vers, prot, port uint32, setit bool) error {
 	var cred rfc1057.Opaque_auth
 	cred.Flavor = rfc1057.AUTH_NONE
 
@@ -35,7 +40,7 @@ func pmap_set_unset(prog, vers, port uint32, setit bool) error {
 	arg := rfc1057.Mapping{
 		Prog: prog,
 		Vers: vers,
-		Prot: rfc1057.IPPROTO_TCP,
+		Prot: prot,
 		Port: port,
 	}
 
@@ -68,14 +73,42 @@ func main() {
 	flag.BoolVar(&unstable, "unstable", true, "use unstable writes if requested")
 
 	var filesizeMegabytes uint64
-	flag.Uint64Var(&filesizeMegabytes, "size", 400, "size of file system (in MB)")
+	flag.Uint64Var(&filesizeMegabytes, "size", 400, "size of file system (in MB), unless the disk image exists")
 
 	var diskfile string
 	flag.StringVar(&diskfile, "disk", "", "disk image (empty for MemDisk)")
 
+	var format bool
+	flag.BoolVar(&format, "format", false,
+		"make a new file system on the disk image, overwriting what is on it")
+
 	var dumpStats bool
 	flag.BoolVar(&dumpStats, "stats", false, "dump stats to stderr at end")
 
+	var rootSquash bool
+	flag.BoolVar(&rootSquash, "rootsquash", false, "treat clients' root as nobody")
+
+	var orphanGrace time.Duration
+	flag.DurationVar(&orphanGrace, "orphangrace", go_nfs.DEFORPHANGRACE,
+		"how long a removed file stays usable by clients that used it recently (0 to free it at once)")
+
+	var serveUDP bool
+	flag.BoolVar(&serveUDP, "udp", false, "also serve NFS and MOUNT over UDP, on the same port")
+
+	var nfsPort uint
+	flag.UintVar(&nfsPort, "port", 0, "port to serve NFS on (0 for any)")
+
+	var mountPort uint
+	flag.UintVar(&mountPort, "mountport", 0, "port to serve MOUNT on (0 for NFS's port)")
+
+	var portmap bool
+	flag.BoolVar(&portmap, "portmap", false,
+		"serve a portmapper on port 111 instead of registering with rpcbind")
+
+	var drcSize int
+	flag.IntVar(&drcSize, "drc", 1024,
+		"replies kept to replay to retransmitted calls (0 for none)")
+
 	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
 	flag.Parse()
 
@@ -90,35 +123,89 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	listener, err := net.Listen("tcp", ":0")
-	if err != nil {
-		panic(err)
+	// the listeners to close on shutdown
+	var closers []io.Closer
+	listen := func(port uint32) (net.Listener, net.PacketConn) {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			panic(err)
+		}
+		closers = append(closers, l)
+		var pc net.PacketConn
+		if serveUDP {
+			port = uint32(l.Addr().(*net.TCPAddr).Port)
+			pc, err = net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+			if err != nil {
+				panic(err)
+			}
+			closers = append(closers, pc)
+		}
+		return l, pc
 	}
+
+	listener, udpConn := listen(uint32(nfsPort))
 	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	mountListener, mountUDPConn := listener, udpConn
+	if mountPort != 0 && uint32(mountPort) != port {
+		mountListener, mountUDPConn = listen(uint32(mountPort))
+	}
+	mport := uint32(mountListener.Addr().(*net.TCPAddr).Port)
 
-	err = pmap_set_unset(nfstypes.MOUNT_PROGRAM, nfstypes.MOUNT_V3, 0, false)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not unset mount - is rpcbind service running?\n")
+	prots := []uint32{rfc1057.IPPROTO_TCP}
+	if serveUDP {
+		prots = append(prots, rfc1057.IPPROTO_UDP)
+	}
+
+	var pm *pmap.Pmap
+	var pmapListener net.Listener
+	var pmapUDPConn net.PacketConn
+	var err error
+	if portmap {
+		pmapListener, pmapUDPConn = listen(rfc1057.PMAP_PORT)
+		pm = pmap.MkPmap(rfc1057.PMAP_PORT, prots)
+		for _, prot := range prots {
+			pm.PMAPPROC_SET(rfc1057.Mapping{Prog: nfstypes.MOUNT_PROGRAM,
+				Vers: nfstypes.MOUNT_V3, Prot: prot, Port: mport})
+			pm.PMAPPROC_SET(rfc1057.Mapping{Prog: nfstypes.NFS_PROGRAM,
+				Vers: nfstypes.NFS_V3, Prot: prot, Port: port})
+		}
+	} else {
+		// unsetting ignores the protocol and port
+		err = pmap_set_unset(nfstypes.MOUNT_PROGRAM, nfstypes.MOUNT_V3, 0, 0, false)
+	}
+	if err != nil && nfsPort == 0 {
+		fmt.Fprintf(os.Stderr, "Could not unset mount - is rpcbind service running? (or use -portmap)\n")
 		fmt.Fprintf(os.Stderr, "%v\n", err.Error())
 		os.Exit(1)
 	}
-	err = pmap_set_unset(nfstypes.MOUNT_PROGRAM, nfstypes.MOUNT_V3, port, true)
-	if err != nil {
-		panic(err)
-	}
-	defer pmap_set_unset(nfstypes.MOUNT_PROGRAM, nfstypes.MOUNT_V3, port, false)
-
-	pmap_set_unset(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, 0, false)
-	err = pmap_set_unset(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, port, true)
 	if err != nil {
-		panic(err)
+		// clients can still mount with port= and mountport=
+		fmt.Fprintf(os.Stderr, "Not registering with rpcbind: %v\n", err)
+	} else if !portmap {
+		pmap_set_unset(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, 0, 0, false)
+		for _, prot := range prots {
+			err = pmap_set_unset(nfstypes.MOUNT_PROGRAM, nfstypes.MOUNT_V3, prot, mport, true)
+			if err != nil {
+				panic(err)
+			}
+			err = pmap_set_unset(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, prot, port, true)
+			if err != nil {
+				panic(err)
+			}
+		}
+		defer pmap_set_unset(nfstypes.MOUNT_PROGRAM, nfstypes.MOUNT_V3, 0, 0, false)
+		defer pmap_set_unset(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, 0, 0, false)
 	}
-	defer pmap_set_unset(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, port, false)
 
 	var d disk.Disk
 	if diskfile == "" {
 		d = disk.NewMemDisk(diskBlocks)
 	} else {
+		// an existing image, perhaps made by mkfs, keeps its size
+		fi, err := os.Stat(diskfile)
+		if err == nil && fi.Mode().IsRegular() && fi.Size() > 0 {
+			diskBlocks = uint64(fi.Size()) / disk.BlockSize
+		}
 		d, err = disk.NewFileDisk(diskfile, diskBlocks)
 		if err != nil {
 			panic(fmt.Errorf("could not create disk: %w", err))
@@ -127,13 +214,31 @@ func main() {
 	if dumpStats {
 		d = timed_disk.New(d)
 	}
-	server := go_nfs.MakeNfs(d)
+	// a MemDisk starts out blank
+	if diskfile == "" || format {
+		err := go_nfs.Mkfs(d, super.DEFNINODE, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not make file system: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	server, err := go_nfs.OpenNfs(d)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open file system: %v\n", err)
+		os.Exit(1)
+	}
 	server.Unstable = unstable
+	server.RootSquash = rootSquash
+	server.SetOrphanGrace(orphanGrace)
 	defer server.ShutdownNfs()
 
-	srv := rfc1057.MakeServer()
-	srv.RegisterMany(nfstypes.MOUNT_PROGRAM_MOUNT_V3_regs(server))
-	srv.RegisterMany(nfstypes.NFS_PROGRAM_NFS_V3_regs(server))
+	srv := rpcsrv.MakeServer()
+	server.Register(srv)
+	var drc *rpcsrv.DRC
+	if drcSize > 0 {
+		drc = rpcsrv.MkDRC(drcSize)
+		srv.SetDRC(drc)
+	}
 
 	interruptSig := make(chan os.Signal, 1)
 	shutdown := false
@@ -141,10 +246,15 @@ func main() {
 	go func() {
 		<-interruptSig
 		shutdown = true
-		listener.Close()
+		for _, c := range closers {
+			c.Close()
+		}
 		if dumpStats {
 			server.WriteOpStats(os.Stderr)
 			d.(*timed_disk.Disk).WriteStats(os.Stderr)
+			if drc != nil {
+				drc.WriteStats(os.Stderr)
+			}
 		}
 	}()
 
@@ -159,10 +269,44 @@ func main() {
 				d := d.(*timed_disk.Disk)
 				d.WriteStats(os.Stderr)
 				d.ResetStats()
+				if drc != nil {
+					drc.WriteStats(os.Stderr)
+					drc.ResetStats()
+				}
 			}
 		}()
 	}
 
+	serve := func(l net.Listener, run func(io.ReadWriter) error) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) || !shutdown {
+					fmt.Printf("accept: %v\n", err)
+				}
+				return
+			}
+			go run(conn)
+		}
+	}
+	if mountListener != listener {
+		go serve(mountListener, srv.Run)
+	}
+	if udpConn != nil {
+		go srv.RunUDP(udpConn)
+	}
+	if mountUDPConn != udpConn {
+		go srv.RunUDP(mountUDPConn)
+	}
+	if pm != nil {
+		pmapSrv := rpcsrv.MakeServer()
+		pm.Register(pmapSrv)
+		go serve(pmapListener, pmapSrv.Run)
+		if pmapUDPConn != nil {
+			go pmapSrv.RunUDP(pmapUDPConn)
+		}
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -0,0 +1,141 @@
+package main
+
+//
+// mkfs makes an empty go-nfsd file system on a disk image or block
+// device, without starting a server.
+//
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	go_nfs "github.com/mit-pdos/go-nfsd/nfs"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+const MB uint64 = 1024 * 1024
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <disk>\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// diskBlocks returns the size of the existing file or device at path,
+// in blocks, or 0 if there is none
+func diskBlocks(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// unlike Stat, works for block devices
+	sz, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sz) / disk.BlockSize, nil
+}
+
+// hasFs reports whether the nblk blocks at path hold a go-nfsd file
+// system, even one that this version can't open
+func hasFs(path string, nblk uint64) (bool, error) {
+	d, err := disk.NewFileDisk(path, nblk)
+	if err != nil {
+		return false, err
+	}
+	defer d.Close()
+	fs, serr := super.ReadFsSuper(d)
+	return serr != super.ENOFS && (serr != super.OK || fs.Formatted()), nil
+}
+
+func mkfs(path string, sizeMegabytes uint64, ninode uint64,
+	bytesPerInode uint64, label string, force bool) error {
+	oldblk, err := diskBlocks(path)
+	if err != nil {
+		return err
+	}
+	if !force && oldblk > common.LOGSIZE {
+		exists, err := hasFs(path, oldblk)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%s has a go-nfsd file system; use -f to overwrite it", path)
+		}
+	}
+
+	nblk := sizeMegabytes * MB / disk.BlockSize
+	if nblk == 0 {
+		if oldblk == 0 {
+			return fmt.Errorf("%s doesn't exist; give its size with -size", path)
+		}
+		nblk = oldblk
+	}
+	if ninode == 0 {
+		ninode = super.DEFNINODE
+		if bytesPerInode != 0 {
+			ninode = super.NInodeForBytes(nblk, bytesPerInode)
+		}
+	}
+
+	d, err := disk.NewFileDisk(path, nblk)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	err = go_nfs.Mkfs(d, ninode, label)
+	if err != nil {
+		return err
+	}
+	d.Barrier()
+
+	fs, serr := super.ReadFsSuper(d)
+	if serr != super.OK {
+		return fmt.Errorf("can't read back the superblock")
+	}
+	fmt.Printf("%s: %d blocks, %d inodes, label %q, uuid %x\n", path,
+		fs.Size, fs.NInode(), fs.LabelString(), fs.UUID)
+	return nil
+}
+
+func main() {
+	var sizeMegabytes uint64
+	flag.Uint64Var(&sizeMegabytes, "size", 0,
+		"size of file system (in MB; 0 for the size of the existing file or device)")
+
+	var ninode uint64
+	flag.Uint64Var(&ninode, "inodes", 0, "number of inodes (0 for the default)")
+
+	var bytesPerInode uint64
+	flag.Uint64Var(&bytesPerInode, "bytes-per-inode", 0,
+		"make one inode per this many bytes of disk, unless -inodes is given")
+
+	var label string
+	flag.StringVar(&label, "label", "", "file system label")
+
+	var force bool
+	flag.BoolVar(&force, "f", false, "overwrite an existing file system")
+
+	flag.Uint64Var(&util.Debug, "debug", 0, "debug level (higher is more verbose)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	err := mkfs(flag.Arg(0), sizeMegabytes, ninode, bytesPerInode, label, force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mkfs: %v\n", err)
+		os.Exit(1)
+	}
+}
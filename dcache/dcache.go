@@ -37,3 +37,7 @@ func (dc *Dcache) Del(name string) bool {
 	}
 	return ok
 }
+
+func (dc *Dcache) Len() uint64 {
+	return uint64(len(dc.cache))
+}
@@ -0,0 +1,428 @@
+package dir
+
+import (
+	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/jrnl"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Compaction.  Removing a name leaves its space free, and a directory
+// never shrinks by itself, so a directory that once held many names
+// stays large.  Compact moves the live entries of such a directory into
+// fewer blocks and truncates it.  Compacting a large directory dirties
+// more blocks than fit in a transaction, so Compact does it in steps of
+// at most COMPACTBUDGET dirty blocks, each leaving a valid directory;
+// the caller commits each step and runs the next in a new transaction.
+//
+// A linear directory slides its entries down over the free ones,
+// keeping their order.  That changes their offsets, so each step that
+// moves entries bumps the generation, and clients reading the directory
+// get NFS3ERR_BAD_COOKIE and start over.  The caller says whether
+// Compact may move entries; if not, Compact only truncates the free
+// entries at the end of a linear directory, which leaves the offsets,
+// and so the cookies, of its entries alone.  An indexed directory packs
+// the entries of overflow buckets into as few buckets as hold them,
+// merges buddy buckets that fit in half a block, halves the table while
+// no bucket needs its full depth, moves its blocks down over the ones
+// that merging freed, and truncates.  Keys stay the same, so its
+// cookies stay valid.
+//
+
+const COMPACTBUDGET = jrnl.LogBlocks / 2
+
+// MERGESZ is the most that two merged buckets may hold, so that they
+// don't split again right away
+const MERGESZ = disk.BlockSize / 2
+
+func roomFor(op *fstxn.FsTxn, nblk uint64) bool {
+	return op.Atxn.Op.NDirty()+nblk < COMPACTBUDGET
+}
+
+// Sparse reports whether compacting dip, from which op just removed
+// name, would free blocks
+func Sparse(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) bool {
+	if isIndexed(dip, op) {
+		hdr := readHdr(dip, op)
+		chain := lookupChain(dip, op, hdr, nameKey(string(name)))
+		if len(chain) > 1 {
+			var used = uint64(0)
+			for _, b := range chain {
+				used += b.used()
+			}
+			return used < uint64(len(chain)-1)*MERGESZ
+		}
+		b := chain[0]
+		return b.depth > 0 && b.used() < MERGESZ/2
+	}
+	if dip.Dcache == nil {
+		mkDcache(dip, op)
+	}
+	used := dip.Dcache.Len() * DIRENTSZ
+	return dip.Size-used >= disk.BlockSize && used < dip.Size/2
+}
+
+// Compact does a step of compacting dip, moving the entries of a
+// linear directory only if move is true.  It returns whether there is
+// more to do, and whether the caller must start the shrinker to free
+// the blocks that it truncated.
+func Compact(dip *inode.Inode, op *fstxn.FsTxn, move bool) (bool, bool) {
+	if dip.Kind != nfstypes.NF3DIR {
+		return false, false
+	}
+	if isIndexed(dip, op) {
+		return compactIndexed(dip, op)
+	}
+	if !move {
+		return false, truncateLinear(dip, op)
+	}
+	return compactLinear(dip, op)
+}
+
+// MovesCookies reports whether compacting dip changes the cookies of
+// its entries, as it does those of a linear directory
+func MovesCookies(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	return !isIndexed(dip, op)
+}
+
+func setGeneration(dip *inode.Inode, op *fstxn.FsTxn, gen uint64) {
+	enc := marshal.NewEnc(8)
+	enc.PutInt(gen)
+	dip.Write(op.Atxn, LINEARGENOFF, 8, enc.Finish())
+}
+
+// truncateLinear truncates the free entries at the end of dip, and
+// returns whether the caller must start the shrinker
+func truncateLinear(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	var end = uint64(2 * DIRENTSZ)
+	for off := end; off < dip.Size; off += DIRENTSZ {
+		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
+		if decodeDirEnt(data).inum != common.NULLINUM {
+			end = off + DIRENTSZ
+		}
+	}
+	dip.Dcache = nil
+	util.DPrintf(1, "truncateLinear # %v: size %d -> %d\n", dip.Inum, dip.Size, end)
+	if end >= dip.Size {
+		return false
+	}
+	// shrinking can't fail
+	shrink, _ := dip.Resize(op.Atxn, end)
+	return shrink
+}
+
+func compactLinear(dip *inode.Inode, op *fstxn.FsTxn) (bool, bool) {
+	var dst = uint64(2 * DIRENTSZ)
+	for ; dst < dip.Size; dst += DIRENTSZ {
+		data, _ := dip.Read(op.Atxn, dst, DIRENTSZ)
+		if decodeDirEnt(data).inum == common.NULLINUM {
+			break
+		}
+	}
+	var moved = false
+	var more = false
+	free := encodeDirEnt(&dirEnt{inum: common.NULLINUM, name: ""})
+	for src := dst + DIRENTSZ; src < dip.Size; src += DIRENTSZ {
+		// the blocks of src and dst, and the generation
+		if !roomFor(op, 3) {
+			more = true
+			break
+		}
+		data, _ := dip.Read(op.Atxn, src, DIRENTSZ)
+		if decodeDirEnt(data).inum == common.NULLINUM {
+			continue
+		}
+		dip.Write(op.Atxn, dst, DIRENTSZ, data)
+		dip.Write(op.Atxn, src, DIRENTSZ, free)
+		dst += DIRENTSZ
+		moved = true
+	}
+	if moved {
+		setGeneration(dip, op, Generation(dip, op)+1)
+	}
+	dip.Dcache = nil
+	if more {
+		return true, false
+	}
+	util.DPrintf(1, "compactLinear # %v: size %d -> %d\n", dip.Inum, dip.Size, dst)
+	if dst >= dip.Size {
+		return false, false
+	}
+	// shrinking can't fail
+	shrink, _ := dip.Resize(op.Atxn, dst)
+	return false, shrink
+}
+
+// readTable returns the entries of the table
+func readTable(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr) []uint64 {
+	n := uint64(1) << hdr.depth
+	tbl := make([]uint64, 0, n)
+	for _, lblk := range hdr.tblks {
+		dec := marshal.NewDec(readBlk(dip, op, lblk))
+		for i := uint64(0); i < NPTR && uint64(len(tbl)) < n; i++ {
+			tbl = append(tbl, dec.GetInt())
+		}
+	}
+	return tbl
+}
+
+// tableBlks is how many table blocks hold entries lo through hi-1
+func tableBlks(lo uint64, hi uint64) uint64 {
+	return (hi-1)/NPTR - lo/NPTR + 1
+}
+
+// writeTable writes the table blocks that hold entries lo through hi-1
+// of tbl
+func writeTable(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, tbl []uint64, lo uint64, hi uint64) bool {
+	for t := lo / NPTR; t*NPTR < hi; t++ {
+		enc := marshal.NewEnc(disk.BlockSize)
+		for i := t * NPTR; i < (t+1)*NPTR && i < uint64(len(tbl)); i++ {
+			enc.PutInt(tbl[i])
+		}
+		if !writeBlk(dip, op, hdr.tblks[t], enc.Finish()) {
+			return false
+		}
+	}
+	return true
+}
+
+// clearBlk zeroes lblk, which the directory no longer uses, so that
+// fsck doesn't take it for a bucket
+func clearBlk(dip *inode.Inode, op *fstxn.FsTxn, lblk uint64) bool {
+	return writeBlk(dip, op, lblk, make([]byte, disk.BlockSize))
+}
+
+func compactIndexed(dip *inode.Inode, op *fstxn.FsTxn) (bool, bool) {
+	hdr := readHdr(dip, op)
+	tbl := readTable(dip, op, hdr)
+	if !packOverflow(dip, op, tbl) || !mergeBuckets(dip, op, hdr, tbl) ||
+		!halveTable(dip, op, hdr, tbl) {
+		return true, false
+	}
+	tbl = readTable(dip, op, hdr)
+	n, ok := packBlocks(dip, op, hdr, tbl)
+	if !ok {
+		return true, false
+	}
+	util.DPrintf(1, "compactIndexed # %v: size %d -> %d\n", dip.Inum,
+		dip.Size, n*disk.BlockSize)
+	if n*disk.BlockSize >= dip.Size {
+		return false, false
+	}
+	// shrinking can't fail
+	shrink, _ := dip.Resize(op.Atxn, n*disk.BlockSize)
+	return false, shrink
+}
+
+// packOverflow moves the entries of each bucket with overflow buckets
+// into the first buckets of its chain that hold them, and drops the
+// rest of the chain.  It returns false if it ran out of room first.
+func packOverflow(dip *inode.Inode, op *fstxn.FsTxn, tbl []uint64) bool {
+	seen := make(map[uint64]bool)
+	for _, lblk := range tbl {
+		if seen[lblk] {
+			continue
+		}
+		seen[lblk] = true
+		chain := readChain(dip, op, lblk)
+		if len(chain) == 1 {
+			continue
+		}
+		var ents []*dirEnt
+		for _, b := range chain {
+			ents = append(ents, b.ents...)
+			b.ents = nil
+		}
+		var n = 0
+		for _, de := range ents {
+			if !chain[n].fits(de.name) {
+				n++
+				if n == len(chain) {
+					break
+				}
+			}
+			chain[n].ents = append(chain[n].ents, de)
+		}
+		if n >= len(chain)-1 {
+			// packing frees nothing
+			continue
+		}
+		if !roomFor(op, uint64(len(chain))) {
+			return false
+		}
+		chain[n].next = 0
+		for j, b := range chain {
+			if j <= n && !writeBucket(dip, op, b) {
+				return false
+			}
+			if j > n && !clearBlk(dip, op, b.lblk) {
+				return false
+			}
+		}
+		util.DPrintf(5, "packOverflow # %v: bucket %d %d -> %d blocks\n",
+			dip.Inum, lblk, len(chain), n+1)
+	}
+	return true
+}
+
+// mergeBuckets merges buddy buckets, updating tbl, until none fit in
+// MERGESZ together.  It returns false if it ran out of room first.
+func mergeBuckets(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, tbl []uint64) bool {
+	for merged := true; merged; {
+		merged = false
+		for i := uint64(0); i < uint64(len(tbl)); {
+			b := readBucket(dip, op, tbl[i])
+			span := uint64(1) << (hdr.depth - b.depth)
+			// b covers i through i+span-1; its buddy covers the
+			// other half of the range of their merged bucket
+			if b.depth == 0 || i/span%2 == 1 {
+				i += span
+				continue
+			}
+			buddy := readBucket(dip, op, tbl[i+span])
+			if buddy.depth != b.depth || b.next != 0 || buddy.next != 0 ||
+				b.used()+buddy.used()-BUCKETHDRSZ > MERGESZ {
+				i += span
+				continue
+			}
+			if !roomFor(op, 2+tableBlks(i, i+2*span)) {
+				return false
+			}
+			b.ents = append(b.ents, buddy.ents...)
+			b.depth--
+			for j := i + span; j < i+2*span; j++ {
+				tbl[j] = b.lblk
+			}
+			if !writeBucket(dip, op, b) || !clearBlk(dip, op, buddy.lblk) ||
+				!writeTable(dip, op, hdr, tbl, i+span, i+2*span) {
+				return false
+			}
+			util.DPrintf(5, "mergeBuckets # %v: %d <- %d depth %d\n",
+				dip.Inum, b.lblk, buddy.lblk, b.depth)
+			merged = true
+			i += 2 * span
+		}
+	}
+	return true
+}
+
+// halveTable halves the table while each pair of its entries maps to
+// the same bucket.  It returns false if it ran out of room first.
+func halveTable(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, tbl []uint64) bool {
+	for hdr.depth > 0 {
+		n := uint64(1) << hdr.depth
+		for i := uint64(0); i < n; i += 2 {
+			if tbl[i] != tbl[i+1] {
+				return true
+			}
+		}
+		if !roomFor(op, uint64(len(hdr.tblks))+1) {
+			return false
+		}
+		for i := uint64(0); i < n/2; i++ {
+			tbl[i] = tbl[2*i]
+		}
+		tbl = tbl[:n/2]
+		ntblk := (n/2 + NPTR - 1) / NPTR
+		if !writeTable(dip, op, hdr, tbl, 0, n/2) {
+			return false
+		}
+		for _, lblk := range hdr.tblks[ntblk:] {
+			if !clearBlk(dip, op, lblk) {
+				return false
+			}
+		}
+		hdr.tblks = hdr.tblks[:ntblk]
+		hdr.depth--
+		if !writeHdr(dip, op, hdr) {
+			return false
+		}
+		util.DPrintf(1, "halveTable # %v: depth %d\n", dip.Inum, hdr.depth)
+	}
+	return true
+}
+
+// packBlocks moves the blocks that the directory uses into the holes
+// below them.  It returns how many blocks the directory uses, which
+// are then the first ones, or false if it ran out of room first.
+func packBlocks(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, tbl []uint64) (uint64, bool) {
+	used := map[uint64]bool{0: true}
+	for _, lblk := range hdr.tblks {
+		used[lblk] = true
+	}
+	// overflow buckets, and the bucket before each
+	prev := make(map[uint64]uint64)
+	for _, lblk := range tbl {
+		if used[lblk] {
+			continue
+		}
+		used[lblk] = true
+		chain := readChain(dip, op, lblk)
+		for j := 1; j < len(chain); j++ {
+			used[chain[j].lblk] = true
+			prev[chain[j].lblk] = chain[j-1].lblk
+		}
+	}
+	n := uint64(len(used))
+	var hole = uint64(1)
+	for lblk := n; lblk < dip.Size/disk.BlockSize; lblk++ {
+		if !used[lblk] {
+			continue
+		}
+		for used[hole] {
+			hole++
+		}
+		// the block, its copy, the header, the table blocks that
+		// map to it, and the bucket before it
+		if !roomFor(op, 4+uint64(len(hdr.tblks))) {
+			return n, false
+		}
+		if !writeBlk(dip, op, hole, readBlk(dip, op, lblk)) ||
+			!clearBlk(dip, op, lblk) {
+			return n, false
+		}
+		if p, ok := prev[lblk]; ok {
+			pb := readBucket(dip, op, p)
+			pb.next = hole
+			if !writeBucket(dip, op, pb) {
+				return n, false
+			}
+			prev[hole] = p
+			delete(prev, lblk)
+		}
+		for o, p := range prev {
+			if p == lblk {
+				prev[o] = hole
+			}
+		}
+		var lo = uint64(len(tbl))
+		var hi = uint64(0)
+		for i, b := range tbl {
+			if b == lblk {
+				tbl[i] = hole
+				lo = util.Min(lo, uint64(i))
+				hi = uint64(i) + 1
+			}
+		}
+		if lo < hi && !writeTable(dip, op, hdr, tbl, lo, hi) {
+			return n, false
+		}
+		for t, b := range hdr.tblks {
+			if b == lblk {
+				hdr.tblks[t] = hole
+				if !writeHdr(dip, op, hdr) {
+					return n, false
+				}
+			}
+		}
+		used[hole] = true
+		delete(used, lblk)
+	}
+	return n, true
+}
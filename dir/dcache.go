@@ -20,6 +20,9 @@ func LookupName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (com
 	if dip.Kind != nfstypes.NF3DIR {
 		return common.NULLINUM, 0
 	}
+	if isIndexed(dip, op) {
+		return lookupIndexed(dip, op, string(name))
+	}
 	var inum = common.NULLINUM
 	var finalOffset uint64 = 0
 	if dip.Dcache == nil {
@@ -34,9 +37,12 @@ func LookupName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (com
 }
 
 func AddName(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum, name nfstypes.Filename3) bool {
-	if dip.Kind != nfstypes.NF3DIR || uint64(len(name)) >= MAXNAMELEN {
+	if dip.Kind != nfstypes.NF3DIR || NameTooLong(dip, op, name) {
 		return false
 	}
+	if isIndexed(dip, op) {
+		return addIndexed(dip, op, inum, string(name))
+	}
 	if dip.Dcache == nil {
 		mkDcache(dip, op)
 	}
@@ -49,9 +55,12 @@ func AddName(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum, name nfstypes.
 }
 
 func RemName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) bool {
-	if dip.Kind != nfstypes.NF3DIR || uint64(len(name)) >= MAXNAMELEN {
+	if dip.Kind != nfstypes.NF3DIR || NameTooLong(dip, op, name) {
 		return false
 	}
+	if isIndexed(dip, op) {
+		return remIndexed(dip, op, string(name))
+	}
 	if dip.Dcache == nil {
 		mkDcache(dip, op)
 	}
@@ -66,3 +75,14 @@ func RemName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) bool {
 	}
 	return false
 }
+
+// SetParent points the ".." entry of dip at parent
+func SetParent(dip *inode.Inode, op *fstxn.FsTxn, parent common.Inum) bool {
+	if isIndexed(dip, op) {
+		return setParentIndexed(dip, op, parent)
+	}
+	if !RemName(dip, op, "..") {
+		return false
+	}
+	return AddName(dip, op, parent, "..")
+}
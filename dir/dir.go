@@ -1,6 +1,7 @@
 package dir
 
 import (
+	"github.com/goose-lang/primitive/disk"
 	"github.com/tchajed/marshal"
 
 	"github.com/mit-pdos/go-journal/common"
@@ -10,17 +11,68 @@ import (
 	"github.com/mit-pdos/go-nfsd/nfstypes"
 )
 
+// Linear directories are arrays of DIRENTSZ-byte entries, and hold
+// names shorter than LINEARNAMELEN; indexed directories (see index.go)
+// hold names of up to MAXNAMELEN bytes.
 const DIRENTSZ uint64 = 128
-const MAXNAMELEN = DIRENTSZ - 16 // uint64 for inum + uint64 for len(name)
+const LINEARNAMELEN = DIRENTSZ - 16 // uint64 for inum + uint64 for len(name)
+const MAXNAMELEN uint64 = 255
 
 type dirEnt struct {
 	inum common.Inum
-	name string // <= MAXNAMELEN
+	name string
 }
 
 func IllegalName(name nfstypes.Filename3) bool {
 	n := name
-	return n == "." || n == ".."
+	return n == "" || n == "." || n == ".."
+}
+
+// NameMax is the longest name that dip can hold
+func NameMax(dip *inode.Inode, op *fstxn.FsTxn) uint64 {
+	if isIndexed(dip, op) {
+		return MAXNAMELEN
+	}
+	return LINEARNAMELEN - 1
+}
+
+// NameTooLong reports whether directory dip can't hold name because of
+// its length
+func NameTooLong(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) bool {
+	if dip.Kind != nfstypes.NF3DIR {
+		return false
+	}
+	return uint64(len(name)) > NameMax(dip, op)
+}
+
+//
+// Readdir cookies.  The cookie of an entry in a linear directory is the
+// offset just past it; that of an entry in an indexed directory is the
+// hash key of its name.  The cookie verifier is derived from the
+// directory's generation, which changes when compaction moves the
+// entries of a linear directory, and so their offsets.  Compacting an
+// indexed directory leaves the keys alone, so its generation stays 0.
+//
+
+// A linear directory keeps its generation in the unused tail of its
+// "." entry, which is always the first
+const LINEARGENOFF = DIRENTSZ - 8
+
+// Generation returns the generation of dip's cookies
+func Generation(dip *inode.Inode, op *fstxn.FsTxn) uint64 {
+	if dip.Size < DIRENTSZ || isIndexed(dip, op) {
+		return 0
+	}
+	data, _ := dip.Read(op.Atxn, LINEARGENOFF, 8)
+	return marshal.NewDec(data).GetInt()
+}
+
+// ValidCookie reports whether dip could have returned cookie
+func ValidCookie(dip *inode.Inode, op *fstxn.FsTxn, cookie uint64) bool {
+	if isIndexed(dip, op) {
+		return true
+	}
+	return cookie%DIRENTSZ == 0
 }
 
 func ScanName(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (common.Inum, uint64) {
@@ -82,6 +134,9 @@ func RemNameDir(dip *inode.Inode, op *fstxn.FsTxn, name nfstypes.Filename3) (uin
 }
 
 func IsDirEmpty(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	if isIndexed(dip, op) {
+		return emptyIndexed(dip, op)
+	}
 	var empty bool = true
 
 	// check all entries after . and ..
@@ -99,7 +154,12 @@ func IsDirEmpty(dip *inode.Inode, op *fstxn.FsTxn) bool {
 	return empty
 }
 
+// InitDir makes dip an empty directory in parent, indexed unless the
+// file system is VERSION0
 func InitDir(dip *inode.Inode, op *fstxn.FsTxn, parent common.Inum) bool {
+	if !op.Fs.Super.Legacy() {
+		return initIndexed(dip, op, parent)
+	}
 	if !AddName(dip, op, dip.Inum, ".") {
 		return false
 	}
@@ -107,6 +167,9 @@ func InitDir(dip *inode.Inode, op *fstxn.FsTxn, parent common.Inum) bool {
 }
 
 func MkRootDir(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	if !op.Fs.Super.Legacy() {
+		return initIndexed(dip, op, dip.Inum)
+	}
 	if !AddName(dip, op, dip.Inum, ".") {
 		return false
 	}
@@ -132,84 +195,75 @@ const entryplus3Baggage uint64 = 8 + // fileid
 func Apply(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
 	dircount uint64, maxcount uint64,
 	f func(*inode.Inode, string, common.Inum, uint64)) bool {
-	var eof bool = true
 	var ip *inode.Inode
-	var begin = uint64(start)
-	if begin != 0 {
-		begin += DIRENTSZ
-	}
 	// TODO: arbitrary estimate of constant XDR overhead
 	var n uint64 = uint64(64)
 	var dirbytes uint64 = uint64(0)
-	for off := begin; off < dip.Size; {
-		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
-		de := decodeDirEnt(data)
-		util.DPrintf(5, "Apply: # %v %v off %d\n", dip.Inum, de, off)
-		if de.inum == common.NULLINUM {
-			off = off + DIRENTSZ
-			continue
-		}
-
+	visit := func(name string, inum common.Inum, cookie uint64) bool {
 		// Lock inode, if this transaction doesn't own it already
 		var own bool = false
-		if op.OwnInum(de.inum) {
+		if op.OwnInum(inum) {
 			own = true
-			ip = op.GetInodeUnlocked(de.inum)
+			ip = op.GetInodeUnlocked(inum)
 		} else {
-			ip = op.GetInodeInum(de.inum)
+			ip = op.GetInodeInum(inum)
 
 		}
 
-		f(ip, de.name, de.inum, off)
+		f(ip, name, inum, cookie)
 
 		// Release inode early, if this trans didn't own it before.
 		if !own {
 			op.ReleaseInode(ip)
 		}
 
-		off = off + DIRENTSZ
 		// TODO: unclear what dircount is supposed to included so we pad it with
 		// 8 bytes per entry
-		dirbytes += uint64(8 + len(de.name))
-		n += entryplus3Baggage + uint64(len(de.name))
-		if dirbytes >= dircount || n >= maxcount {
-			eof = false
-			break
-		}
+		dirbytes += uint64(8 + len(name))
+		n += entryplus3Baggage + uint64(len(name))
+		return dirbytes < dircount && n < maxcount
 	}
-	return eof
+	if isIndexed(dip, op) {
+		return applyIndexed(dip, op, start, visit)
+	}
+	return applyLinear(dip, op, start, visit)
 }
 
-func ApplyEnts(dip *inode.Inode, op *fstxn.FsTxn, start uint64, count uint64,
-	f func(string, common.Inum, uint64)) bool {
-	var eof bool = true
-	var begin = uint64(start)
-	if begin != 0 {
-		begin += DIRENTSZ
-	}
-	// TODO: this is supposed to track the size of the XDR-encoded reply in
-	// bytes, and we somewhat arbitrarily use 64 as the constant overhead
-	var n uint64 = uint64(64)
-	for off := begin; off < dip.Size; {
+// applyLinear calls f on the entries of dip, a linear directory, from
+// offset start, until f returns false.  It returns whether it reached
+// the end.
+func applyLinear(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
+	f func(name string, inum common.Inum, cookie uint64) bool) bool {
+	for off := start; off < dip.Size; off += DIRENTSZ {
 		data, _ := dip.Read(op.Atxn, off, DIRENTSZ)
 		de := decodeDirEnt(data)
 		util.DPrintf(5, "Apply: # %v %v off %d\n", dip.Inum, de, off)
 		if de.inum == common.NULLINUM {
-			off = off + DIRENTSZ
 			continue
 		}
-		f(de.name, de.inum, off)
+		if !f(de.name, de.inum, off+DIRENTSZ) {
+			return false
+		}
+	}
+	return true
+}
 
-		off = off + DIRENTSZ
+func ApplyEnts(dip *inode.Inode, op *fstxn.FsTxn, start uint64, count uint64,
+	f func(string, common.Inum, uint64)) bool {
+	// TODO: this is supposed to track the size of the XDR-encoded reply in
+	// bytes, and we somewhat arbitrarily use 64 as the constant overhead
+	var n uint64 = uint64(64)
+	visit := func(name string, inum common.Inum, cookie uint64) bool {
+		f(name, inum, cookie)
 		// TODO: estimate of XDR overhead, 16-byte file id, name, cookie, and
 		// pointer for linked list
-		n += uint64(16 + len(de.name) + 8 + 8)
-		if n >= count {
-			eof = false
-			break
-		}
+		n += uint64(16 + len(name) + 8 + 8)
+		return n < count
+	}
+	if isIndexed(dip, op) {
+		return applyIndexed(dip, op, start, visit)
 	}
-	return eof
+	return applyLinear(dip, op, start, visit)
 }
 
 // Caller must ensure de.Name fits
@@ -221,6 +275,39 @@ func encodeDirEnt(de *dirEnt) []byte {
 	return enc.Finish()
 }
 
+// DecodeEnts calls f for each entry in use in data, the contents of a
+// directory, with its offset, and the number of bytes at that offset
+// to zero to remove the entry.  It is for fsck, which reads directories
+// without going through inodes; an entry whose name length is corrupt
+// has ok false.
+func DecodeEnts(data []byte, f func(off uint64, clear uint64, inum common.Inum, name string, ok bool)) {
+	if uint64(len(data)) >= disk.BlockSize {
+		dec := marshal.NewDec(data)
+		if dec.GetInt() == uint64(common.NULLINUM) && dec.GetInt() == DIRMAGIC {
+			decodeIndexed(data, f)
+			return
+		}
+	}
+	decodeLinear(data, f)
+}
+
+func decodeLinear(data []byte, f func(off uint64, clear uint64, inum common.Inum, name string, ok bool)) {
+	for off := uint64(0); off+DIRENTSZ <= uint64(len(data)); off += DIRENTSZ {
+		ent := data[off : off+DIRENTSZ]
+		dec := marshal.NewDec(ent)
+		inum := common.Inum(dec.GetInt())
+		if inum == common.NULLINUM {
+			continue
+		}
+		if dec.GetInt() > LINEARNAMELEN {
+			f(off, DIRENTSZ, inum, "", false)
+			continue
+		}
+		de := decodeDirEnt(ent)
+		f(off, DIRENTSZ, de.inum, de.name, true)
+	}
+}
+
 func decodeDirEnt(d []byte) *dirEnt {
 	dec := marshal.NewDec(d)
 	inum := dec.GetInt()
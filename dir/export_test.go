@@ -0,0 +1,9 @@
+package dir
+
+// SetHashName makes nameKey hash with h, and returns a function that
+// restores the real hash
+func SetHashName(h func(name string) uint64) func() {
+	old := hashName
+	hashName = h
+	return func() { hashName = old }
+}
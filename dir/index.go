@@ -0,0 +1,536 @@
+package dir
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+)
+
+//
+// Indexed directories.  Searching a large linear directory is slow, so
+// new directories on VERSION1 file systems are extendible hash tables
+// keyed by a hash of the name:
+//
+//   - block 0 is the header: the depth of the table, the inums of "."
+//     and "..", and the blocks that hold the table;
+//   - the table has 2^depth entries, and maps the top depth bits of a
+//     hash to the bucket that holds the names with that hash;
+//   - a bucket is a block that starts with the bucket's own depth, and
+//     holds the names whose hash starts with the top bucket-depth bits
+//     of the table indexes that map to it.  Its entries are packed:
+//     each is an inum, a byte of name length, and the name, and the
+//     entries end with a null inum and length, or at the end of the
+//     block.  An entry with a null inum and a name is free.  The word
+//     with the depth also holds, in its top 32 bits, the block of the
+//     bucket's overflow bucket, if it has one.
+//
+// A full bucket splits in two, after doubling the table if the bucket's
+// depth is the table's.  A full bucket at MAXDEPTH can't split, and
+// chains overflow buckets instead.  New buckets and table blocks are
+// appended to the directory.
+//
+// Readdir returns entries in key order.  The cookie of an entry is its
+// key with the low COLLBITS bits replaced by the entry's place among
+// the names whose keys agree in the other bits, in name order, so that
+// names whose hashes collide get cookies of their own.  Cookies stay
+// valid when buckets split.
+//
+// The header and buckets start with a null inum, so that code that
+// scans a linear directory sees their first slot as a free entry.
+//
+
+const (
+	DIRMAGIC    uint64 = 0x78646e4973666e01
+	BUCKETMAGIC uint64 = 0x6b637542736e6601
+
+	NPTR     = disk.BlockSize / 8 // table entries per block
+	MAXDEPTH = 16                 // doubling rewrites 2^MAXDEPTH/NPTR blocks
+
+	COLLBITS = 8 // of a cookie, for names whose keys collide
+	COLLMASK = uint64(1)<<COLLBITS - 1
+
+	BUCKETHDRSZ = 3 * 8
+	ENTHDRSZ    = 8 + 1 // inum and name length
+
+	DOTCOOKIE    uint64 = 1
+	DOTDOTCOOKIE uint64 = 2
+)
+
+type dirHdr struct {
+	depth  uint64
+	dot    common.Inum
+	dotdot common.Inum
+	tblks  []uint64 // blocks of the table
+}
+
+type bucket struct {
+	lblk  uint64
+	depth uint64
+	next  uint64 // overflow bucket, or 0
+	ents  []*dirEnt
+	offs  []uint64 // of ents, in the directory
+}
+
+// hashName hashes name; a variable so that tests can make names collide
+var hashName = func(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	// the top bits of FNV are poorly mixed for short names, and the
+	// table indexes by the top bits; mix them with the finalizer of
+	// MurmurHash3
+	k := h.Sum64()
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+// nameKey is the key of name.  Keys skip the cookies of "." and "..".
+func nameKey(name string) uint64 {
+	k := hashName(name)
+	if k <= COLLMASK {
+		k = COLLMASK + 1
+	}
+	return k
+}
+
+// tableIndex is the table entry for key in a table of depth depth
+func tableIndex(key uint64, depth uint64) uint64 {
+	if depth == 0 {
+		return 0
+	}
+	return key >> (64 - depth)
+}
+
+func isIndexed(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	if dip.Size < disk.BlockSize {
+		return false
+	}
+	data, _ := dip.Read(op.Atxn, 0, 16)
+	dec := marshal.NewDec(data)
+	return dec.GetInt() == uint64(common.NULLINUM) && dec.GetInt() == DIRMAGIC
+}
+
+func readBlk(dip *inode.Inode, op *fstxn.FsTxn, lblk uint64) []byte {
+	data, _ := dip.Read(op.Atxn, lblk*disk.BlockSize, disk.BlockSize)
+	return data
+}
+
+func writeBlk(dip *inode.Inode, op *fstxn.FsTxn, lblk uint64, data []byte) bool {
+	n, _ := dip.Write(op.Atxn, lblk*disk.BlockSize, disk.BlockSize, data)
+	return n == disk.BlockSize
+}
+
+func decodeHdr(data []byte) *dirHdr {
+	dec := marshal.NewDec(data)
+	dec.GetInt() // null inum
+	dec.GetInt() // magic
+	hdr := &dirHdr{}
+	hdr.depth = dec.GetInt()
+	hdr.dot = common.Inum(dec.GetInt())
+	hdr.dotdot = common.Inum(dec.GetInt())
+	ntblk := dec.GetInt()
+	if ntblk > (uint64(len(data))-hdrSz)/8 {
+		ntblk = 0
+	}
+	hdr.tblks = dec.GetInts(ntblk)
+	return hdr
+}
+
+func (hdr *dirHdr) encode() []byte {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(uint64(common.NULLINUM))
+	enc.PutInt(DIRMAGIC)
+	enc.PutInt(hdr.depth)
+	enc.PutInt(uint64(hdr.dot))
+	enc.PutInt(uint64(hdr.dotdot))
+	enc.PutInt(uint64(len(hdr.tblks)))
+	enc.PutInts(hdr.tblks)
+	return enc.Finish()
+}
+
+// the header up to the table blocks
+const hdrSz = 6 * 8
+
+func readHdr(dip *inode.Inode, op *fstxn.FsTxn) *dirHdr {
+	data, _ := dip.Read(op.Atxn, 0, hdrSz)
+	ntblk := marshal.NewDec(data[hdrSz-8:]).GetInt()
+	tblks, _ := dip.Read(op.Atxn, hdrSz, ntblk*8)
+	return decodeHdr(append(data, tblks...))
+}
+
+func writeHdr(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr) bool {
+	return writeBlk(dip, op, 0, hdr.encode())
+}
+
+func tableGet(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, i uint64) uint64 {
+	off := hdr.tblks[i/NPTR]*disk.BlockSize + (i%NPTR)*8
+	data, _ := dip.Read(op.Atxn, off, 8)
+	return marshal.NewDec(data).GetInt()
+}
+
+func tableSet(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, i uint64, lblk uint64) bool {
+	off := hdr.tblks[i/NPTR]*disk.BlockSize + (i%NPTR)*8
+	enc := marshal.NewEnc(8)
+	enc.PutInt(lblk)
+	n, _ := dip.Write(op.Atxn, off, 8, enc.Finish())
+	return n == 8
+}
+
+func isBucket(data []byte) bool {
+	dec := marshal.NewDec(data)
+	return dec.GetInt() == uint64(common.NULLINUM) && dec.GetInt() == BUCKETMAGIC
+}
+
+func entSize(name string) uint64 {
+	return ENTHDRSZ + uint64(len(name))
+}
+
+// decodeBucket calls f for each entry in use in blk, a bucket, with its
+// offset in blk.  It stops at an entry whose length is corrupt, which
+// has ok false.
+func decodeBucket(blk []byte, f func(off uint64, inum common.Inum, name string, ok bool)) {
+	for off := uint64(BUCKETHDRSZ); off+ENTHDRSZ <= uint64(len(blk)); {
+		inum := common.Inum(marshal.NewDec(blk[off:]).GetInt())
+		l := uint64(blk[off+8])
+		if l == 0 {
+			if inum != common.NULLINUM {
+				f(off, inum, "", false)
+			}
+			return
+		}
+		if off+ENTHDRSZ+l > uint64(len(blk)) {
+			f(off, inum, "", false)
+			return
+		}
+		if inum != common.NULLINUM {
+			f(off, inum, string(blk[off+ENTHDRSZ:off+ENTHDRSZ+l]), true)
+		}
+		off += ENTHDRSZ + l
+	}
+}
+
+func readBucket(dip *inode.Inode, op *fstxn.FsTxn, lblk uint64) *bucket {
+	data := readBlk(dip, op, lblk)
+	dec := marshal.NewDec(data)
+	dec.GetInt() // null inum
+	dec.GetInt() // magic
+	w := dec.GetInt()
+	b := &bucket{lblk: lblk, depth: w & 0xffffffff, next: w >> 32}
+	decodeBucket(data, func(off uint64, inum common.Inum, name string, ok bool) {
+		if ok {
+			b.ents = append(b.ents, &dirEnt{inum: inum, name: name})
+			b.offs = append(b.offs, lblk*disk.BlockSize+off)
+		}
+	})
+	return b
+}
+
+// writeBucket writes b with its entries packed, which reuses the space
+// of removed entries
+func writeBucket(dip *inode.Inode, op *fstxn.FsTxn, b *bucket) bool {
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(uint64(common.NULLINUM))
+	enc.PutInt(BUCKETMAGIC)
+	enc.PutInt(b.next<<32 | b.depth)
+	for _, de := range b.ents {
+		enc.PutInt(uint64(de.inum))
+		enc.PutBytes([]byte{byte(len(de.name))})
+		enc.PutBytes([]byte(de.name))
+	}
+	return writeBlk(dip, op, b.lblk, enc.Finish())
+}
+
+// used is how many bytes of its block b takes when packed
+func (b *bucket) used() uint64 {
+	var used = uint64(BUCKETHDRSZ)
+	for _, de := range b.ents {
+		used += entSize(de.name)
+	}
+	return used
+}
+
+// fits reports whether b has room for name
+func (b *bucket) fits(name string) bool {
+	return b.used()+entSize(name) <= disk.BlockSize
+}
+
+// lookupBucket returns the bucket for key
+func lookupBucket(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, key uint64) *bucket {
+	lblk := tableGet(dip, op, hdr, tableIndex(key, hdr.depth))
+	return readBucket(dip, op, lblk)
+}
+
+// readChain returns the bucket at lblk and its overflow buckets
+func readChain(dip *inode.Inode, op *fstxn.FsTxn, lblk uint64) []*bucket {
+	b := readBucket(dip, op, lblk)
+	chain := []*bucket{b}
+	for b.next != 0 && uint64(len(chain)) < dip.Size/disk.BlockSize {
+		b = readBucket(dip, op, b.next)
+		chain = append(chain, b)
+	}
+	return chain
+}
+
+// lookupChain returns the buckets for key
+func lookupChain(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, key uint64) []*bucket {
+	return readChain(dip, op, tableGet(dip, op, hdr, tableIndex(key, hdr.depth)))
+}
+
+// initIndexed makes dip an empty indexed directory: a header, a table
+// of one entry, and one bucket
+func initIndexed(dip *inode.Inode, op *fstxn.FsTxn, parent common.Inum) bool {
+	hdr := &dirHdr{depth: 0, dot: dip.Inum, dotdot: parent, tblks: []uint64{1}}
+	if !writeHdr(dip, op, hdr) {
+		return false
+	}
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(2)
+	if !writeBlk(dip, op, 1, enc.Finish()) {
+		return false
+	}
+	return writeBucket(dip, op, &bucket{lblk: 2, depth: 0})
+}
+
+func lookupIndexed(dip *inode.Inode, op *fstxn.FsTxn, name string) (common.Inum, uint64) {
+	hdr := readHdr(dip, op)
+	if name == "." {
+		return hdr.dot, 0
+	}
+	if name == ".." {
+		return hdr.dotdot, 0
+	}
+	for _, b := range lookupChain(dip, op, hdr, nameKey(name)) {
+		for i, de := range b.ents {
+			if de.name == name {
+				return de.inum, b.offs[i]
+			}
+		}
+	}
+	return common.NULLINUM, 0
+}
+
+// addIndexed adds name to dip, splitting buckets until there is room,
+// or adding an overflow bucket once the bucket is at MAXDEPTH
+func addIndexed(dip *inode.Inode, op *fstxn.FsTxn, inum common.Inum, name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	key := nameKey(name)
+	for {
+		hdr := readHdr(dip, op)
+		b := lookupBucket(dip, op, hdr, key)
+		if b.fits(name) {
+			util.DPrintf(5, "addIndexed # %v: %v %v bucket %d\n", dip.Inum, name, inum, b.lblk)
+			b.ents = append(b.ents, &dirEnt{inum: inum, name: name})
+			return writeBucket(dip, op, b)
+		}
+		if b.depth == MAXDEPTH {
+			return addOverflow(dip, op, readChain(dip, op, b.lblk), inum, name)
+		}
+		if b.depth == hdr.depth {
+			if !doubleTable(dip, op, hdr) {
+				return false
+			}
+			continue
+		}
+		if !splitBucket(dip, op, hdr, b, key) {
+			return false
+		}
+	}
+}
+
+// addOverflow adds name to the first bucket of chain with room for it,
+// or to a new overflow bucket at the end of the chain
+func addOverflow(dip *inode.Inode, op *fstxn.FsTxn, chain []*bucket, inum common.Inum, name string) bool {
+	de := &dirEnt{inum: inum, name: name}
+	for _, b := range chain {
+		if b.fits(name) {
+			b.ents = append(b.ents, de)
+			return writeBucket(dip, op, b)
+		}
+	}
+	last := chain[len(chain)-1]
+	nb := &bucket{lblk: dip.Size / disk.BlockSize, depth: last.depth,
+		ents: []*dirEnt{de}}
+	last.next = nb.lblk
+	util.DPrintf(1, "addOverflow # %v: %d -> %d\n", dip.Inum, last.lblk, nb.lblk)
+	return writeBucket(dip, op, nb) && writeBucket(dip, op, last)
+}
+
+// doubleTable doubles the table, so that entries 2i and 2i+1 of the new
+// table map to the bucket that entry i of the old one does
+func doubleTable(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr) bool {
+	n := uint64(1) << hdr.depth
+	old := make([]uint64, n)
+	for i := uint64(0); i < n; i++ {
+		old[i] = tableGet(dip, op, hdr, i)
+	}
+	hdr.depth++
+	for uint64(len(hdr.tblks))*NPTR < 2*n {
+		hdr.tblks = append(hdr.tblks, dip.Size/disk.BlockSize)
+		if !writeBlk(dip, op, dip.Size/disk.BlockSize, make([]byte, disk.BlockSize)) {
+			return false
+		}
+	}
+	for t, lblk := range hdr.tblks {
+		enc := marshal.NewEnc(disk.BlockSize)
+		for i := uint64(t) * NPTR; i < uint64(t+1)*NPTR && i < 2*n; i++ {
+			enc.PutInt(old[i/2])
+		}
+		if !writeBlk(dip, op, lblk, enc.Finish()) {
+			return false
+		}
+	}
+	util.DPrintf(1, "doubleTable # %v: depth %d\n", dip.Inum, hdr.depth)
+	return writeHdr(dip, op, hdr)
+}
+
+// splitBucket splits b, which holds key and has a smaller depth than
+// the table, moving the entries whose next hash bit is 1 into a new
+// bucket
+func splitBucket(dip *inode.Inode, op *fstxn.FsTxn, hdr *dirHdr, b *bucket, key uint64) bool {
+	span := uint64(1) << (hdr.depth - b.depth)
+	lo := tableIndex(key, hdr.depth) / span * span
+	nb := &bucket{lblk: dip.Size / disk.BlockSize, depth: b.depth + 1}
+	var stay []*dirEnt
+	for _, de := range b.ents {
+		if (nameKey(de.name)>>(63-b.depth))&1 == 1 {
+			nb.ents = append(nb.ents, de)
+		} else {
+			stay = append(stay, de)
+		}
+	}
+	b.ents = stay
+	b.depth++
+	if !writeBucket(dip, op, nb) || !writeBucket(dip, op, b) {
+		return false
+	}
+	for i := lo + span/2; i < lo+span; i++ {
+		if !tableSet(dip, op, hdr, i, nb.lblk) {
+			return false
+		}
+	}
+	util.DPrintf(5, "splitBucket # %v: %d -> %d depth %d\n", dip.Inum, b.lblk, nb.lblk, b.depth)
+	return true
+}
+
+func remIndexed(dip *inode.Inode, op *fstxn.FsTxn, name string) bool {
+	if name == "." || name == ".." {
+		return false
+	}
+	hdr := readHdr(dip, op)
+	for _, b := range lookupChain(dip, op, hdr, nameKey(name)) {
+		for i, de := range b.ents {
+			if de.name == name {
+				util.DPrintf(5, "remIndexed # %v: %v %v bucket %d\n", dip.Inum, name, de.inum, b.lblk)
+				b.ents = append(b.ents[:i], b.ents[i+1:]...)
+				b.offs = nil
+				return writeBucket(dip, op, b)
+			}
+		}
+	}
+	return false
+}
+
+func setParentIndexed(dip *inode.Inode, op *fstxn.FsTxn, parent common.Inum) bool {
+	hdr := readHdr(dip, op)
+	hdr.dotdot = parent
+	return writeHdr(dip, op, hdr)
+}
+
+// applyIndexed calls f on ".", "..", and then the entries of dip in key
+// order, starting after cookie start, until f returns false.  It
+// returns whether it reached the end.
+func applyIndexed(dip *inode.Inode, op *fstxn.FsTxn, start uint64,
+	f func(name string, inum common.Inum, cookie uint64) bool) bool {
+	hdr := readHdr(dip, op)
+	if start < DOTCOOKIE && !f(".", hdr.dot, DOTCOOKIE) {
+		return false
+	}
+	if start < DOTDOTCOOKIE && !f("..", hdr.dotdot, DOTDOTCOOKIE) {
+		return false
+	}
+	n := uint64(1) << hdr.depth
+	var i uint64
+	if start > DOTDOTCOOKIE {
+		i = tableIndex(start, hdr.depth)
+	}
+	for i < n {
+		chain := readChain(dip, op, tableGet(dip, op, hdr, i))
+		var ents []*dirEnt
+		for _, b := range chain {
+			ents = append(ents, b.ents...)
+		}
+		cookies := bucketCookies(ents)
+		for x, de := range ents {
+			if cookies[x] > start && !f(de.name, de.inum, cookies[x]) {
+				return false
+			}
+		}
+		// skip the other table entries that map to the bucket
+		span := uint64(1) << (hdr.depth - chain[0].depth)
+		i = i/span*span + span
+	}
+	return true
+}
+
+// bucketCookies sorts ents, the entries of a bucket and its overflow
+// buckets, into cookie order, and returns their cookies
+func bucketCookies(ents []*dirEnt) []uint64 {
+	sort.Slice(ents, func(x, y int) bool {
+		kx := nameKey(ents[x].name) &^ COLLMASK
+		ky := nameKey(ents[y].name) &^ COLLMASK
+		return kx < ky || kx == ky && ents[x].name < ents[y].name
+	})
+	cookies := make([]uint64, len(ents))
+	for x, de := range ents {
+		k := nameKey(de.name) &^ COLLMASK
+		cookies[x] = k
+		if x > 0 && cookies[x-1]&^COLLMASK == k {
+			// more than COLLMASK+1 names that collide share a cookie
+			cookies[x] = cookies[x-1]
+			if cookies[x]&COLLMASK < COLLMASK {
+				cookies[x]++
+			}
+		}
+	}
+	return cookies
+}
+
+// emptyIndexed reports whether dip has no entries besides "." and ".."
+func emptyIndexed(dip *inode.Inode, op *fstxn.FsTxn) bool {
+	return applyIndexed(dip, op, DOTDOTCOOKIE,
+		func(string, common.Inum, uint64) bool { return false })
+}
+
+// decodeIndexed is DecodeEnts for the contents of an indexed directory.
+// Clearing the inum of an entry frees it; clearing the rest of the block
+// from a corrupt entry ends the bucket there.
+func decodeIndexed(data []byte, f func(off uint64, clear uint64, inum common.Inum, name string, ok bool)) {
+	hdr := decodeHdr(data)
+	f(0, 0, hdr.dot, ".", true)
+	f(0, 0, hdr.dotdot, "..", true)
+	for lblk := uint64(1); (lblk+1)*disk.BlockSize <= uint64(len(data)); lblk++ {
+		blk := data[lblk*disk.BlockSize : (lblk+1)*disk.BlockSize]
+		if !isBucket(blk) {
+			continue
+		}
+		decodeBucket(blk, func(off uint64, inum common.Inum, name string, ok bool) {
+			var clear uint64 = 8
+			if !ok {
+				clear = disk.BlockSize - off
+			}
+			f(lblk*disk.BlockSize+off, clear, inum, name, ok)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package dir_test
+
+import (
+	"hash/fnv"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/nfs"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+// collideHash gives all names the same top 24 bits, so that they land
+// in one bucket until it reaches MAXDEPTH, and names that start with
+// "c" the same key
+func collideHash(name string) uint64 {
+	if name[0] == 'c' {
+		return dir.COLLMASK + 1
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64() & (1<<40 - 1)
+}
+
+func readDirAll(t *testing.T, clnt *nfs.NfsClient, cnt uint64) map[string]bool {
+	names := make(map[string]bool)
+	var cookie nfstypes.Cookie3
+	var verf nfstypes.Cookieverf3
+	for {
+		reply := clnt.ReadDirOp(fh.MkRootFh3(), cookie, verf, cnt)
+		require.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		verf = reply.Resok.Cookieverf
+		for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+			assert.False(t, names[string(e.Name)], "%q twice", e.Name)
+			names[string(e.Name)] = true
+			cookie = e.Cookie
+		}
+		if reply.Resok.Reply.Eof {
+			return names
+		}
+	}
+}
+
+// Names whose hashes collide, and more names than a bucket at MAXDEPTH
+// holds, go in overflow buckets
+func TestIndexOverflow(t *testing.T) {
+	defer dir.SetHashName(collideHash)()
+	clnt := nfs.MkNfsClient(10 * 1000)
+	defer clnt.Shutdown()
+
+	root := fh.MkRootFh3()
+	const N = 1000
+	const NCOLL = 40
+	names := map[string]bool{".": true, "..": true}
+	for i := 0; i < N; i++ {
+		name := "x" + strconv.Itoa(i)
+		if i < NCOLL {
+			name = "c" + strconv.Itoa(i)
+		}
+		reply := clnt.CreateOp(root, name)
+		require.Equal(t, nfstypes.NFS3_OK, reply.Status, name)
+		names[name] = true
+	}
+	for name := range names {
+		reply := clnt.LookupOp(root, name)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status, name)
+	}
+	assert.Equal(t, names, readDirAll(t, clnt, 512))
+
+	attr := clnt.GetattrOp(root)
+	require.Equal(t, nfstypes.NFS3_OK, attr.Status)
+	sz := attr.Resok.Obj_attributes.Size
+
+	for i := 0; i < N; i++ {
+		if i%5 == 0 {
+			continue
+		}
+		name := "x" + strconv.Itoa(i)
+		if i < NCOLL {
+			name = "c" + strconv.Itoa(i)
+		}
+		reply := clnt.RemoveOp(root, name)
+		require.Equal(t, nfstypes.NFS3_OK, reply.Status, name)
+		delete(names, name)
+	}
+
+	// the compactor packs the overflow buckets
+	for i := 0; i < 10; i++ {
+		attr = clnt.GetattrOp(root)
+		if attr.Resok.Obj_attributes.Size < sz {
+			break
+		}
+		time.Sleep(nfs.COMPACTINTERVAL)
+	}
+	assert.Less(t, uint64(attr.Resok.Obj_attributes.Size), uint64(sz))
+
+	for i := 0; i < N; i++ {
+		name := "x" + strconv.Itoa(i)
+		if i < NCOLL {
+			name = "c" + strconv.Itoa(i)
+		}
+		reply := clnt.LookupOp(root, name)
+		if names[name] {
+			assert.Equal(t, nfstypes.NFS3_OK, reply.Status, name)
+		} else {
+			assert.Equal(t, nfstypes.NFS3ERR_NOENT, reply.Status, name)
+		}
+	}
+	assert.Equal(t, names, readDirAll(t, clnt, 512))
+}
@@ -0,0 +1,523 @@
+package fsck
+
+//
+// fsck checks a file system offline.  It replays the log (in memory,
+// unless it repairs the file system), and then cross-checks the inodes,
+// the directory tree, and the bitmaps:
+//
+//   - every block an inode points to is a data block, owned by only that
+//     inode, and allocated in the block bitmap, and every allocated data
+//     block is owned by an inode;
+//   - an inode is allocated in the inode bitmap if and only if it is in
+//     use, in use inodes have a known kind and a generation, and they are
+//     reachable from the root;
+//   - directory entries name inodes in use, each directory has "." and
+//     "..", and only one name;
+//   - the orphan list, which starts at inode 0, holds only inodes in use
+//     with no names, and these are the only inodes in use without names;
+//   - Nlink counts the names of an inode (see inode.nlink);
+//   - no inode was left half-shrunk.
+//
+// In repair mode, fsck also fixes what it can, in transactions through
+// the log.
+//
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/goose-lang/primitive/disk"
+
+	"github.com/mit-pdos/go-journal/addr"
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/jrnl"
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/shrinker"
+	"github.com/mit-pdos/go-nfsd/super"
+)
+
+// Kinds of findings
+const (
+	BLOCKRANGE  = "block-range"  // pointer outside the data blocks
+	BLOCKDUP    = "block-dup"    // block owned by more than one inode
+	BLOCKFREE   = "block-free"   // owned block free in the bitmap
+	BLOCKLEAK   = "block-leak"   // allocated block owned by no inode
+	INODEBITMAP = "inode-bitmap" // inode bitmap disagrees with inode kind
+	INODEKIND   = "inode-kind"   // unknown kind
+	INODEGEN    = "inode-gen"    // in use with generation 0
+	ORPHAN      = "orphan"       // in use but not reachable from the root
+	ORPHANLIST  = "orphan-list"  // orphan list names an inode that isn't an orphan
+	NLINK       = "nlink"        // Nlink doesn't count the inode's names
+	SHRINK      = "shrink"       // left half-shrunk
+	DIRENT      = "dirent"       // entry names a bad inode or is corrupt
+	DIRDOTS     = "dir-dots"     // "." or ".." missing or wrong
+	DIRPARENT   = "dir-parent"   // directory with more than one name
+)
+
+// A Finding is one problem fsck found
+type Finding struct {
+	Kind     string `json:"kind"`
+	Inum     uint64 `json:"inum,omitempty"`
+	Bnum     uint64 `json:"bnum,omitempty"`
+	Msg      string `json:"msg"`
+	Repaired bool   `json:"repaired"`
+}
+
+// A Report is the result of checking a file system
+type Report struct {
+	Inodes   uint64    `json:"inodes"` // in use
+	Blocks   uint64    `json:"blocks"` // owned by inodes
+	Findings []Finding `json:"findings"`
+}
+
+// Clean reports whether fsck found no problems
+func (r *Report) Clean() bool {
+	return len(r.Findings) == 0
+}
+
+// Repaired reports whether fsck repaired all the problems it found
+func (r *Report) Repaired() bool {
+	for _, f := range r.Findings {
+		if !f.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+type checker struct {
+	super  *super.FsSuper
+	log    *obj.Log
+	repair bool
+	op     *jrnl.Op
+	report *Report
+
+	inodes  []*inode.Inode
+	owner   map[common.Bnum]common.Inum
+	blkmap  map[common.Inum]map[uint64]common.Bnum // data blocks of dirs
+	visited []bool
+	listed  []bool // on the orphan list
+	parent  []common.Inum
+	dotdot  []common.Inum
+	refs    []uint32
+	shrink  []common.Inum
+}
+
+// Check checks the file system on d, and repairs it if repair is true.
+// It fails if d has no file system that it can read.  Unless repair is
+// true, it doesn't write d: it replays the log into memory.
+func Check(d disk.Disk, repair bool) (*Report, error) {
+	if !repair {
+		o := mkOverlay(d)
+		defer o.Close()
+		d = o
+	}
+	fssuper, serr := super.ReadFsSuper(d)
+	if serr != super.OK {
+		return nil, fmt.Errorf("can't read superblock (error %d)", serr)
+	}
+	log := obj.MkLog(d) // runs recovery
+	defer log.Shutdown()
+
+	ninode := uint64(fssuper.NInode())
+	c := &checker{
+		super:   fssuper,
+		log:     log,
+		repair:  repair,
+		report:  &Report{Findings: make([]Finding, 0)},
+		inodes:  make([]*inode.Inode, ninode),
+		owner:   make(map[common.Bnum]common.Inum),
+		blkmap:  make(map[common.Inum]map[uint64]common.Bnum),
+		visited: make([]bool, ninode),
+		listed:  make([]bool, ninode),
+		parent:  make([]common.Inum, ninode),
+		dotdot:  make([]common.Inum, ninode),
+		refs:    make([]uint32, ninode),
+	}
+	// inode 0 holds the head of the orphan list
+	c.inodes[common.NULLINUM] = c.readInode(common.NULLINUM)
+	for inum := common.ROOTINUM; uint64(inum) < ninode; inum++ {
+		c.inodes[inum] = c.readInode(inum)
+	}
+	root := c.inodes[common.ROOTINUM]
+	if root.Kind != nfstypes.NF3DIR {
+		return nil, errors.New("root is not a directory")
+	}
+	c.walkOrphans()
+	c.walkBlocks()
+	c.walkTree()
+	c.checkInodes()
+	c.checkBlockBitmap()
+	c.commit()
+	c.finishShrinks()
+	return c.report, nil
+}
+
+func (c *checker) find(kind string, inum common.Inum, bnum common.Bnum,
+	repaired bool, format string, a ...interface{}) {
+	f := Finding{
+		Kind:     kind,
+		Inum:     uint64(inum),
+		Bnum:     uint64(bnum),
+		Msg:      fmt.Sprintf(format, a...),
+		Repaired: repaired,
+	}
+	util.DPrintf(1, "fsck: %v\n", f)
+	c.report.Findings = append(c.report.Findings, f)
+}
+
+func (c *checker) readInode(inum common.Inum) *inode.Inode {
+	buf := c.log.Load(c.super.Inum2Addr(inum), c.super.InodeSz()*8)
+	return inode.Decode(buf, inum)
+}
+
+func (c *checker) validBlock(bn common.Bnum) bool {
+	return bn >= c.super.DataStart() && bn < c.super.MaxBnum()
+}
+
+func (c *checker) readBlock(bn common.Bnum) []byte {
+	if !c.validBlock(bn) {
+		return nil
+	}
+	return c.log.Load(c.super.Block2addr(bn), common.NBITBLOCK).Data
+}
+
+func validKind(kind nfstypes.Ftype3) bool {
+	return kind >= nfstypes.NF3REG && kind <= nfstypes.NF3FIFO
+}
+
+// holdsBlocks reports whether ip's blocks are in use: those of an inode
+// in use, and those of a free inode that is still shrinking
+func holdsBlocks(ip *inode.Inode) bool {
+	return validKind(ip.Kind) || (ip.Kind == inode.NF3FREE && ip.IsShrinking())
+}
+
+// walkBlocks records the owner of every block, and the data blocks of
+// directories
+func (c *checker) walkBlocks() {
+	for _, ip := range c.inodes[common.ROOTINUM:] {
+		if !holdsBlocks(ip) {
+			continue
+		}
+		inum := ip.Inum
+		var blks map[uint64]common.Bnum
+		if ip.Kind == nfstypes.NF3DIR {
+			blks = make(map[uint64]common.Bnum)
+			c.blkmap[inum] = blks
+		}
+		ip.Walk(c.readBlock, func(bn uint64, blkno common.Bnum, index bool) {
+			if !c.validBlock(blkno) {
+				c.find(BLOCKRANGE, inum, blkno, false,
+					"inode %d points to block %d outside [%d, %d)",
+					inum, blkno, c.super.DataStart(), c.super.MaxBnum())
+				return
+			}
+			if o, ok := c.owner[blkno]; ok {
+				c.find(BLOCKDUP, inum, blkno, false,
+					"block %d is owned by inodes %d and %d", blkno, o, inum)
+				return
+			}
+			c.owner[blkno] = inum
+			if blks != nil && !index {
+				blks[bn] = blkno
+			}
+		})
+	}
+	c.report.Blocks = uint64(len(c.owner))
+}
+
+// readDir returns the contents of directory dip
+func (c *checker) readDir(dip *inode.Inode) []byte {
+	data := make([]byte, util.RoundUp(dip.Size, disk.BlockSize)*disk.BlockSize)
+	for bn, blkno := range c.blkmap[dip.Inum] {
+		if bn*disk.BlockSize < uint64(len(data)) {
+			copy(data[bn*disk.BlockSize:], c.readBlock(blkno))
+		}
+	}
+	return data[:dip.Size]
+}
+
+// walkOrphans follows the orphan list, and cuts it at the first inode
+// that isn't an orphan
+func (c *checker) walkOrphans() {
+	prev := c.inodes[common.NULLINUM]
+	for prev.Next != common.NULLINUM {
+		next := prev.Next
+		if uint64(next) >= uint64(len(c.inodes)) || next < common.ROOTINUM ||
+			c.listed[next] || !validKind(c.inodes[next].Kind) ||
+			c.inodes[next].Nlink != 0 {
+			c.find(ORPHANLIST, prev.Inum, 0, c.cutList(prev),
+				"orphan list names inode %d after inode %d, which is not an orphan",
+				next, prev.Inum)
+			return
+		}
+		c.listed[next] = true
+		prev = c.inodes[next]
+	}
+}
+
+// walkTree walks the directory tree from the root, counting the names of
+// each inode
+func (c *checker) walkTree() {
+	c.visited[common.ROOTINUM] = true
+	c.parent[common.ROOTINUM] = common.ROOTINUM
+	queue := []common.Inum{common.ROOTINUM}
+	for len(queue) > 0 {
+		dinum := queue[0]
+		queue = queue[1:]
+		queue = append(queue, c.walkDir(c.inodes[dinum])...)
+	}
+}
+
+// walkDir checks the entries of dip, and returns the directories it
+// names that haven't been visited yet
+func (c *checker) walkDir(dip *inode.Inode) []common.Inum {
+	var subdirs []common.Inum
+	var dot = common.NULLINUM
+	c.dotdot[dip.Inum] = common.NULLINUM
+	dir.DecodeEnts(c.readDir(dip), func(off uint64, clear uint64, inum common.Inum, name string, ok bool) {
+		if !ok {
+			c.find(DIRENT, dip.Inum, 0, c.clearEnt(dip, off, clear),
+				"directory %d has a corrupt entry at offset %d", dip.Inum, off)
+			return
+		}
+		if uint64(inum) >= uint64(len(c.inodes)) || inum == common.NULLINUM ||
+			!validKind(c.inodes[inum].Kind) {
+			if name == "." || name == ".." {
+				// leave it for the DIRDOTS check
+				return
+			}
+			c.find(DIRENT, dip.Inum, 0, c.clearEnt(dip, off, clear),
+				"directory %d entry %q names inode %d, which is not in use",
+				dip.Inum, name, inum)
+			return
+		}
+		if name == "." {
+			dot = inum
+			return
+		}
+		c.refs[inum]++
+		if name == ".." {
+			c.dotdot[dip.Inum] = inum
+			return
+		}
+		ip := c.inodes[inum]
+		if ip.Kind == nfstypes.NF3DIR {
+			if c.visited[inum] {
+				c.find(DIRPARENT, inum, 0, false,
+					"directory %d has another name %q in directory %d",
+					inum, name, dip.Inum)
+				return
+			}
+			c.parent[inum] = dip.Inum
+			subdirs = append(subdirs, inum)
+		}
+		c.visited[inum] = true
+	})
+	if dot != dip.Inum {
+		c.find(DIRDOTS, dip.Inum, 0, false,
+			"directory %d has \".\" naming %d", dip.Inum, dot)
+	}
+	if c.dotdot[dip.Inum] != c.parent[dip.Inum] {
+		c.find(DIRDOTS, dip.Inum, 0, false,
+			"directory %d has \"..\" naming %d instead of %d",
+			dip.Inum, c.dotdot[dip.Inum], c.parent[dip.Inum])
+	}
+	return subdirs
+}
+
+// checkInodes checks each inode against the inode bitmap and the names
+// found for it
+func (c *checker) checkInodes() {
+	start := c.super.BitmapInodeStart()
+	for _, ip := range c.inodes[common.ROOTINUM:] {
+		inum := ip.Inum
+		inuse := validKind(ip.Kind)
+		if !inuse && ip.Kind != inode.NF3FREE {
+			c.find(INODEKIND, inum, 0, false,
+				"inode %d has unknown kind %d", inum, ip.Kind)
+			continue
+		}
+		if ip.IsShrinking() {
+			c.find(SHRINK, inum, 0, c.repair,
+				"inode %d was left shrinking from %d to %d blocks", inum,
+				ip.ShrinkSize, util.RoundUp(ip.Size, disk.BlockSize))
+			c.shrink = append(c.shrink, inum)
+		}
+		if inuse {
+			c.report.Inodes++
+		}
+		// the root's bit is always set
+		alloc := inum == common.ROOTINUM || c.isAlloc(start, uint64(inum))
+		if inuse && !c.visited[inum] && !c.listed[inum] {
+			c.find(ORPHAN, inum, 0, c.freeOrphan(ip, alloc),
+				"inode %d is in use but has no name", inum)
+			continue
+		}
+		if alloc != inuse {
+			c.find(INODEBITMAP, inum, 0, c.setBit(start, uint64(inum), inuse),
+				"inode %d is allocated %v in the bitmap but in use %v",
+				inum, alloc, inuse)
+		}
+		if !inuse {
+			continue
+		}
+		if ip.Nlink != c.refs[inum] {
+			c.find(NLINK, inum, 0, c.setNlink(ip),
+				"inode %d has Nlink %d but %d names", inum, ip.Nlink, c.refs[inum])
+		}
+		if ip.Gen == 0 {
+			ip.Gen = 1
+			c.find(INODEGEN, inum, 0, c.writeInode(ip),
+				"inode %d is in use with generation 0", inum)
+		}
+	}
+}
+
+func (c *checker) checkBlockBitmap() {
+	for bn := c.super.DataStart(); bn < c.super.MaxBnum(); bn++ {
+		inum, owned := c.owner[bn]
+		alloc := c.isAlloc(c.super.BitmapBlockStart(), uint64(bn))
+		if owned && !alloc {
+			c.find(BLOCKFREE, inum, bn, c.setBit(c.super.BitmapBlockStart(), uint64(bn), true),
+				"block %d of inode %d is free in the bitmap", bn, inum)
+		}
+		if !owned && alloc {
+			c.find(BLOCKLEAK, 0, bn, c.setBit(c.super.BitmapBlockStart(), uint64(bn), false),
+				"block %d is allocated but has no owner", bn)
+		}
+	}
+}
+
+func (c *checker) isAlloc(start common.Bnum, n uint64) bool {
+	a := addr.MkBitAddr(start, n)
+	buf := c.log.Load(a, 1)
+	return buf.Data[0]&(1<<(a.Off%8)) != 0
+}
+
+//
+// Repairs.  Each returns whether it repaired anything.
+//
+
+func (c *checker) write(a addr.Addr, sz uint64, data []byte) {
+	if c.op == nil {
+		c.op = jrnl.Begin(c.log)
+	}
+	c.op.OverWrite(a, sz, data)
+	if c.op.NDirty() >= jrnl.LogBlocks/2 {
+		c.commit()
+	}
+}
+
+func (c *checker) commit() {
+	if c.op == nil {
+		return
+	}
+	if !c.op.CommitWait(true) {
+		panic("fsck: commit")
+	}
+	c.op = nil
+}
+
+func (c *checker) writeInode(ip *inode.Inode) bool {
+	if !c.repair {
+		return false
+	}
+	sz := c.super.InodeSz()
+	c.write(c.super.Inum2Addr(ip.Inum), sz*8, ip.Encode(sz))
+	return true
+}
+
+func (c *checker) setBit(start common.Bnum, n uint64, alloc bool) bool {
+	if !c.repair {
+		return false
+	}
+	// like alloctxn.WriteBits
+	var b = byte(1 << (n % 8))
+	if !alloc {
+		b = ^b
+	}
+	c.write(addr.MkBitAddr(start, n), 1, []byte{b})
+	return true
+}
+
+// clearEnt frees the entry at off in dip by zeroing sz bytes
+func (c *checker) clearEnt(dip *inode.Inode, off uint64, sz uint64) bool {
+	if !c.repair {
+		return false
+	}
+	blkno := c.blkmap[dip.Inum][off/disk.BlockSize]
+	a := addr.MkAddr(blkno, (off%disk.BlockSize)*8)
+	c.write(a, sz*8, make([]byte, sz))
+	return true
+}
+
+// cutList ends the orphan list at ip
+func (c *checker) cutList(ip *inode.Inode) bool {
+	if !c.repair {
+		return false
+	}
+	ip.Next = common.NULLINUM
+	return c.writeInode(ip)
+}
+
+func (c *checker) setNlink(ip *inode.Inode) bool {
+	if !c.repair {
+		return false
+	}
+	ip.Nlink = c.refs[ip.Inum]
+	return c.writeInode(ip)
+}
+
+// freeOrphan frees ip the way removing its last name does: by
+// truncating it and leaving it shrinking, which finishShrinks finishes
+func (c *checker) freeOrphan(ip *inode.Inode, alloc bool) bool {
+	if !c.repair {
+		return false
+	}
+	sz := util.RoundUp(ip.Size, disk.BlockSize)
+	if sz > ip.ShrinkSize {
+		ip.ShrinkSize = sz
+	}
+	ip.Size = 0
+	ip.Nlink = 0
+	ip.Kind = inode.NF3FREE
+	ip.Gen = ip.Gen + 1
+	c.writeInode(ip)
+	if alloc {
+		c.setBit(c.super.BitmapInodeStart(), uint64(ip.Inum), false)
+	}
+	if ip.IsShrinking() && !inList(c.shrink, ip.Inum) {
+		c.shrink = append(c.shrink, ip.Inum)
+	}
+	return true
+}
+
+func inList(l []common.Inum, inum common.Inum) bool {
+	for _, i := range l {
+		if i == inum {
+			return true
+		}
+	}
+	return false
+}
+
+// finishShrinks frees the blocks of shrinking inodes, once the bitmaps
+// are right, with the same code the server uses
+func (c *checker) finishShrinks() {
+	if !c.repair || len(c.shrink) == 0 {
+		return
+	}
+	st := fstxn.MkFsState(c.super, c.log)
+	shrinkst := shrinker.MkShrinkerSt(st)
+	for _, inum := range c.shrink {
+		if !shrinkst.DoShrink(inum) {
+			panic("fsck: shrink")
+		}
+	}
+}
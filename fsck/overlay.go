@@ -0,0 +1,66 @@
+package fsck
+
+//
+// overlay keeps the writes to a disk in memory, so that a check without
+// repair can replay the log, and see the file system the server would,
+// without changing the disk.
+//
+
+import (
+	"sync"
+
+	"github.com/goose-lang/primitive/disk"
+)
+
+type overlay struct {
+	mu      *sync.Mutex
+	d       disk.Disk
+	written map[uint64]disk.Block
+}
+
+func mkOverlay(d disk.Disk) *overlay {
+	return &overlay{
+		mu:      new(sync.Mutex),
+		d:       d,
+		written: make(map[uint64]disk.Block),
+	}
+}
+
+func (o *overlay) Read(a uint64) disk.Block {
+	b := make(disk.Block, disk.BlockSize)
+	o.ReadTo(a, b)
+	return b
+}
+
+func (o *overlay) ReadTo(a uint64, b disk.Block) {
+	o.mu.Lock()
+	v, ok := o.written[a]
+	o.mu.Unlock()
+	if ok {
+		copy(b, v)
+		return
+	}
+	o.d.ReadTo(a, b)
+}
+
+func (o *overlay) Write(a uint64, v disk.Block) {
+	b := make(disk.Block, disk.BlockSize)
+	copy(b, v)
+	o.mu.Lock()
+	o.written[a] = b
+	o.mu.Unlock()
+}
+
+func (o *overlay) Size() uint64 {
+	return o.d.Size()
+}
+
+func (o *overlay) Barrier() {
+}
+
+// Close drops the writes; the caller closes the disk underneath
+func (o *overlay) Close() {
+	o.mu.Lock()
+	o.written = nil
+	o.mu.Unlock()
+}
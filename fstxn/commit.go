@@ -1,5 +1,9 @@
 package fstxn
 
+import (
+	"github.com/mit-pdos/go-journal/common"
+)
+
 // putInodes may free an inode so must be done before commit
 func (op *FsTxn) preCommit() {
 	op.Atxn.PreCommit()
@@ -12,7 +16,13 @@ func (op *FsTxn) postCommit() {
 
 func (op *FsTxn) commitWait(wait bool) bool {
 	op.preCommit()
+	mark := op.Fs.unstable.mark()
+	dirty := op.Atxn.Op.NDirty() > 0
 	ok := op.Atxn.Op.CommitWait(wait)
+	if ok && wait && dirty {
+		// flushing this transaction flushed the ones before it
+		op.Fs.unstable.advance(mark)
+	}
 	op.postCommit()
 	return ok
 }
@@ -27,23 +37,48 @@ func (op *FsTxn) CommitData() bool {
 	return op.Commit()
 }
 
-// Commit transaction, but don't write to stable storage
-func (op *FsTxn) CommitUnstable() bool {
-	return op.commitWait(false)
+// Commit transaction, which wrote cnt bytes at off of inum, but don't
+// write to stable storage
+func (op *FsTxn) CommitUnstable(inum common.Inum, off uint64, cnt uint64) bool {
+	ok := op.commitWait(false)
+	if ok {
+		op.Fs.unstable.add(inum, off, cnt)
+	}
+	return ok
 }
 
-// Flush log. We don't have to flush data from other file handles, but
-// that is only an option if we do log-by-pass writes.
-func (op *FsTxn) CommitFh() bool {
+// CommitRange makes the unstable writes to cnt bytes at off of inum, or
+// to the rest of the file if cnt is 0 or off+cnt overflows, durable.  It flushes the log only
+// if some of them aren't durable yet; flushing also flushes everything
+// before them, since the log has no other way.
+func (op *FsTxn) CommitRange(inum common.Inum, off uint64, cnt uint64) bool {
 	op.preCommit()
-	ok := op.Fs.Txn.Flush()
+	var end = off + cnt
+	if cnt == 0 || end < off {
+		end = ^uint64(0)
+	}
+	var ok = true
+	st := op.Fs.unstable
+	if st.pending(inum, off, end) {
+		mark := st.mark()
+		ok = op.Fs.Txn.Flush()
+		st.advance(mark)
+		st.flushed()
+	}
 	op.postCommit()
 	return ok
 }
 
 // An aborted transaction may free an inode, which results in dirty
 // buffers that need to be written to log. So, call commit.
+//
+// An aborted transaction may also have modified the in-memory inodes it
+// holds (e.g., pointers to blocks that abort frees again), so drop them
+// from the inode cache; they will be re-read from the log.
 func (op *FsTxn) Abort() bool {
+	if op.Atxn.Modified() {
+		op.invalidateInodes()
+	}
 	op.releaseInodes()
 	op.Atxn.PostAbort()
 	return true
@@ -1,10 +1,10 @@
 package fstxn
 
 import (
-	"github.com/mit-pdos/go-journal/alloc"
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/lockmap"
 	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
 	"github.com/mit-pdos/go-nfsd/cache"
 	"github.com/mit-pdos/go-nfsd/super"
 )
@@ -16,23 +16,27 @@ type FsState struct {
 	Txn     *obj.Log
 	Icache  *cache.Cache
 	Lockmap *lockmap.LockMap
-	Balloc  *alloc.Alloc
-	Ialloc  *alloc.Alloc
+	Balloc  *alloctxn.Alloc
+	Ialloc  *alloctxn.Alloc
+
+	unstable *unstableSt
 }
 
-func readBitmap(super *super.FsSuper, start common.Bnum, len uint64) []byte {
+// Read the bitmap through the log, since recovery may not have installed
+// the latest bitmap blocks yet.
+func readBitmap(super *super.FsSuper, log *obj.Log, start common.Bnum, len uint64) []byte {
 	var bitmap []byte
 	for i := uint64(0); i < len; i++ {
-		blk := super.Disk.Read(uint64(start) + i)
-		bitmap = append(bitmap, blk...)
+		buf := log.Load(super.Block2addr(start+i), common.NBITBLOCK)
+		bitmap = append(bitmap, buf.Data...)
 	}
 	return bitmap
 }
 
 func MkFsState(super *super.FsSuper, log *obj.Log) *FsState {
-	balloc := alloc.MkAlloc(readBitmap(super, super.BitmapBlockStart(),
+	balloc := alloctxn.MkAlloc(readBitmap(super, log, super.BitmapBlockStart(),
 		super.NBlockBitmap))
-	ialloc := alloc.MkAlloc(readBitmap(super, super.BitmapInodeStart(),
+	ialloc := alloctxn.MkAlloc(readBitmap(super, log, super.BitmapInodeStart(),
 		super.NInodeBitmap))
 	icache := cache.MkCache(ICACHESZ)
 	st := &FsState{
@@ -42,6 +46,8 @@ func MkFsState(super *super.FsSuper, log *obj.Log) *FsState {
 		Lockmap: lockmap.MkLockMap(),
 		Balloc:  balloc,
 		Ialloc:  ialloc,
+
+		unstable: mkUnstableSt(),
 	}
 	return st
 }
@@ -55,6 +55,13 @@ func (op *FsTxn) releaseInodes() {
 	}
 }
 
+func (op *FsTxn) invalidateInodes() {
+	for inum := range op.inodes {
+		cslot := op.Fs.Icache.LookupSlot(uint64(inum))
+		cslot.Obj = nil
+	}
+}
+
 func (op *FsTxn) AllocInode(kind nfstypes.Ftype3) *inode.Inode {
 	var ip *inode.Inode
 	inum := op.Atxn.AllocINum()
@@ -66,6 +73,9 @@ func (op *FsTxn) AllocInode(kind nfstypes.Ftype3) *inode.Inode {
 		if !ip.IsShrinking() {
 			util.DPrintf(1, "AllocInode -> # %v\n", inum)
 			ip.InitInode(inum, kind)
+			if op.Fs.Super.Extents() {
+				ip.Flags = inode.NewFlags(kind)
+			}
 			ip.WriteInode(op.Atxn)
 		}
 	}
@@ -91,7 +101,7 @@ func (op *FsTxn) GetInodeLocked(inum common.Inum) *inode.Inode {
 	cslot := op.LockInode(inum)
 	if cslot.Obj == nil {
 		addr := op.Fs.Super.Inum2Addr(inum)
-		buf := op.Atxn.Op.ReadBuf(addr, common.INODESZ*8)
+		buf := op.Atxn.Op.ReadBuf(addr, op.Fs.Super.InodeSz()*8)
 		i := inode.Decode(buf, inum)
 		util.DPrintf(1, "GetInodeLocked # %v: read inode from disk\n", inum)
 		cslot.Obj = i
@@ -116,7 +126,11 @@ func (op *FsTxn) GetInodeInum(inum common.Inum) *inode.Inode {
 		op.ReleaseInode(ip)
 		return nil
 	}
-	if ip.Nlink == 0 {
+	// an inode in use with Nlink 0 is an orphan, which clients may
+	// still use through its file handle; directories never become
+	// orphans, and VERSION0 file systems have none
+	if ip.Nlink == 0 &&
+		(ip.Kind == nfstypes.NF3DIR || op.Fs.Super.Legacy()) {
 		panic("getInodeInum")
 	}
 	return ip
@@ -0,0 +1,126 @@
+package fstxn
+
+import (
+	"sync"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+)
+
+//
+// Tracking of unstable writes.  The log makes a transaction durable by
+// flushing it and all transactions before it, so COMMIT needs a flush
+// only if some unstable write to the range it asks for isn't durable
+// yet.  Each unstable commit gets a sequence number after it is in the
+// log, and each flush and synchronous commit, once done, makes durable
+// the unstable commits numbered up to the last one before it started.
+// For each inode, unstableSt keeps the ranges that its unstable commits
+// that aren't known to be durable wrote.
+//
+
+// MAXRANGES is the most ranges kept per inode; more are merged into one
+const MAXRANGES = 64
+
+type wrange struct {
+	seq uint64 // of the unstable commit that wrote it
+	off uint64
+	end uint64
+}
+
+type unstableSt struct {
+	mu      *sync.Mutex
+	seq     uint64 // of the last unstable commit
+	durable uint64 // unstable commits up to this one are durable
+	ranges  map[common.Inum][]wrange
+	nflush  uint64 // flushes that COMMIT needed
+}
+
+func mkUnstableSt() *unstableSt {
+	return &unstableSt{
+		mu:     new(sync.Mutex),
+		ranges: make(map[common.Inum][]wrange),
+	}
+}
+
+// add records that an unstable commit, just done, wrote cnt bytes at off
+// of inum
+func (st *unstableSt) add(inum common.Inum, off uint64, cnt uint64) {
+	st.mu.Lock()
+	st.seq = st.seq + 1
+	r := wrange{seq: st.seq, off: off, end: off + cnt}
+	rs := append(st.ranges[inum], r)
+	if len(rs) > MAXRANGES {
+		for _, o := range rs {
+			r.off = util.Min(r.off, o.off)
+			if o.end > r.end {
+				r.end = o.end
+			}
+		}
+		rs = []wrange{r}
+	}
+	st.ranges[inum] = rs
+	st.mu.Unlock()
+}
+
+// flushed counts a flush that COMMIT needed
+func (st *unstableSt) flushed() {
+	st.mu.Lock()
+	st.nflush = st.nflush + 1
+	st.mu.Unlock()
+}
+
+// mark returns the number of the last unstable commit, which a flush
+// that starts now makes durable
+func (st *unstableSt) mark() uint64 {
+	st.mu.Lock()
+	seq := st.seq
+	st.mu.Unlock()
+	return seq
+}
+
+// advance records that the unstable commits up to seq are durable, and
+// forgets their ranges
+func (st *unstableSt) advance(seq uint64) {
+	st.mu.Lock()
+	if seq > st.durable {
+		st.durable = seq
+		for inum, rs := range st.ranges {
+			var keep []wrange
+			for _, r := range rs {
+				if r.seq > seq {
+					keep = append(keep, r)
+				}
+			}
+			if len(keep) == 0 {
+				delete(st.ranges, inum)
+			} else {
+				st.ranges[inum] = keep
+			}
+		}
+	}
+	st.mu.Unlock()
+}
+
+// pending reports whether an unstable commit that isn't durable wrote
+// to inum between off and end
+func (st *unstableSt) pending(inum common.Inum, off uint64, end uint64) bool {
+	st.mu.Lock()
+	var p = false
+	for _, r := range st.ranges[inum] {
+		if r.seq > st.durable && r.off < end && off < r.end {
+			p = true
+			break
+		}
+	}
+	st.mu.Unlock()
+	return p
+}
+
+// NFlush returns how many times committing a range had to flush the log
+func (fs *FsState) NFlush() uint64 {
+	st := fs.unstable
+	st.mu.Lock()
+	n := st.nflush
+	st.mu.Unlock()
+	return n
+}
@@ -0,0 +1,331 @@
+package inode
+
+import (
+	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+)
+
+//
+// Extents.  An inode with FLAGEXTENTS maps its blocks with a tree of
+// extents, each a run of logical blocks stored in a run of physical
+// blocks, instead of with a block number per block.  The root of the
+// tree is in the inode, in the words of blks, and the other nodes are
+// blocks.  A node is a header word, with its depth in the high half and
+// its number of entries in the low half, and then its entries, sorted
+// by logical block.  A leaf (depth 0) holds extents: first logical
+// block, first physical block, and length.  An interior node holds, for
+// each child, the first logical block that the child may map and the
+// child's block number; the child maps the logical blocks up to the
+// next entry's.
+//
+// bmap allocates the block after the end of the extent that ends just
+// before the block it maps if it is free, and then only lengthens that
+// extent, so that sequential writes make few, long extents and seldom
+// write a node.
+//
+
+const FLAGEXTENTS uint32 = 1 // blks holds the root of an extent tree
+
+const (
+	ROOTWORDS uint64 = NBLKINO + 1 // words of blks, which hold the root
+	EXTWORDS  uint64 = 3           // words of a leaf entry
+	IDXWORDS  uint64 = 2           // words of an interior entry
+)
+
+type extent struct {
+	lblk uint64      // first logical block
+	pblk common.Bnum // first physical block; the child in an interior node
+	n    uint64      // # blocks; 0 in an interior node
+}
+
+type extNode struct {
+	blkno common.Bnum // NULLBNUM for the root
+	depth uint64
+	ents  []extent
+}
+
+// UseExtents reports whether ip maps its blocks with extents
+func (ip *Inode) UseExtents() bool {
+	return ip.Flags&FLAGEXTENTS != 0
+}
+
+func decodeNode(words []uint64, blkno common.Bnum) *extNode {
+	nd := &extNode{blkno: blkno, depth: words[0] >> 32}
+	n := words[0] & (1<<32 - 1)
+	nd.ents = make([]extent, 0, n)
+	var w = uint64(1)
+	for i := uint64(0); i < n; i++ {
+		if nd.depth == 0 {
+			if w+EXTWORDS > uint64(len(words)) {
+				break
+			}
+			nd.ents = append(nd.ents, extent{lblk: words[w],
+				pblk: words[w+1], n: words[w+2]})
+			w += EXTWORDS
+		} else {
+			if w+IDXWORDS > uint64(len(words)) {
+				break
+			}
+			nd.ents = append(nd.ents, extent{lblk: words[w], pblk: words[w+1]})
+			w += IDXWORDS
+		}
+	}
+	return nd
+}
+
+// encode returns nd as nwords words
+func (nd *extNode) encode(nwords uint64) []uint64 {
+	words := make([]uint64, nwords)
+	words[0] = nd.depth<<32 | uint64(len(nd.ents))
+	var w = uint64(1)
+	for _, e := range nd.ents {
+		words[w] = e.lblk
+		words[w+1] = e.pblk
+		if nd.depth == 0 {
+			words[w+2] = e.n
+			w += EXTWORDS
+		} else {
+			w += IDXWORDS
+		}
+	}
+	return words
+}
+
+func (nd *extNode) capacity() uint64 {
+	var nwords = NBLKBLK
+	if nd.blkno == common.NULLBNUM {
+		nwords = ROOTWORDS
+	}
+	if nd.depth == 0 {
+		return (nwords - 1) / EXTWORDS
+	}
+	return (nwords - 1) / IDXWORDS
+}
+
+// find returns the index of the last entry of nd that starts at or
+// before bn, or -1 if there is none
+func (nd *extNode) find(bn uint64) int {
+	var i = len(nd.ents) - 1
+	for i >= 0 && nd.ents[i].lblk > bn {
+		i--
+	}
+	return i
+}
+
+// child returns the index of the entry of nd, an interior node, for bn
+func (nd *extNode) child(bn uint64) int {
+	i := nd.find(bn)
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+func (nd *extNode) insert(e extent) {
+	i := nd.find(e.lblk) + 1
+	nd.ents = append(nd.ents, extent{})
+	copy(nd.ents[i+1:], nd.ents[i:])
+	nd.ents[i] = e
+}
+
+func blockWords(blk []byte) []uint64 {
+	return marshal.NewDec(blk).GetInts(NBLKBLK)
+}
+
+func (ip *Inode) readNode(atxn *alloctxn.AllocTxn, blkno common.Bnum) *extNode {
+	if blkno == common.NULLBNUM {
+		return decodeNode(ip.blks, blkno)
+	}
+	return decodeNode(blockWords(atxn.ReadBlock(blkno).Data), blkno)
+}
+
+// writeNode writes nd to its block, or to blks for the root, which the
+// caller must write with the inode
+func (ip *Inode) writeNode(atxn *alloctxn.AllocTxn, nd *extNode) {
+	if nd.blkno == common.NULLBNUM {
+		copy(ip.blks, nd.encode(ROOTWORDS))
+		return
+	}
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInts(nd.encode(NBLKBLK))
+	buf := atxn.ReadBlock(nd.blkno)
+	copy(buf.Data, enc.Finish())
+	buf.SetDirty()
+}
+
+// extPath returns the nodes from the root to the leaf that maps bn
+func (ip *Inode) extPath(atxn *alloctxn.AllocTxn, bn uint64) []*extNode {
+	var nd = ip.readNode(atxn, common.NULLBNUM)
+	path := []*extNode{nd}
+	for nd.depth > 0 && len(nd.ents) > 0 {
+		nd = ip.readNode(atxn, nd.ents[nd.child(bn)].pblk)
+		path = append(path, nd)
+	}
+	return path
+}
+
+// bmapExt is bmap for an inode with extents
+func (ip *Inode) bmapExt(atxn *alloctxn.AllocTxn, bn uint64) (common.Bnum, bool) {
+	path := ip.extPath(atxn, bn)
+	leaf := path[len(path)-1]
+	i := leaf.find(bn)
+	var goal = common.NULLBNUM
+	if i >= 0 {
+		e := leaf.ents[i]
+		if bn < e.lblk+e.n {
+			return e.pblk + (bn - e.lblk), false
+		}
+		if bn == e.lblk+e.n {
+			goal = e.pblk + e.n
+		}
+	}
+	blkno := atxn.AllocBlockNear(goal)
+	if blkno == common.NULLBNUM {
+		return blkno, false
+	}
+	if goal != common.NULLBNUM && blkno == goal {
+		leaf.ents[i].n++
+		ip.writeNode(atxn, leaf)
+		return blkno, true
+	}
+	if !ip.insertExt(atxn, path, uint64(len(path)-1),
+		extent{lblk: bn, pblk: blkno, n: 1}) {
+		return common.NULLBNUM, false
+	}
+	return blkno, true
+}
+
+// insertExt inserts e into path[level], splitting it if it is full.
+// It returns false if it runs out of blocks.
+func (ip *Inode) insertExt(atxn *alloctxn.AllocTxn, path []*extNode, level uint64, e extent) bool {
+	nd := path[level]
+	if uint64(len(nd.ents)) < nd.capacity() {
+		nd.insert(e)
+		ip.writeNode(atxn, nd)
+		return true
+	}
+	blkno := atxn.AllocBlock()
+	if blkno == common.NULLBNUM {
+		return false
+	}
+	if nd.blkno == common.NULLBNUM {
+		// move the full root into a block, and make the root an
+		// interior node with that block as its only child
+		child := &extNode{blkno: blkno, depth: nd.depth, ents: nd.ents}
+		nd.depth++
+		nd.ents = []extent{{lblk: child.ents[0].lblk, pblk: blkno}}
+		ip.writeNode(atxn, nd)
+		return ip.insertExt(atxn, []*extNode{nd, child}, 1, e)
+	}
+	half := len(nd.ents) / 2
+	right := &extNode{blkno: blkno, depth: nd.depth,
+		ents: append([]extent{}, nd.ents[half:]...)}
+	nd.ents = nd.ents[:half]
+	if e.lblk >= right.ents[0].lblk {
+		right.insert(e)
+	} else {
+		nd.insert(e)
+	}
+	ip.writeNode(atxn, nd)
+	ip.writeNode(atxn, right)
+	util.DPrintf(5, "insertExt # %v: split %d -> %d\n", ip.Inum, nd.blkno, blkno)
+	return ip.insertExt(atxn, path, level-1,
+		extent{lblk: right.ents[0].lblk, pblk: blkno})
+}
+
+// shrinkExt frees the last block that ip maps past its size, and the
+// nodes that that empties, and lowers ShrinkSize to the end of the
+// blocks that are left.
+func (ip *Inode) shrinkExt(op *alloctxn.AllocTxn) {
+	cursz := util.RoundUp(ip.Size, disk.BlockSize)
+	path := ip.extPath(op, ^uint64(0))
+	leaf := path[len(path)-1]
+	if len(leaf.ents) == 0 {
+		ip.ShrinkSize = cursz
+		return
+	}
+	last := len(leaf.ents) - 1
+	e := &leaf.ents[last]
+	end := e.lblk + e.n
+	if end <= cursz {
+		ip.ShrinkSize = cursz
+		return
+	}
+	e.n--
+	op.FreeBlock(e.pblk + e.n)
+	if e.n == 0 {
+		leaf.ents = leaf.ents[:last]
+	}
+	if len(leaf.ents) == 0 && leaf.blkno != common.NULLBNUM {
+		ip.freeNode(op, path)
+	} else {
+		ip.writeNode(op, leaf)
+	}
+	if end-1 > cursz {
+		ip.ShrinkSize = end - 1
+	} else {
+		ip.ShrinkSize = cursz
+	}
+}
+
+// freeNode frees the last node of path, which is empty, and removes it
+// from its parent, freeing the parent too if that empties it
+func (ip *Inode) freeNode(op *alloctxn.AllocTxn, path []*extNode) {
+	level := len(path) - 1
+	op.FreeBlock(path[level].blkno)
+	parent := path[level-1]
+	parent.ents = parent.ents[:len(parent.ents)-1]
+	if len(parent.ents) == 0 {
+		if parent.blkno != common.NULLBNUM {
+			ip.freeNode(op, path[:level])
+			return
+		}
+		parent.depth = 0
+	}
+	ip.writeNode(op, parent)
+}
+
+// walkExt is Walk for an inode with extents
+func walkExt(read func(common.Bnum) []byte, nd *extNode,
+	f func(uint64, common.Bnum, bool)) {
+	for _, e := range nd.ents {
+		if nd.depth == 0 {
+			for i := uint64(0); i < e.n; i++ {
+				f(e.lblk+i, e.pblk+i, false)
+			}
+			continue
+		}
+		f(0, e.pblk, true)
+		blk := read(e.pblk)
+		if blk == nil {
+			continue
+		}
+		walkExt(read, decodeNode(blockWords(blk), e.pblk), f)
+	}
+}
+
+// NRuns returns the number of runs of blocks of ip that are contiguous
+// both in the file and on disk, which for an inode with extents is its
+// number of extents
+func (ip *Inode) NRuns(atxn *alloctxn.AllocTxn) uint64 {
+	var n = uint64(0)
+	var prevbn = uint64(0)
+	var prev = common.NULLBNUM
+	ip.Walk(func(blkno common.Bnum) []byte {
+		return atxn.ReadBlock(blkno).Data
+	}, func(bn uint64, blkno common.Bnum, index bool) {
+		if index {
+			return
+		}
+		if prev == common.NULLBNUM || bn != prevbn+1 || blkno != prev+1 {
+			n++
+		}
+		prevbn = bn
+		prev = blkno
+	})
+	return n
+}
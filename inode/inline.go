@@ -0,0 +1,125 @@
+package inode
+
+import (
+	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/alloctxn"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Inline data.  An inode with FLAGINLINE keeps its contents, at most
+// MAXINLINE bytes, in the words of blks instead of in a block, so that
+// a small file or symlink costs no block and no bitmap update.  The
+// bytes past Size are zero.  Writing past MAXINLINE, or growing the file
+// past it, moves the contents to a block and clears FLAGINLINE for good.
+//
+
+const FLAGINLINE uint32 = 2 // blks holds the contents
+
+const MAXINLINE uint64 = ROOTWORDS * 8
+
+// NewFlags returns the flags of a new inode of kind on a file system
+// with extents: files and symlinks start out inline, and all map their
+// blocks with extents once they have any.  Inodes on older file systems
+// have no flags, and map their blocks with block pointers.
+func NewFlags(kind nfstypes.Ftype3) uint32 {
+	if kind == nfstypes.NF3REG || kind == nfstypes.NF3LNK {
+		return FLAGEXTENTS | FLAGINLINE
+	}
+	return FLAGEXTENTS
+}
+
+// IsInline reports whether ip keeps its contents in the inode
+func (ip *Inode) IsInline() bool {
+	return ip.Flags&FLAGINLINE != 0
+}
+
+func (ip *Inode) inlineData() []byte {
+	enc := marshal.NewEnc(MAXINLINE)
+	enc.PutInts(ip.blks)
+	return enc.Finish()
+}
+
+func (ip *Inode) setInlineData(data []byte) {
+	ip.blks = marshal.NewDec(data).GetInts(ROOTWORDS)
+}
+
+// zeroInline zeroes the contents of ip from byte off on
+func (ip *Inode) zeroInline(off uint64) {
+	buf := ip.inlineData()
+	for i := off; i < MAXINLINE; i++ {
+		buf[i] = 0
+	}
+	ip.setInlineData(buf)
+}
+
+func (ip *Inode) readInline(offset uint64, count uint64) []byte {
+	data := ip.inlineData()
+	return append([]byte{}, data[offset:offset+count]...)
+}
+
+func (ip *Inode) writeInline(atxn *alloctxn.AllocTxn, offset uint64, data []byte) {
+	buf := ip.inlineData()
+	copy(buf[offset:], data)
+	ip.setInlineData(buf)
+	if offset+uint64(len(data)) > ip.Size {
+		ip.Size = offset + uint64(len(data))
+	}
+	ip.modified()
+	ip.WriteInode(atxn)
+}
+
+// resizeInline truncates or extends ip, which stays inline
+func (ip *Inode) resizeInline(atxn *alloctxn.AllocTxn, sz uint64) {
+	if sz < ip.Size {
+		ip.zeroInline(sz)
+	}
+	ip.Size = sz
+	ip.ShrinkSize = util.RoundUp(sz, disk.BlockSize)
+	ip.modified()
+	ip.WriteInode(atxn)
+}
+
+// uninline moves the contents of ip into a block of their own, if it
+// has any.  It returns false, leaving ip alone, if there is no free
+// block.
+func (ip *Inode) uninline(atxn *alloctxn.AllocTxn) bool {
+	data := ip.inlineData()[:ip.Size]
+	var blkno = common.NULLBNUM
+	if ip.Size > 0 {
+		blkno = atxn.AllocBlock()
+		if blkno == common.NULLBNUM {
+			return false
+		}
+	}
+	ip.Flags = ip.Flags &^ FLAGINLINE
+	ip.blks = make([]common.Bnum, ROOTWORDS)
+	if blkno != common.NULLBNUM {
+		if ip.UseExtents() {
+			root := &extNode{ents: []extent{{lblk: 0, pblk: blkno, n: 1}}}
+			ip.writeNode(atxn, root)
+		} else {
+			ip.blks[0] = blkno
+		}
+		buf := atxn.ReadBlock(blkno)
+		copy(buf.Data, data)
+		buf.SetDirty()
+	}
+	ip.WriteInode(atxn)
+	util.DPrintf(1, "uninline # %v: %d bytes -> %d\n", ip.Inum, ip.Size, blkno)
+	return true
+}
+
+// Grow readies ip to be resized to sz bytes, moving its contents out of
+// the inode if they wouldn't fit.  It returns false if there is no free
+// block for them.
+func (ip *Inode) Grow(atxn *alloctxn.AllocTxn, sz uint64) bool {
+	if !ip.IsInline() || sz <= MAXINLINE {
+		return true
+	}
+	return ip.uninline(atxn)
+}
@@ -18,12 +18,21 @@ import (
 const NF3FREE nfstypes.Ftype3 = 0
 
 const (
-	NBLKINO   uint64 = 10 // # blk in an inode's blks array
+	NBLKINO   uint64 = 10 // # blk in a VERSION0 inode's blks array
 	NDIRECT   uint64 = NBLKINO - 2
 	INDIRECT  uint64 = NBLKINO - 2
 	DINDIRECT uint64 = NBLKINO - 1
+	TINDIRECT uint64 = NBLKINO            // not in VERSION0 inodes
 	NBLKBLK   uint64 = disk.BlockSize / 8 // # blkno per block
-	NINDLEVEL uint64 = 2                  // # levels of indirection
+	NINDLEVEL uint64 = 3                  // # levels of indirection
+)
+
+// MAXLINK is the maximum number of hard links to an inode
+const MAXLINK uint32 = 65000
+
+const (
+	MODEMASK uint32 = 07777 // permission, setuid, setgid, and sticky bits
+	DEFMODE  uint32 = 0777  // mode if none is given, and of VERSION0 inodes
 )
 
 type Inode struct {
@@ -44,6 +53,38 @@ type Inode struct {
 	Atime nfstypes.Nfstime3
 	Mtime nfstypes.Nfstime3
 	blks  []common.Bnum
+
+	// not stored in VERSION0 inodes
+	Mode  uint32
+	Uid   uint32
+	Gid   uint32
+	Ctime nfstypes.Nfstime3
+	Verf  nfstypes.Createverf3 // of an EXCLUSIVE create, if FLAGVERF
+	Rdev  nfstypes.Specdata3   // major and minor of a device
+	Next  common.Inum          // next inode on the orphan list
+	Flags uint32               // FLAG* bits
+}
+
+const FLAGVERF uint32 = 4 // Verf holds the verifier of an EXCLUSIVE create
+
+// SetVerf records that an EXCLUSIVE create with verf made ip.  Caller
+// must write ip.
+func (ip *Inode) SetVerf(verf nfstypes.Createverf3) {
+	ip.Verf = verf
+	ip.Flags = ip.Flags | FLAGVERF
+}
+
+// ClearVerf records that ip's EXCLUSIVE create, if any, is done.  Caller
+// must write ip.
+func (ip *Inode) ClearVerf() {
+	ip.Verf = nfstypes.Createverf3{}
+	ip.Flags = ip.Flags &^ FLAGVERF
+}
+
+// CreatedWith reports whether an EXCLUSIVE create with verf made ip and
+// the client hasn't set its attributes since
+func (ip *Inode) CreatedWith(verf nfstypes.Createverf3) bool {
+	return ip.Flags&FLAGVERF != 0 && ip.Verf == verf
 }
 
 func NfstimeNow() nfstypes.Nfstime3 {
@@ -55,6 +96,38 @@ func NfstimeNow() nfstypes.Nfstime3 {
 	return t
 }
 
+func timeBefore(t1 nfstypes.Nfstime3, t2 nfstypes.Nfstime3) bool {
+	return t1.Seconds < t2.Seconds ||
+		(t1.Seconds == t2.Seconds && t1.Nseconds < t2.Nseconds)
+}
+
+// nextTime returns the current time, but at least a nanosecond after t,
+// so that a time clients use to validate their caches always moves
+// forward.
+func nextTime(t nfstypes.Nfstime3) nfstypes.Nfstime3 {
+	now := NfstimeNow()
+	if timeBefore(t, now) {
+		return now
+	}
+	if t.Nseconds+1 < 1000000000 {
+		return nfstypes.Nfstime3{Seconds: t.Seconds, Nseconds: t.Nseconds + 1}
+	}
+	return nfstypes.Nfstime3{Seconds: t.Seconds + 1, Nseconds: 0}
+}
+
+// Changed updates the ctime of ip for a change to its metadata. Caller
+// must write ip.
+func (ip *Inode) Changed() {
+	ip.Ctime = nextTime(ip.Ctime)
+}
+
+// modified updates the mtime and ctime of ip for a change to its
+// contents. Caller must write ip.
+func (ip *Inode) modified() {
+	ip.Changed()
+	ip.Mtime = ip.Ctime
+}
+
 func (ip *Inode) InitInode(inum common.Inum, kind nfstypes.Ftype3) {
 	util.DPrintf(1, "initInode: inode # %d\n", inum)
 	ip.Inum = inum
@@ -62,42 +135,60 @@ func (ip *Inode) InitInode(inum common.Inum, kind nfstypes.Ftype3) {
 	ip.Nlink = 1
 	ip.Gen = ip.Gen + 1
 	ip.Atime = NfstimeNow()
-	ip.Mtime = NfstimeNow()
+	ip.Mtime = ip.Atime
+	ip.Ctime = ip.Atime
+	ip.Mode = DEFMODE
+	ip.Uid = 0
+	ip.Gid = 0
+	ip.Verf = nfstypes.Createverf3{}
+	ip.Rdev = nfstypes.Specdata3{}
+	ip.Next = common.NULLINUM
+	ip.Flags = 0
 }
 
 func MkRootInode() *Inode {
 	ip := new(Inode)
-	ip.blks = make([]common.Bnum, NBLKINO)
+	ip.blks = make([]common.Bnum, NBLKINO+1)
 	ip.InitInode(common.ROOTINUM, nfstypes.NF3DIR)
 	return ip
 }
 
 func (ip *Inode) String() string {
-	return fmt.Sprintf("# %d k %d n %d g %d sz %d ssz %d %v", ip.Inum, ip.Kind, ip.Nlink, ip.Gen, ip.Size, ip.ShrinkSize, ip.blks)
+	return fmt.Sprintf("# %d k %d n %d g %d m %o u %d g %d sz %d ssz %d nx %d f %x %v", ip.Inum, ip.Kind, ip.Nlink, ip.Gen, ip.Mode, ip.Uid, ip.Gid, ip.Size, ip.ShrinkSize, ip.Next, ip.Flags, ip.blks)
+}
+
+// A directory's Nlink counts its name in its parent and the ".." entries of
+// its subdirectories; its own "." entry is implicit.
+func (ip *Inode) nlink() uint32 {
+	if ip.Kind == nfstypes.NF3DIR {
+		return ip.Nlink + 1
+	}
+	return ip.Nlink
 }
 
 func (ip *Inode) MkFattr() nfstypes.Fattr3 {
 	return nfstypes.Fattr3{
-		Ftype: ip.Kind,
-		Mode:  0777,
-		Nlink: 1,
-		Uid:   nfstypes.Uid3(0),
-		Gid:   nfstypes.Gid3(0),
-		Size:  nfstypes.Size3(ip.Size),
-		Used:  nfstypes.Size3(ip.Size),
-		Rdev: nfstypes.Specdata3{Specdata1: nfstypes.Uint32(0),
-			Specdata2: nfstypes.Uint32(0)},
+		Ftype:  ip.Kind,
+		Mode:   nfstypes.Mode3(ip.Mode),
+		Nlink:  nfstypes.Uint32(ip.nlink()),
+		Uid:    nfstypes.Uid3(ip.Uid),
+		Gid:    nfstypes.Gid3(ip.Gid),
+		Size:   nfstypes.Size3(ip.Size),
+		Used:   nfstypes.Size3(ip.Size),
+		Rdev:   ip.Rdev,
 		Fsid:   nfstypes.Uint64(0),
 		Fileid: nfstypes.Fileid3(ip.Inum),
 		Atime:  ip.Atime,
 		Mtime:  ip.Mtime,
-		Ctime: nfstypes.Nfstime3{Seconds: nfstypes.Uint32(0),
-			Nseconds: nfstypes.Uint32(0)},
+		Ctime:  ip.Ctime,
 	}
 }
 
-func (ip *Inode) Encode() []byte {
-	enc := marshal.NewEnc(common.INODESZ)
+// Encode ip as an inode of sz bytes. Inodes of common.INODESZ bytes
+// (VERSION0) have no room for mode, uid, gid, ctime, the create
+// verifier, rdev, the orphan list, the triple-indirect block, and flags.
+func (ip *Inode) Encode(sz uint64) []byte {
+	enc := marshal.NewEnc(sz)
 	enc.PutInt32(uint32(ip.Kind))
 	enc.PutInt32(ip.Nlink)
 	enc.PutInt(ip.Gen)
@@ -107,7 +198,20 @@ func (ip *Inode) Encode() []byte {
 	enc.PutInt32(uint32(ip.Atime.Nseconds))
 	enc.PutInt32(uint32(ip.Mtime.Seconds))
 	enc.PutInt32(uint32(ip.Mtime.Nseconds))
-	enc.PutInts(ip.blks)
+	enc.PutInts(ip.blks[:NBLKINO])
+	if sz > common.INODESZ {
+		enc.PutInt32(ip.Mode)
+		enc.PutInt32(ip.Uid)
+		enc.PutInt32(ip.Gid)
+		enc.PutInt32(uint32(ip.Ctime.Seconds))
+		enc.PutInt32(uint32(ip.Ctime.Nseconds))
+		enc.PutBytes(ip.Verf[:])
+		enc.PutInt32(uint32(ip.Rdev.Specdata1))
+		enc.PutInt32(uint32(ip.Rdev.Specdata2))
+		enc.PutInt(uint64(ip.Next))
+		enc.PutInt(ip.blks[TINDIRECT])
+		enc.PutInt32(ip.Flags)
+	}
 	return enc.Finish()
 }
 
@@ -125,31 +229,75 @@ func Decode(buf *buf.Buf, inum common.Inum) *Inode {
 	ip.Mtime.Seconds = nfstypes.Uint32(dec.GetInt32())
 	ip.Mtime.Nseconds = nfstypes.Uint32(dec.GetInt32())
 	ip.blks = dec.GetInts(NBLKINO)
+	if uint64(len(buf.Data)) > common.INODESZ {
+		ip.Mode = dec.GetInt32()
+		ip.Uid = dec.GetInt32()
+		ip.Gid = dec.GetInt32()
+		ip.Ctime.Seconds = nfstypes.Uint32(dec.GetInt32())
+		ip.Ctime.Nseconds = nfstypes.Uint32(dec.GetInt32())
+		copy(ip.Verf[:], dec.GetBytes(uint64(nfstypes.NFS3_CREATEVERFSIZE)))
+		ip.Rdev.Specdata1 = nfstypes.Uint32(dec.GetInt32())
+		ip.Rdev.Specdata2 = nfstypes.Uint32(dec.GetInt32())
+		ip.Next = common.Inum(dec.GetInt())
+		ip.blks = append(ip.blks, dec.GetInt())
+		ip.Flags = dec.GetInt32()
+	} else {
+		ip.blks = append(ip.blks, common.NULLBNUM)
+		ip.Mode = DEFMODE
+		ip.Ctime = ip.Mtime
+	}
 	return ip
 }
 
+// pow is the number of blocks that an index tree of level level maps
 func pow(level uint64) uint64 {
-	if level == 0 {
-		return 1
-	}
-	var p uint64 = NBLKBLK
-	for i := uint64(1); i < level; i++ {
-		p = p * p
+	var p uint64 = 1
+	for i := uint64(0); i < level; i++ {
+		p = p * NBLKBLK
 	}
 	return p
 }
 
-func MaxFileSize() uint64 {
-	maxblks := pow(NINDLEVEL)
-	return (NDIRECT + maxblks) * disk.BlockSize
+// nindlevel is the number of levels of indirection of inodes of the
+// given version
+func nindlevel(legacy bool) uint64 {
+	if legacy {
+		return NINDLEVEL - 1
+	}
+	return NINDLEVEL
+}
+
+// MaxFileSize is the size of the largest file that inodes of the given
+// version can map: NDIRECT blocks, and then a tree of each level of
+// indirection.
+func MaxFileSize(legacy bool) uint64 {
+	var maxblks = NDIRECT
+	for level := uint64(1); level <= nindlevel(legacy); level++ {
+		maxblks += pow(level)
+	}
+	return maxblks * disk.BlockSize
+}
+
+// tree returns the blks index of the root of the index tree that maps
+// logical block bn, which is past the direct blocks, along with the
+// tree's level and the first logical block it maps
+func tree(bn uint64) (uint64, uint64, uint64) {
+	var base = NDIRECT
+	var level = uint64(1)
+	for level < NINDLEVEL && bn >= base+pow(level) {
+		base += pow(level)
+		level++
+	}
+	return INDIRECT + level - 1, level, base
 }
 
 func (ip *Inode) WriteInode(atxn *alloctxn.AllocTxn) {
 	if ip.Inum >= atxn.Super.NInode() {
 		panic("WriteInode")
 	}
-	d := ip.Encode()
-	atxn.Op.OverWrite(atxn.Super.Inum2Addr(ip.Inum), common.INODESZ*8, d)
+	sz := atxn.Super.InodeSz()
+	d := ip.Encode(sz)
+	atxn.Op.OverWrite(atxn.Super.Inum2Addr(ip.Inum), sz*8, d)
 	util.DPrintf(1, "WriteInode %v\n", ip)
 }
 
@@ -164,12 +312,23 @@ func (ip *Inode) FreeInode(atxn *alloctxn.AllocTxn) {
 // shrinks. It creates a new thread to free blocks in a separate
 // transaction, if shrinking involves freeing many blocks.  ShrinkSize
 // tracks shrinking progress, and is initialized with the old size.
-func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) bool {
+// Resize returns whether the caller must start a shrinker, and false,
+// leaving ip alone, if ip is inline and growing it past MAXINLINE
+// needs a block when there is none free; shrinking always succeeds.
+func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) (bool, bool) {
 	var newSz = sz
 	var doshrink = false
 	oldsz := util.RoundUp(ip.Size, disk.BlockSize)
 	util.DPrintf(5, "Resize %v to sz %d\n", oldsz, newSz)
+	if ip.IsInline() && sz <= MAXINLINE {
+		ip.resizeInline(atxn, sz)
+		return false, true
+	}
+	if ip.IsInline() && !ip.uninline(atxn) {
+		return false, false
+	}
 	ip.Size = newSz
+	ip.modified()
 	newSz = util.RoundUp(sz, disk.BlockSize)
 	if newSz < oldsz {
 		ip.ShrinkSize = oldsz
@@ -185,7 +344,7 @@ func (ip *Inode) Resize(atxn *alloctxn.AllocTxn, sz uint64) bool {
 			doshrink = true
 		}
 	}
-	return doshrink
+	return doshrink, true
 }
 
 // Returns blkno and root index block for off. If blkno is 0, failure.
@@ -223,6 +382,9 @@ func (ip *Inode) indbmap(atxn *alloctxn.AllocTxn, root_ common.Bnum, level uint6
 // Map logical block number bn to a physical block number, allocating
 // blocks if no block exists for bn.
 func (ip *Inode) bmap(atxn *alloctxn.AllocTxn, bn uint64) (common.Bnum, bool) {
+	if ip.UseExtents() {
+		return ip.bmapExt(atxn, bn)
+	}
 	var blkno = common.NULLBNUM
 	var alloc = false
 	if bn < NDIRECT {
@@ -234,25 +396,12 @@ func (ip *Inode) bmap(atxn *alloctxn.AllocTxn, bn uint64) (common.Bnum, bool) {
 		}
 		blkno = ip.blks[bn]
 	} else {
-		var off = bn - NDIRECT
-		var root = common.NULLBNUM
-		if off < NBLKBLK {
-			newBlkno, newRoot := ip.indbmap(atxn, ip.blks[INDIRECT], 1, off)
-			blkno = newBlkno
-			root = newRoot
-			alloc = root != ip.blks[INDIRECT]
-			if alloc {
-				ip.blks[INDIRECT] = root
-			}
-		} else {
-			off -= NBLKBLK
-			newBlkno, newRoot := ip.indbmap(atxn, ip.blks[DINDIRECT], 2, off)
-			blkno = newBlkno
-			root = newRoot
-			alloc = root != ip.blks[INDIRECT]
-			if alloc {
-				ip.blks[DINDIRECT] = root
-			}
+		slot, level, base := tree(bn)
+		newBlkno, newRoot := ip.indbmap(atxn, ip.blks[slot], level, bn-base)
+		blkno = newBlkno
+		alloc = newRoot != ip.blks[slot]
+		if alloc {
+			ip.blks[slot] = newRoot
 		}
 	}
 	return blkno, alloc
@@ -271,6 +420,9 @@ func (ip *Inode) Read(atxn *alloctxn.AllocTxn, offset uint64, bytesToRead uint64
 		count = ip.Size - offset
 	}
 	util.DPrintf(5, "Read: off %d cnt %d\n", offset, count)
+	if ip.IsInline() {
+		return ip.readInline(offset, count), false
+	}
 	var data = make([]byte, 0)
 	var off = offset
 	for boff := off / disk.BlockSize; n < count; boff++ {
@@ -284,10 +436,7 @@ func (ip *Inode) Read(atxn *alloctxn.AllocTxn, offset uint64, bytesToRead uint64
 			ip.WriteInode(atxn)
 		}
 		buf := atxn.ReadBlock(blkno)
-
-		for b := uint64(0); b < nbytes; b++ {
-			data = append(data, buf.Data[byteoff+b])
-		}
+		data = append(data, buf.Data[byteoff:byteoff+nbytes]...)
 		n += nbytes
 		off += nbytes
 	}
@@ -306,9 +455,18 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 	var data = dataBuf
 
 	util.DPrintf(5, "Write: off %d cnt %d\n", offset, count)
-	if offset+count > MaxFileSize() {
+	if offset+count > MaxFileSize(atxn.Super.Legacy()) {
 		return 0, false
 	}
+	if ip.IsInline() {
+		if offset+count <= MAXINLINE {
+			ip.writeInline(atxn, offset, dataBuf[:count])
+			return count, true
+		}
+		if !ip.uninline(atxn) {
+			return 0, false
+		}
+	}
 	for boff := off / disk.BlockSize; n > uint64(0); boff++ {
 		blkno, new := ip.bmap(atxn, boff)
 		if blkno == common.NULLBNUM {
@@ -328,9 +486,7 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 			atxn.Op.OverWrite(addr, common.NBITBLOCK, data[0:nbytes])
 		} else {
 			buffer := atxn.ReadBlock(blkno)
-			for b := uint64(0); b < nbytes; b++ {
-				buffer.Data[byteoff+b] = data[b]
-			}
+			copy(buffer.Data[byteoff:byteoff+nbytes], data[:nbytes])
 			buffer.SetDirty()
 		}
 		n -= nbytes
@@ -343,14 +499,24 @@ func (ip *Inode) Write(atxn *alloctxn.AllocTxn, offset uint64,
 		if offset+cnt > ip.Size {
 			ip.Size = offset + cnt
 		}
+		if cnt > 0 {
+			ip.modified()
+		}
 		ip.WriteInode(atxn)
 		return cnt, true
 	}
 	return cnt, ok
 }
 
+func (ip *Inode) IncLink(atxn *alloctxn.AllocTxn) {
+	ip.Nlink = ip.Nlink + 1
+	ip.Changed()
+	ip.WriteInode(atxn)
+}
+
 func (ip *Inode) DecLink(atxn *alloctxn.AllocTxn) bool {
 	ip.Nlink = ip.Nlink - 1
+	ip.Changed()
 	ip.WriteInode(atxn)
 	return ip.Nlink == 0
 }
@@ -31,14 +31,17 @@ func (ip *Inode) freeIndex(op *alloctxn.AllocTxn, index uint64) {
 	ip.blks[index] = 0
 }
 
-// Frees indirect bn.  Assumes if bn is cleared, then all blocks > bn
-// have been cleared
-func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64, bn uint64) common.Bnum {
+// indshrink frees block bn of the index tree at root, of level level,
+// and the index blocks that that empties.  It returns root if the tree
+// is now empty, for the caller to free, and the first block of the run
+// of holes that ends at bn, which the caller can skip.  Assumes that
+// the blocks after bn have been freed.
+func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64, bn uint64) (common.Bnum, uint64) {
 	if root == common.NULLBNUM {
-		return 0
+		return common.NULLBNUM, 0
 	}
 	if level == 0 {
-		return root
+		return root, 0
 	}
 	divisor := pow(level - 1)
 	off := (bn / divisor)
@@ -47,43 +50,65 @@ func (ip *Inode) indshrink(op *alloctxn.AllocTxn, root common.Bnum, level uint64
 	b := op.ReadBlock(root)
 	nxtroot := b.BnumGet(boff)
 	op.AssertValidBlock(nxtroot)
+	var first = off * divisor
 	if nxtroot != 0 {
-		freeroot := ip.indshrink(op, nxtroot, level-1, ind)
-		if freeroot != 0 {
-			b.BnumPut(boff, 0)
-			op.FreeBlock(freeroot)
+		freeroot, nxtfirst := ip.indshrink(op, nxtroot, level-1, ind)
+		if freeroot == 0 {
+			return common.NULLBNUM, first + nxtfirst
 		}
+		b.BnumPut(boff, 0)
+		op.FreeBlock(freeroot)
 	}
-	if off == 0 && ind == 0 {
-		return root
-	} else {
-		return common.NULLBNUM
+	if off == 0 {
+		return root, 0
 	}
+	return common.NULLBNUM, first
+}
+
+// shrinkBlocks is the most blocks that a step of Shrink dirties: the
+// inode, two bitmap blocks, and an index block of each level; or, with
+// extents, the inode, the bitmap block of the freed block, and each
+// node below the root, which the step may write or free along with
+// its bitmap block.
+func (ip *Inode) shrinkBlocks(op *alloctxn.AllocTxn) uint64 {
+	if ip.UseExtents() {
+		return 2 + 2*ip.readNode(op, common.NULLBNUM).depth
+	}
+	return 3 + NINDLEVEL
 }
 
 // Frees as many blocks as possible, and returns if more shrinking is necessary.
-// 5: inode block, 2xbitmap block, indirect block, double indirect
 func (ip *Inode) Shrink(op *alloctxn.AllocTxn) bool {
 	util.DPrintf(1, "Shrink: from %d to %d\n", ip.ShrinkSize,
 		util.RoundUp(ip.Size, disk.BlockSize))
-	for ip.IsShrinking() && ip.shrinkFits(op, 5) {
+	if ip.IsInline() && ip.IsShrinking() {
+		// no blocks to free, just the contents past Size
+		ip.zeroInline(ip.Size)
+		ip.ShrinkSize = util.RoundUp(ip.Size, disk.BlockSize)
+	}
+	for ip.IsShrinking() && ip.shrinkFits(op, ip.shrinkBlocks(op)) {
+		if ip.UseExtents() {
+			ip.shrinkExt(op)
+			continue
+		}
 		ip.ShrinkSize -= 1
 		if ip.ShrinkSize < NDIRECT {
 			ip.freeIndex(op, ip.ShrinkSize)
-		} else {
-			var off = ip.ShrinkSize - NDIRECT
-			if off < NBLKBLK {
-				freeroot := ip.indshrink(op, ip.blks[INDIRECT], 1, off)
-				if freeroot != 0 {
-					ip.freeIndex(op, INDIRECT)
-				}
-			} else {
-				off = off - NBLKBLK
-				freeroot := ip.indshrink(op, ip.blks[DINDIRECT], 2, off)
-				if freeroot != 0 {
-					ip.freeIndex(op, DINDIRECT)
-				}
-			}
+			continue
+		}
+		slot, level, base := tree(ip.ShrinkSize)
+		freeroot, first := ip.indshrink(op, ip.blks[slot], level,
+			ip.ShrinkSize-base)
+		if freeroot != 0 {
+			ip.freeIndex(op, slot)
+		}
+		// skip the holes before ShrinkSize, which are common in
+		// large sparse files
+		cursz := util.RoundUp(ip.Size, disk.BlockSize)
+		if base+first > cursz {
+			ip.ShrinkSize = base + first
+		} else if ip.ShrinkSize > cursz {
+			ip.ShrinkSize = cursz
 		}
 	}
 	ip.WriteInode(op)
@@ -0,0 +1,58 @@
+package inode
+
+import (
+	"github.com/tchajed/marshal"
+
+	"github.com/mit-pdos/go-journal/common"
+)
+
+//
+// Walking an inode's blocks without a transaction, for fsck.
+//
+
+// Walk calls f for each block that ip points to, directly or through
+// index blocks: with its logical block number for a data block, and with
+// index true for an index block.  Walk reads index blocks with read,
+// which returns nil for a block that isn't valid; Walk doesn't descend
+// into those.
+func (ip *Inode) Walk(read func(common.Bnum) []byte,
+	f func(bn uint64, blkno common.Bnum, index bool)) {
+	if ip.IsInline() {
+		return
+	}
+	if ip.UseExtents() {
+		walkExt(read, decodeNode(ip.blks, common.NULLBNUM), f)
+		return
+	}
+	for bn := uint64(0); bn < NDIRECT; bn++ {
+		if ip.blks[bn] != common.NULLBNUM {
+			f(bn, ip.blks[bn], false)
+		}
+	}
+	var base = NDIRECT
+	for level := uint64(1); level <= NINDLEVEL; level++ {
+		walkInd(read, ip.blks[INDIRECT+level-1], level, base, f)
+		base += pow(level)
+	}
+}
+
+func walkInd(read func(common.Bnum) []byte, root common.Bnum, level uint64,
+	base uint64, f func(uint64, common.Bnum, bool)) {
+	if root == common.NULLBNUM {
+		return
+	}
+	if level == 0 {
+		f(base, root, false)
+		return
+	}
+	f(0, root, true)
+	blk := read(root)
+	if blk == nil {
+		return
+	}
+	divisor := pow(level - 1)
+	dec := marshal.NewDec(blk)
+	for i := uint64(0); i < NBLKBLK; i++ {
+		walkInd(read, common.Bnum(dec.GetInt()), level-1, base+i*divisor, f)
+	}
+}
@@ -0,0 +1,286 @@
+package nfs
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/rpcsrv"
+)
+
+//
+// Permission checks.  RPCs arriving through Register run on a view of
+// the Nfs whose cred is the caller's AUTH_UNIX credential.  In-process
+// callers pick a cred with WithCred, RootCred to be trusted; a view
+// without a cred may do nothing that needs permission.
+//
+
+// NOBODY is the uid and gid of callers without an AUTH_UNIX credential,
+// and of root if root is squashed.
+const NOBODY uint32 = 65534
+
+// Cred is the identity of a caller
+type Cred struct {
+	Uid  uint32
+	Gid  uint32
+	Gids []uint32
+}
+
+const (
+	permRead  uint32 = 4
+	permWrite uint32 = 2
+	permExec  uint32 = 1
+
+	modeSticky uint32 = 01000
+)
+
+func (cred *Cred) inGroup(gid uint32) bool {
+	if cred.Gid == gid {
+		return true
+	}
+	for _, g := range cred.Gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// mkCred decodes auth into a Cred, squashing root if nfs.RootSquash
+func (nfs *Nfs) mkCred(auth rfc1057.Opaque_auth) *Cred {
+	cred := &Cred{Uid: NOBODY, Gid: NOBODY}
+	if auth.Flavor == rfc1057.AUTH_UNIX {
+		var au rfc1057.Auth_unix
+		rd := xdr.MakeReader(auth.Body)
+		au.Xdr(rd)
+		if rd.Error() == nil {
+			cred = &Cred{Uid: au.Uid, Gid: au.Gid, Gids: au.Gids}
+		}
+	}
+	if nfs.RootSquash {
+		if cred.Uid == 0 {
+			cred.Uid = NOBODY
+		}
+		if cred.Gid == 0 {
+			cred.Gid = NOBODY
+		}
+		var gids []uint32
+		for _, g := range cred.Gids {
+			if g != 0 {
+				gids = append(gids, g)
+			}
+		}
+		cred.Gids = gids
+	}
+	return cred
+}
+
+// RootCred returns the cred of a trusted in-process caller
+func RootCred() *Cred {
+	return &Cred{Uid: 0, Gid: 0}
+}
+
+// WithCred returns a view of nfs that runs RPCs on behalf of cred
+func (nfs *Nfs) WithCred(cred *Cred) *Nfs {
+	return &Nfs{serverSt: nfs.serverSt, cred: cred}
+}
+
+func (nfs *Nfs) isRoot() bool {
+	return nfs.cred != nil && nfs.cred.Uid == 0
+}
+
+func (nfs *Nfs) isOwner(ip *inode.Inode) bool {
+	return nfs.cred != nil && (nfs.cred.Uid == 0 || nfs.cred.Uid == ip.Uid)
+}
+
+// perm returns the read, write, and execute bits that the caller has
+// on ip
+func (nfs *Nfs) perm(ip *inode.Inode) uint32 {
+	if nfs.cred == nil {
+		return 0
+	}
+	if nfs.isRoot() {
+		return permRead | permWrite | permExec
+	}
+	if nfs.cred.Uid == ip.Uid {
+		return (ip.Mode >> 6) & 7
+	}
+	if nfs.cred.inGroup(ip.Gid) {
+		return (ip.Mode >> 3) & 7
+	}
+	return ip.Mode & 7
+}
+
+func (nfs *Nfs) allowed(ip *inode.Inode, want uint32) bool {
+	return nfs.perm(ip)&want == want
+}
+
+// mayDelete reports whether the caller may remove the name for ip from
+// dip.  In a sticky directory, only the owner of ip or dip may.
+func (nfs *Nfs) mayDelete(dip *inode.Inode, ip *inode.Inode) bool {
+	if !nfs.allowed(dip, permWrite|permExec) {
+		return false
+	}
+	if dip.Mode&modeSticky != 0 {
+		return nfs.isOwner(dip) || nfs.isOwner(ip)
+	}
+	return true
+}
+
+// mayRename reports whether the caller may rename from in dipfrom to
+// to (nil if none) in dipto.  Moving a directory to another parent
+// updates its "..", which requires write permission on it.
+func (nfs *Nfs) mayRename(dipfrom, dipto, from, to *inode.Inode) bool {
+	if !nfs.mayDelete(dipfrom, from) {
+		return false
+	}
+	if to != nil && !nfs.mayDelete(dipto, to) {
+		return false
+	}
+	if !nfs.allowed(dipto, permWrite|permExec) {
+		return false
+	}
+	if from.Kind == nfstypes.NF3DIR && dipfrom != dipto {
+		return nfs.allowed(from, permWrite)
+	}
+	return true
+}
+
+// access returns the ACCESS3 bits the caller has on ip
+func (nfs *Nfs) access(ip *inode.Inode) uint32 {
+	perm := nfs.perm(ip)
+	var access uint32
+	if perm&permRead != 0 {
+		access |= nfstypes.ACCESS3_READ
+	}
+	if perm&permWrite != 0 {
+		access |= nfstypes.ACCESS3_MODIFY | nfstypes.ACCESS3_EXTEND
+		if ip.Kind == nfstypes.NF3DIR {
+			access |= nfstypes.ACCESS3_DELETE
+		}
+	}
+	if perm&permExec != 0 {
+		if ip.Kind == nfstypes.NF3DIR {
+			access |= nfstypes.ACCESS3_LOOKUP
+		} else {
+			access |= nfstypes.ACCESS3_EXECUTE
+		}
+	}
+	return access
+}
+
+// checkSetattr checks that the caller may apply attr to ip.  Only the
+// owner may change the mode or set times of its choosing, only root may
+// give a file away, and the owner may only change the group to one it
+// belongs to.
+func (nfs *Nfs) checkSetattr(ip *inode.Inode, attr nfstypes.Sattr3) nfstypes.Nfsstat3 {
+	if nfs.isRoot() {
+		return nfstypes.NFS3_OK
+	}
+	if attr.Uid.Set_it && uint32(attr.Uid.Uid) != ip.Uid {
+		return nfstypes.NFS3ERR_PERM
+	}
+	if attr.Gid.Set_it && uint32(attr.Gid.Gid) != ip.Gid &&
+		(!nfs.isOwner(ip) || !nfs.cred.inGroup(uint32(attr.Gid.Gid))) {
+		return nfstypes.NFS3ERR_PERM
+	}
+	if (attr.Mode.Set_it ||
+		attr.Atime.Set_it == nfstypes.SET_TO_CLIENT_TIME ||
+		attr.Mtime.Set_it == nfstypes.SET_TO_CLIENT_TIME) && !nfs.isOwner(ip) {
+		return nfstypes.NFS3ERR_PERM
+	}
+	// setting times to now, like writing, requires write permission
+	if (attr.Size.Set_it ||
+		attr.Atime.Set_it == nfstypes.SET_TO_SERVER_TIME ||
+		attr.Mtime.Set_it == nfstypes.SET_TO_SERVER_TIME) && !nfs.mayWrite(ip) {
+		return nfstypes.NFS3ERR_ACCES
+	}
+	return nfstypes.NFS3_OK
+}
+
+// mayWrite reports whether the caller may change ip's size or set its
+// times to now.  As in knfsd, the owner always may, since a client
+// that opens a file it owns with O_TRUNC truncates it with SETATTR
+// whatever its mode; WRITE checks the mode.
+func (nfs *Nfs) mayWrite(ip *inode.Inode) bool {
+	return nfs.isOwner(ip) || nfs.allowed(ip, permWrite)
+}
+
+// A view caches the NFS procedures for one credential
+type view struct {
+	key      string
+	handlers []func(args *xdr.XdrState) (xdr.Xdrable, error)
+	elem     *list.Element
+}
+
+// MAXVIEWS bounds the number of credentials Register caches, evicting
+// the least recently used
+const MAXVIEWS = 1024
+
+// nonIdempotent are the NFS procedures that fail or do something else
+// if a retransmission runs them again
+var nonIdempotent = []uint32{
+	nfstypes.NFSPROC3_SETATTR, nfstypes.NFSPROC3_WRITE,
+	nfstypes.NFSPROC3_CREATE, nfstypes.NFSPROC3_MKDIR,
+	nfstypes.NFSPROC3_SYMLINK, nfstypes.NFSPROC3_MKNOD,
+	nfstypes.NFSPROC3_REMOVE, nfstypes.NFSPROC3_RMDIR,
+	nfstypes.NFSPROC3_RENAME, nfstypes.NFSPROC3_LINK,
+}
+
+// Register registers the MOUNT and NFS procedures with srv.  NFS
+// procedures run with the caller's credential.  FSINFO offers callers
+// over UDP transfers that fit in a datagram.
+func (nfs *Nfs) Register(srv *rpcsrv.Server) {
+	srv.RegisterMany(nfstypes.MOUNT_PROGRAM_MOUNT_V3_regs(nfs))
+
+	var mu sync.Mutex
+	views := make(map[string]*view)
+	lru := list.New() // of *view, most recently used first
+	getView := func(auth rfc1057.Opaque_auth) *view {
+		// callers without an AUTH_UNIX credential share a view
+		var key = ""
+		if auth.Flavor == rfc1057.AUTH_UNIX {
+			key = "unix:" + string(auth.Body)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		v, ok := views[key]
+		if ok {
+			lru.MoveToFront(v.elem)
+			return v
+		}
+		if len(views) >= MAXVIEWS {
+			old := lru.Remove(lru.Back()).(*view)
+			delete(views, old.key)
+		}
+		cred := nfs.mkCred(auth)
+		util.DPrintf(1, "Register: new view for %v\n", cred)
+		v = &view{key: key, handlers: make([]func(*xdr.XdrState) (xdr.Xdrable, error),
+			NUM_NFS_OPS)}
+		for _, r := range nfstypes.NFS_PROGRAM_NFS_V3_regs(nfs.WithCred(cred)) {
+			v.handlers[r.Proc] = r.Handler
+		}
+		v.elem = lru.PushFront(v)
+		views[key] = v
+		return v
+	}
+	for proc := uint32(0); proc < NUM_NFS_OPS; proc++ {
+		p := proc
+		srv.Register(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, p,
+			func(call *rpcsrv.Call, args *xdr.XdrState) (xdr.Xdrable, error) {
+				res, err := getView(call.Cred).handlers[p](args)
+				if err == nil && call.Datagram && p == nfstypes.NFSPROC3_FSINFO {
+					datagramFsinfo(res.(*nfstypes.FSINFO3res))
+				}
+				return res, err
+			})
+	}
+	for _, proc := range nonIdempotent {
+		srv.NonIdempotent(nfstypes.NFS_PROGRAM, nfstypes.NFS_V3, proc)
+	}
+}
@@ -0,0 +1,163 @@
+package nfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/dir"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Directory compaction.  Removing a name from a directory that
+// dir.Sparse says is worth compacting queues the directory, and the
+// compactor compacts the queued directories every COMPACTINTERVAL, so
+// that a mass deletion compacts a directory now and then rather than
+// after each removal.
+//
+// Moving the entries of a linear directory changes their cookies, so
+// while a client may be in the middle of reading a linear directory,
+// that is, within READDIRGRACE of its last READDIR or READDIRPLUS,
+// the compactor only truncates the free entries at its end, and queues
+// it again for the rest.
+//
+
+const COMPACTINTERVAL = time.Second
+
+const READDIRGRACE = time.Minute
+
+type compactSt struct {
+	mu      *sync.Mutex
+	pending map[common.Inum]bool
+	read    map[common.Inum]time.Time // last READDIR or READDIRPLUS
+	done    chan struct{}
+	wg      *sync.WaitGroup
+}
+
+func mkCompactSt() *compactSt {
+	return &compactSt{
+		mu:      new(sync.Mutex),
+		pending: make(map[common.Inum]bool),
+		read:    make(map[common.Inum]time.Time),
+		done:    make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+	}
+}
+
+// readDir records that a client read directory inum, and may hold its
+// cookies
+func (nfs *Nfs) readDir(inum common.Inum) {
+	st := nfs.compact
+	st.mu.Lock()
+	st.read[inum] = time.Now()
+	st.mu.Unlock()
+}
+
+// mayMove reports whether no client may be reading directory inum, so
+// that compacting it may change its cookies
+func (st *compactSt) mayMove(inum common.Inum) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.read[inum]
+	if ok && time.Since(t) >= READDIRGRACE {
+		delete(st.read, inum)
+		return true
+	}
+	return !ok
+}
+
+// compactLater queues dip, from which op just removed name, for the
+// compactor if it is worth compacting
+func (nfs *Nfs) compactLater(op *fstxn.FsTxn, dip *inode.Inode, name nfstypes.Filename3) {
+	if !dir.Sparse(dip, op, name) {
+		return
+	}
+	st := nfs.compact
+	st.mu.Lock()
+	st.pending[dip.Inum] = true
+	st.mu.Unlock()
+}
+
+// compactDir compacts directory inum, a transaction per step
+func (nfs *Nfs) compactDir(inum common.Inum) bool {
+	for {
+		op := fstxn.Begin(nfs.fsstate)
+		dip := op.GetInodeInumFree(inum)
+		if dip.Kind != nfstypes.NF3DIR || dip.Nlink == 0 {
+			op.Abort()
+			return true
+		}
+		if dip.IsShrinking() {
+			// finish truncating the last compaction first, like
+			// getShrink, so that Resize doesn't lose track of it
+			op.Abort()
+			if !nfs.shrinkst.DoShrink(inum) {
+				return false
+			}
+			continue
+		}
+		move := nfs.compact.mayMove(inum)
+		later := !move && dir.MovesCookies(dip, op)
+		more, shrink := dir.Compact(dip, op, move)
+		if !op.Commit() {
+			return false
+		}
+		if shrink {
+			nfs.shrinkst.StartShrinker(inum)
+		}
+		if !more {
+			util.DPrintf(1, "compactDir # %d: done\n", inum)
+			if later {
+				st := nfs.compact
+				st.mu.Lock()
+				st.pending[inum] = true
+				st.mu.Unlock()
+			}
+			return true
+		}
+	}
+}
+
+// compactPending compacts the queued directories
+func (nfs *Nfs) compactPending() {
+	st := nfs.compact
+	st.mu.Lock()
+	pending := st.pending
+	st.pending = make(map[common.Inum]bool)
+	for inum, t := range st.read {
+		if time.Since(t) >= READDIRGRACE {
+			delete(st.read, inum)
+		}
+	}
+	st.mu.Unlock()
+	for inum := range pending {
+		nfs.compactDir(inum)
+	}
+}
+
+func (nfs *Nfs) startCompactor() {
+	st := nfs.compact
+	st.wg.Add(1)
+	go func() {
+		defer st.wg.Done()
+		t := time.NewTicker(COMPACTINTERVAL)
+		defer t.Stop()
+		for {
+			select {
+			case <-st.done:
+				return
+			case <-t.C:
+				nfs.compactPending()
+			}
+		}
+	}()
+}
+
+func (nfs *Nfs) stopCompactor() {
+	close(nfs.compact.done)
+	nfs.compact.wg.Wait()
+}
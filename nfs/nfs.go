@@ -1,6 +1,11 @@
 package nfs
 
 import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/goose-lang/primitive/disk"
 
 	"github.com/mit-pdos/go-journal/buf"
@@ -10,49 +15,188 @@ import (
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fstxn"
 	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
 	"github.com/mit-pdos/go-nfsd/shrinker"
 	"github.com/mit-pdos/go-nfsd/super"
 	"github.com/mit-pdos/go-nfsd/util/stats"
 )
 
+// Nfs is a view of a server that runs RPCs on behalf of one caller.
+// All views of a server share its serverSt.
 type Nfs struct {
+	*serverSt
+	// the caller this view runs RPCs for; nil allows nothing that needs
+	// permission
+	cred *Cred
+}
+
+type serverSt struct {
 	fsstate  *fstxn.FsState
 	shrinkst *shrinker.ShrinkerSt
 	// support unstable writes
 	Unstable bool
-	// statistics
-	stats [NUM_NFS_OPS]stats.Op
+	// treat callers with uid 0 as NOBODY
+	RootSquash bool
+	stats      *[NUM_NFS_OPS]stats.Op
+	// files used recently and orphans
+	orphans *orphanSt
+	// directories to compact
+	compact *compactSt
+	// write verifier of this boot, which tells clients that UNSTABLE
+	// writes acknowledged before a restart may be lost
+	verf nfstypes.Writeverf3
 }
 
+// MakeNfs opens the file system on d, and panics if there is none.
+// Use Mkfs to make one.  The Nfs it returns runs RPCs
+// for no one; see WithCred.
 func MakeNfs(d disk.Disk) *Nfs {
+	nfs, err := OpenNfs(d)
+	if err != nil {
+		panic(err)
+	}
+	return nfs
+}
+
+// OpenNfs opens the file system on d.  It fails if d has no file system,
+// including if d is blank, or a file system that doesn't fit d.
+func OpenNfs(d disk.Disk) (*Nfs, error) {
 	// run first so that disk is initialized before mkLog
-	super := super.MkFsSuper(d)
+	fssuper, serr := super.ReadFsSuper(d)
+	if serr != super.OK {
+		return nil, superError(fssuper, d, serr)
+	}
+	return openNfs(fssuper)
+}
+
+// Mkfs makes an empty file system on d with room for ninode inodes and
+// the given label, overwriting whatever is on d
+func Mkfs(d disk.Disk, ninode uint64, label string) error {
+	if uint64(len(label)) > super.LABELSZ {
+		return fmt.Errorf("label is longer than %d bytes", super.LABELSZ)
+	}
+	fssuper, serr := super.MkFsSuperInodes(d, ninode)
+	if serr != super.OK {
+		return fmt.Errorf("%d inodes don't fit on a disk of %d blocks",
+			ninode, d.Size())
+	}
+	copy(fssuper.Label, label)
+	// wipe the log, so that recovery doesn't apply it to the new file
+	// system, and the superblock, so that a crash leaves no file system
+	zero := make(disk.Block, disk.BlockSize)
+	for bn := uint64(0); bn <= uint64(fssuper.SuperStart()); bn++ {
+		d.Write(bn, zero)
+	}
+	nfs, err := openNfs(fssuper)
+	if err != nil {
+		return err
+	}
+	nfs.ShutdownNfs()
+	return nil
+}
+
+// openNfs opens the file system laid out by fssuper, making one if
+// fssuper is the layout for a new one
+func openNfs(fssuper *super.FsSuper) (*Nfs, error) {
+	d := fssuper.Disk
 	util.DPrintf(1, "Super: "+
-		"Size %d NBlockBitmap %d NInodeBitmap %d Maxaddr %d\n",
-		d.Size(),
-		super.NBlockBitmap, super.NInodeBitmap, super.Maxaddr)
+		"Size %d Version %d NBlockBitmap %d NInodeBitmap %d Maxaddr %d "+
+		"Created %d UUID %x Label %q\n",
+		d.Size(), fssuper.Version,
+		fssuper.NBlockBitmap, fssuper.NInodeBitmap, fssuper.Maxaddr,
+		fssuper.Created, fssuper.UUID, fssuper.LabelString())
 
 	log := obj.MkLog(d) // runs recovery
 
-	i := readRootInode(super)
-	if i.Kind == 0 { // make a new file system?
-		makeFs(super)
+	fresh := !fssuper.Formatted()
+	if fresh {
+		makeFs(fssuper)
+	} else {
+		i := readRootInode(fssuper, log)
+		if i.Kind != nfstypes.NF3DIR {
+			log.Shutdown()
+			return nil, errors.New("not a file system: no root directory")
+		}
 	}
 
-	st := fstxn.MkFsState(super, log)
-	nfs := &Nfs{
+	st := fstxn.MkFsState(fssuper, log)
+	nfs := &Nfs{serverSt: &serverSt{
 		fsstate:  st,
 		shrinkst: shrinker.MkShrinkerSt(st),
 		Unstable: true,
-	}
-	if i.Kind == 0 {
+		stats:    new([NUM_NFS_OPS]stats.Op),
+		orphans:  mkOrphanSt(),
+		compact:  mkCompactSt(),
+		verf:     mkWriteVerf(),
+	}}
+	if fresh {
 		nfs.makeRootDir()
+		// last, so that a crash while making the file system
+		// leaves a blank disk
+		fssuper.WriteSuper()
+	} else {
+		nfs.resumeShrinks()
+		if !fssuper.Legacy() {
+			nfs.freeOrphans()
+		}
 	}
-	return nfs
+	nfs.startReaper()
+	nfs.startCompactor()
+	return nfs, nil
+}
+
+// mkWriteVerf returns a write verifier that differs from those of
+// earlier boots
+func mkWriteVerf() nfstypes.Writeverf3 {
+	var verf nfstypes.Writeverf3
+	rand.Read(verf[:])
+	return verf
+}
+
+// resumeShrinks hands the inodes that were shrinking when the server
+// stopped to the shrinker's resumers, so that they free their blocks
+// without waiting for someone to touch them
+func (nfs *Nfs) resumeShrinks() {
+	super := nfs.fsstate.Super
+	log := nfs.fsstate.Txn
+	inodeblk := disk.BlockSize / super.InodeSz()
+	var shrinking []common.Inum
+	for bn := super.InodeStart(); bn < super.DataStart(); bn++ {
+		blk := log.Load(super.Block2addr(bn), common.NBITBLOCK)
+		for i := uint64(0); i < inodeblk; i++ {
+			inum := common.Inum(uint64(bn-super.InodeStart())*inodeblk + i)
+			if inum < common.ROOTINUM || inum >= super.NInode() {
+				continue
+			}
+			a := super.Inum2Addr(inum)
+			ip := inode.Decode(buf.MkBufLoad(a, super.InodeSz()*8, blk.Data), inum)
+			if ip.IsShrinking() {
+				util.DPrintf(1, "resumeShrinks: # %d\n", inum)
+				shrinking = append(shrinking, inum)
+			}
+		}
+	}
+	nfs.shrinkst.ResumeShrinkers(shrinking)
+}
+
+func superError(fssuper *super.FsSuper, d disk.Disk, serr uint64) error {
+	switch serr {
+	case super.ENOFS:
+		return errors.New("not a file system: no superblock (format it with mkfs)")
+	case super.EVERSION:
+		return fmt.Errorf("unsupported file system version %d (supported: %d)",
+			fssuper.Version, super.VERSION)
+	case super.ESIZE:
+		return fmt.Errorf("file system is %d blocks but the disk is %d blocks",
+			fssuper.Size, d.Size())
+	}
+	return errors.New("corrupt superblock: inconsistent layout")
 }
 
 func (nfs *Nfs) ShutdownNfs() {
 	util.DPrintf(1, "Shutdown\n")
+	nfs.stopReaper()
+	nfs.stopCompactor()
 	nfs.shrinkst.Shutdown()
 	nfs.fsstate.Txn.Shutdown()
 	util.DPrintf(1, "Shutdown done\n")
@@ -82,55 +226,56 @@ func (nfs *Nfs) makeRootDir() {
 func makeFs(super *super.FsSuper) {
 	util.DPrintf(1, "mkfs")
 
+	super.Created = uint64(time.Now().Unix())
+	rand.Read(super.UUID)
+
+	// the disk may have held another file system
+	zero := make(disk.Block, disk.BlockSize)
+	for bn := super.InodeStart(); bn < super.DataStart(); bn++ {
+		super.Disk.Write(uint64(bn), zero)
+	}
+
 	root := inode.MkRootInode()
 	util.DPrintf(1, "root %v\n", root)
 	raddr := super.Inum2Addr(common.ROOTINUM)
-	rootblk := root.Encode()
-	rootbuf := buf.MkBuf(raddr, common.INODESZ*8, rootblk)
+	rootblk := root.Encode(super.InodeSz())
+	rootbuf := buf.MkBuf(raddr, super.InodeSz()*8, rootblk)
 	rootbuf.WriteDirect(super.Disk)
 
-	markAlloc(super, super.DataStart(), super.MaxBnum())
+	markAlloc(super.Disk, super.BitmapBlockStart(), super.NBlockBitmap,
+		uint64(super.DataStart()), uint64(super.MaxBnum()))
+	// inode 0 is unused and inode 1 is the root
+	markAlloc(super.Disk, super.BitmapInodeStart(), super.NInodeBitmap,
+		uint64(common.ROOTINUM)+1, uint64(super.NInode()))
 }
 
-func markAlloc(super *super.FsSuper, n common.Bnum, m common.Bnum) {
-	util.DPrintf(1, "markAlloc: [0, %d) and [%d,%d)\n", n, m,
-		super.NBlockBitmap*common.NBITBLOCK)
-	if n >= common.Bnum(common.NBITBLOCK) ||
-		m >= common.Bnum(common.NBITBLOCK*super.NBlockBitmap) ||
-		m < n {
+// markAlloc marks [0, n) and [m, end of bitmap) allocated in the bitmap
+// of nblk blocks at start
+func markAlloc(d disk.Disk, start common.Bnum, nblk uint64, n uint64, m uint64) {
+	util.DPrintf(1, "markAlloc: %d: [0, %d) and [%d,%d)\n", start, n, m,
+		nblk*common.NBITBLOCK)
+	if m > nblk*common.NBITBLOCK || m < n {
 		panic("markAlloc: configuration makes no sense")
 	}
-	blk := make(disk.Block, disk.BlockSize)
-	for bn := uint64(0); bn < uint64(n); bn++ {
+	bitmap := make([]byte, nblk*disk.BlockSize)
+	for bn := uint64(0); bn < n; bn++ {
 		byte := bn / 8
 		bit := bn % 8
-		blk[byte] = blk[byte] | 1<<bit
+		bitmap[byte] = bitmap[byte] | 1<<bit
 	}
-	super.Disk.Write(uint64(super.BitmapBlockStart()), blk)
-
-	var blk1 = blk
-	blkno := m/common.Bnum(common.NBITBLOCK) + super.BitmapBlockStart()
-	if blkno > super.BitmapBlockStart() {
-		blk1 = make(disk.Block, disk.BlockSize)
-	}
-	for bn := uint64(m) % common.NBITBLOCK; bn < common.NBITBLOCK; bn++ {
+	for bn := m; bn < nblk*common.NBITBLOCK; bn++ {
 		byte := bn / 8
 		bit := bn % 8
-		blk1[byte] = blk1[byte] | 1<<bit
+		bitmap[byte] = bitmap[byte] | 1<<bit
+	}
+	for i := uint64(0); i < nblk; i++ {
+		d.Write(uint64(start)+i, bitmap[i*disk.BlockSize:(i+1)*disk.BlockSize])
 	}
-	super.Disk.Write(uint64(blkno), blk1)
-
-	// mark inode 0 and 1 as allocated
-	blk2 := make(disk.Block, disk.BlockSize)
-	blk2[0] = blk2[0] | 1<<0
-	blk2[0] = blk2[0] | 1<<1
-	super.Disk.Write(uint64(super.BitmapInodeStart()), blk2)
 }
 
-func readRootInode(super *super.FsSuper) *inode.Inode {
+func readRootInode(super *super.FsSuper, log *obj.Log) *inode.Inode {
 	addr := super.Inum2Addr(common.ROOTINUM)
-	blk := super.Disk.Read(uint64(addr.Blkno))
-	buf := buf.MkBufLoad(addr, common.INODESZ*8, blk)
+	buf := log.Load(addr, super.InodeSz()*8)
 	i := inode.Decode(buf, common.ROOTINUM)
 	return i
 }
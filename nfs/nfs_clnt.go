@@ -6,6 +6,7 @@ import (
 	"github.com/goose-lang/primitive/disk"
 	"github.com/mit-pdos/go-nfsd/fh"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/super"
 )
 
 type NfsClient struct {
@@ -14,8 +15,12 @@ type NfsClient struct {
 
 func MkNfsClient(sz uint64) *NfsClient {
 	d := disk.NewMemDisk(sz)
+	err := Mkfs(d, super.DEFNINODE, "")
+	if err != nil {
+		panic(err)
+	}
 	return &NfsClient{
-		srv: MakeNfs(d),
+		srv: MakeNfs(d).WithCred(RootCred()),
 	}
 }
 
@@ -28,8 +33,20 @@ func (clnt *NfsClient) Crash() {
 }
 
 func (clnt *NfsClient) CreateOp(fh nfstypes.Nfs_fh3, name string) nfstypes.CREATE3res {
+	return clnt.CreateAttrOp(fh, name, nfstypes.Sattr3{})
+}
+
+func (clnt *NfsClient) CreateAttrOp(fh nfstypes.Nfs_fh3, name string, sattr nfstypes.Sattr3) nfstypes.CREATE3res {
+	where := nfstypes.Diropargs3{Dir: fh, Name: nfstypes.Filename3(name)}
+	how := nfstypes.Createhow3{Obj_attributes: sattr}
+	args := nfstypes.CREATE3args{Where: where, How: how}
+	attr := clnt.srv.NFSPROC3_CREATE(args)
+	return attr
+}
+
+func (clnt *NfsClient) CreateExclOp(fh nfstypes.Nfs_fh3, name string, verf nfstypes.Createverf3) nfstypes.CREATE3res {
 	where := nfstypes.Diropargs3{Dir: fh, Name: nfstypes.Filename3(name)}
-	how := nfstypes.Createhow3{}
+	how := nfstypes.Createhow3{Mode: nfstypes.EXCLUSIVE, Verf: verf}
 	args := nfstypes.CREATE3args{Where: where, How: how}
 	attr := clnt.srv.NFSPROC3_CREATE(args)
 	return attr
@@ -48,6 +65,12 @@ func (clnt *NfsClient) GetattrOp(fh nfstypes.Nfs_fh3) *nfstypes.GETATTR3res {
 	return &attr
 }
 
+func (clnt *NfsClient) AccessOp(fh nfstypes.Nfs_fh3, access uint32) nfstypes.ACCESS3res {
+	args := nfstypes.ACCESS3args{Object: fh, Access: nfstypes.Uint32(access)}
+	reply := clnt.srv.NFSPROC3_ACCESS(args)
+	return reply
+}
+
 func (clnt *NfsClient) WriteOp(fh nfstypes.Nfs_fh3, off uint64, data []byte, how nfstypes.Stable_how) *nfstypes.WRITE3res {
 	args := nfstypes.WRITE3args{
 		File:   fh,
@@ -101,6 +124,13 @@ func (clnt *NfsClient) SymLinkOp(dir nfstypes.Nfs_fh3, name string, path nfstype
 	return attr
 }
 
+func (clnt *NfsClient) MknodOp(dir nfstypes.Nfs_fh3, name string, what nfstypes.Mknoddata3) nfstypes.MKNOD3res {
+	where := nfstypes.Diropargs3{Dir: dir, Name: nfstypes.Filename3(name)}
+	args := nfstypes.MKNOD3args{Where: where, What: what}
+	attr := clnt.srv.NFSPROC3_MKNOD(args)
+	return attr
+}
+
 func (clnt *NfsClient) ReadLinkOp(fh nfstypes.Nfs_fh3) nfstypes.READLINK3res {
 	args := nfstypes.READLINK3args{Symlink: fh}
 	attr := clnt.srv.NFSPROC3_READLINK(args)
@@ -126,20 +156,64 @@ func (clnt *NfsClient) RenameOp(fhfrom nfstypes.Nfs_fh3, from string,
 	return reply.Status
 }
 
+func (clnt *NfsClient) LinkOp(fh nfstypes.Nfs_fh3, dir nfstypes.Nfs_fh3, name string) nfstypes.LINK3res {
+	args := nfstypes.LINK3args{
+		File: fh,
+		Link: nfstypes.Diropargs3{Dir: dir, Name: nfstypes.Filename3(name)},
+	}
+	reply := clnt.srv.NFSPROC3_LINK(args)
+	return reply
+}
+
 func (clnt *NfsClient) SetattrOp(fh nfstypes.Nfs_fh3, sz uint64) nfstypes.SETATTR3res {
 	size := nfstypes.Set_size3{Set_it: true, Size: nfstypes.Size3(sz)}
 	attr := nfstypes.Sattr3{Size: size}
+	return clnt.SetattrAttrOp(fh, attr)
+}
+
+func (clnt *NfsClient) SetattrAttrOp(fh nfstypes.Nfs_fh3, attr nfstypes.Sattr3) nfstypes.SETATTR3res {
 	args := nfstypes.SETATTR3args{Object: fh, New_attributes: attr}
 	reply := clnt.srv.NFSPROC3_SETATTR(args)
 	return reply
 }
 
+func (clnt *NfsClient) SetattrGuardOp(fh nfstypes.Nfs_fh3, attr nfstypes.Sattr3, ctime nfstypes.Nfstime3) nfstypes.SETATTR3res {
+	guard := nfstypes.Sattrguard3{Check: true, Obj_ctime: ctime}
+	args := nfstypes.SETATTR3args{Object: fh, New_attributes: attr, Guard: guard}
+	reply := clnt.srv.NFSPROC3_SETATTR(args)
+	return reply
+}
+
+func (clnt *NfsClient) FsstatOp(fh nfstypes.Nfs_fh3) nfstypes.FSSTAT3res {
+	args := nfstypes.FSSTAT3args{Fsroot: fh}
+	reply := clnt.srv.NFSPROC3_FSSTAT(args)
+	return reply
+}
+
+func (clnt *NfsClient) FsinfoOp(fh nfstypes.Nfs_fh3) nfstypes.FSINFO3res {
+	args := nfstypes.FSINFO3args{Fsroot: fh}
+	reply := clnt.srv.NFSPROC3_FSINFO(args)
+	return reply
+}
+
+func (clnt *NfsClient) PathconfOp(fh nfstypes.Nfs_fh3) nfstypes.PATHCONF3res {
+	args := nfstypes.PATHCONF3args{Object: fh}
+	reply := clnt.srv.NFSPROC3_PATHCONF(args)
+	return reply
+}
+
 func (clnt *NfsClient) ReadDirPlusOp(dir nfstypes.Nfs_fh3, cnt uint64) nfstypes.READDIRPLUS3res {
 	args := nfstypes.READDIRPLUS3args{Dir: dir, Dircount: nfstypes.Count3(100), Maxcount: nfstypes.Count3(cnt)}
 	reply := clnt.srv.NFSPROC3_READDIRPLUS(args)
 	return reply
 }
 
+func (clnt *NfsClient) ReadDirOp(dir nfstypes.Nfs_fh3, cookie nfstypes.Cookie3, verf nfstypes.Cookieverf3, cnt uint64) nfstypes.READDIR3res {
+	args := nfstypes.READDIR3args{Dir: dir, Cookie: cookie, Cookieverf: verf, Count: nfstypes.Count3(cnt)}
+	reply := clnt.srv.NFSPROC3_READDIR(args)
+	return reply
+}
+
 // Run parallel clients executing f(), each in their own directory
 func Parallel(nthread int, disksz uint64,
 	f func(clnt *NfsClient, dirfh nfstypes.Nfs_fh3) int) int {
@@ -1,6 +1,8 @@
 package nfs
 
 import (
+	"github.com/tchajed/marshal"
+
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fh"
@@ -13,7 +15,7 @@ func Ls3(dip *inode.Inode, op *fstxn.FsTxn, start nfstypes.Cookie3, dircount, ma
 	var lst *nfstypes.Entryplus3
 	var last *nfstypes.Entryplus3
 	eof := dir.Apply(dip, op, uint64(start), uint64(dircount), uint64(maxcount),
-		func(ip *inode.Inode, name string, inum common.Inum, off uint64) {
+		func(ip *inode.Inode, name string, inum common.Inum, cookie uint64) {
 			fattr := ip.MkFattr()
 			fh := &fh.Fh{Ino: ip.Inum, Gen: ip.Gen}
 			ph := nfstypes.Post_op_fh3{
@@ -27,7 +29,7 @@ func Ls3(dip *inode.Inode, op *fstxn.FsTxn, start nfstypes.Cookie3, dircount, ma
 			e := &nfstypes.Entryplus3{
 				Fileid:          nfstypes.Fileid3(inum),
 				Name:            nfstypes.Filename3(name),
-				Cookie:          nfstypes.Cookie3(off),
+				Cookie:          nfstypes.Cookie3(cookie),
 				Name_attributes: pa,
 				Name_handle:     ph,
 				Nextentry:       nil,
@@ -49,11 +51,11 @@ func Readdir3(dip *inode.Inode, op *fstxn.FsTxn,
 	var lst *nfstypes.Entry3
 	var last *nfstypes.Entry3
 	eof := dir.ApplyEnts(dip, op, uint64(start), uint64(count),
-		func(name string, inum common.Inum, off uint64) {
+		func(name string, inum common.Inum, cookie uint64) {
 			e := &nfstypes.Entry3{
 				Fileid:    nfstypes.Fileid3(inum),
 				Name:      nfstypes.Filename3(name),
-				Cookie:    nfstypes.Cookie3(off),
+				Cookie:    nfstypes.Cookie3(cookie),
 				Nextentry: nil,
 			}
 			if last == nil {
@@ -67,3 +69,24 @@ func Readdir3(dip *inode.Inode, op *fstxn.FsTxn,
 	dl := nfstypes.Dirlist3{Entries: lst, Eof: eof}
 	return dl
 }
+
+// cookieVerf is the cookie verifier of a directory of generation gen
+func cookieVerf(gen uint64) nfstypes.Cookieverf3 {
+	var verf nfstypes.Cookieverf3
+	enc := marshal.NewEnc(uint64(len(verf)))
+	enc.PutInt(gen)
+	copy(verf[:], enc.Finish())
+	return verf
+}
+
+// badCookie reports whether a client can't continue reading dip from
+// cookie with verifier verf, because dip never returned cookie or its
+// layout changed since it returned verf.  Cookie 0 reads from the start
+// and needs no verifier.
+func badCookie(dip *inode.Inode, op *fstxn.FsTxn, cookie nfstypes.Cookie3, verf nfstypes.Cookieverf3) bool {
+	if cookie == 0 {
+		return false
+	}
+	return verf != cookieVerf(dir.Generation(dip, op)) ||
+		!dir.ValidCookie(dip, op, uint64(cookie))
+}
@@ -3,6 +3,8 @@ package nfs
 import (
 	"time"
 
+	"github.com/goose-lang/primitive/disk"
+
 	"github.com/mit-pdos/go-journal/common"
 	"github.com/mit-pdos/go-journal/jrnl"
 	"github.com/mit-pdos/go-journal/util"
@@ -46,6 +48,7 @@ func (nfs *Nfs) NFSPROC3_GETATTR(args nfstypes.GETATTR3args) nfstypes.GETATTR3re
 	defer nfs.recordOp(nfstypes.NFSPROC3_GETATTR, time.Now())
 	var reply nfstypes.GETATTR3res
 	util.DPrintf(1, "NFS GetAttr %v\n", args)
+	nfs.touch(args.Object)
 	op := fstxn.Begin(nfs.fsstate)
 	ip := op.GetInodeFh(args.Object)
 	if ip == nil {
@@ -92,59 +95,97 @@ func (nfs *Nfs) NFSPROC3_SETATTR(args nfstypes.SETATTR3args) nfstypes.SETATTR3re
 	var reply nfstypes.SETATTR3res
 
 	util.DPrintf(1, "NFS SetAttr %v\n", args)
+	nfs.touch(args.Object)
 	op, ip, err := nfs.getShrink(args.Object)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
 
 	}
-	if args.New_attributes.Mode.Set_it {
-		util.DPrintf(1, "NFS SetAttr ignore mode %v\n", args)
-		err = nfstypes.NFS3_OK
+	if args.Guard.Check && args.Guard.Obj_ctime != ip.Ctime {
+		util.DPrintf(1, "NFS SetAttr ctime mismatch %v\n", args)
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOT_SYNC)
+		return reply
+	}
+	err = nfs.setattr(op, ip, args.New_attributes)
+	if err != nfstypes.NFS3_OK {
+		errRet(op, &reply.Status, err)
+		return reply
+	}
+	reply.Resok.Obj_wcc.After.Attributes_follow = true
+	reply.Resok.Obj_wcc.After.Attributes = ip.MkFattr()
+	commitReply(op, &reply.Status)
+	return reply
+}
+
+// setattr checks that the caller may apply attr to ip, which must not be
+// shrinking, and applies it in op
+func (nfs *Nfs) setattr(op *fstxn.FsTxn, ip *inode.Inode, attr nfstypes.Sattr3) nfstypes.Nfsstat3 {
+	err := nfs.checkSetattr(ip, attr)
+	if err != nfstypes.NFS3_OK {
+		return err
+	}
+	if attr.Size.Set_it && uint64(attr.Size.Size) >
+		inode.MaxFileSize(nfs.fsstate.Super.Legacy()) {
+		return nfstypes.NFS3ERR_FBIG
 	}
-	if args.New_attributes.Uid.Set_it {
-		util.DPrintf(1, "NFS SetAttr uid not supported %v\n", args)
+	if attr.Size.Set_it && !ip.Grow(op.Atxn, uint64(attr.Size.Size)) {
+		return nfstypes.NFS3ERR_NOSPC
 	}
-	if args.New_attributes.Gid.Set_it {
-		util.DPrintf(1, "NFS SetAttr gid not supported %v\n", args)
+	if attr.Mode.Set_it || attr.Uid.Set_it || attr.Gid.Set_it {
+		if nfs.fsstate.Super.Legacy() {
+			util.DPrintf(1, "NFS SetAttr mode/uid/gid not supported %v\n", attr)
+			return nfstypes.NFS3ERR_NOTSUPP
+		}
+		setOwnerMode(ip, attr)
 	}
-	if args.New_attributes.Size.Set_it {
-		shrink := ip.Resize(op.Atxn, uint64(args.New_attributes.Size.Size))
+	if attr.Size.Set_it {
+		shrink, ok := ip.Resize(op.Atxn, uint64(attr.Size.Size))
+		if !ok {
+			return nfstypes.NFS3ERR_NOSPC
+		}
 		if shrink {
 			nfs.shrinkst.StartShrinker(ip.Inum)
 		}
-		err = nfstypes.NFS3_OK
 	}
-	if args.New_attributes.Atime.Set_it != nfstypes.DONT_CHANGE {
-		util.DPrintf(1, "NFS SetAttr Atime %v\n", args)
-		if args.New_attributes.Atime.Set_it == nfstypes.SET_TO_CLIENT_TIME {
-			ip.Atime = args.New_attributes.Atime.Atime
+	if attr.Atime.Set_it != nfstypes.DONT_CHANGE {
+		util.DPrintf(1, "NFS SetAttr Atime %v\n", attr)
+		if attr.Atime.Set_it == nfstypes.SET_TO_CLIENT_TIME {
+			ip.Atime = attr.Atime.Atime
 		} else {
 			ip.Atime = inode.NfstimeNow()
 
 		}
-		ip.WriteInode(op.Atxn)
-		err = nfstypes.NFS3_OK
 	}
-	if args.New_attributes.Mtime.Set_it != nfstypes.DONT_CHANGE {
-		util.DPrintf(1, "NFS SetAttr Mtime %v\n", args)
-		if args.New_attributes.Mtime.Set_it == nfstypes.SET_TO_CLIENT_TIME {
-			ip.Mtime = args.New_attributes.Mtime.Mtime
+	if attr.Mtime.Set_it != nfstypes.DONT_CHANGE {
+		util.DPrintf(1, "NFS SetAttr Mtime %v\n", attr)
+		if attr.Mtime.Set_it == nfstypes.SET_TO_CLIENT_TIME {
+			ip.Mtime = attr.Mtime.Mtime
 		} else {
 			ip.Mtime = inode.NfstimeNow()
 
 		}
-		ip.WriteInode(op.Atxn)
-		err = nfstypes.NFS3_OK
 	}
-	if err == nfstypes.NFS3_OK {
-		reply.Resok.Obj_wcc.After.Attributes_follow = true
-		reply.Resok.Obj_wcc.After.Attributes = ip.MkFattr()
-		commitReply(op, &reply.Status)
-	} else {
-		errRet(op, &reply.Status, err)
+	// the client sets attributes after an EXCLUSIVE create, so that
+	// create is done
+	ip.ClearVerf()
+	ip.Changed()
+	ip.WriteInode(op.Atxn)
+	return nfstypes.NFS3_OK
+}
+
+// setOwnerMode applies the mode, uid, and gid in attr to ip, where set.
+// Caller must write ip.
+func setOwnerMode(ip *inode.Inode, attr nfstypes.Sattr3) {
+	if attr.Mode.Set_it {
+		ip.Mode = uint32(attr.Mode.Mode) & inode.MODEMASK
+	}
+	if attr.Uid.Set_it {
+		ip.Uid = uint32(attr.Uid.Uid)
+	}
+	if attr.Gid.Set_it {
+		ip.Gid = uint32(attr.Gid.Gid)
 	}
-	return reply
 }
 
 func twoInodes(ino1, ino2 *inode.Inode) []*inode.Inode {
@@ -172,6 +213,10 @@ func (nfs *Nfs) getInodesLocked(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3) (
 			err = nfstypes.NFS3ERR_STALE
 			break
 		}
+		if !nfs.allowed(dip, permExec) {
+			err = nfstypes.NFS3ERR_ACCES
+			break
+		}
 		inodes = []*inode.Inode{dip}
 		inum, _ := dir.LookupName(dip, op, name)
 		if inum == common.NULLINUM {
@@ -219,6 +264,7 @@ func (nfs *Nfs) NFSPROC3_LOOKUP(args nfstypes.LOOKUP3args) nfstypes.LOOKUP3res {
 	reply.Resok.Obj_attributes.Attributes_follow = true
 	reply.Resok.Obj_attributes.Attributes = i.MkFattr()
 	commitReply(op, &reply.Status)
+	nfs.touch(reply.Resok.Object)
 	return reply
 }
 
@@ -226,8 +272,17 @@ func (nfs *Nfs) NFSPROC3_ACCESS(args nfstypes.ACCESS3args) nfstypes.ACCESS3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_ACCESS, time.Now())
 	var reply nfstypes.ACCESS3res
 	util.DPrintf(1, "NFS Access %v\n", args)
-	reply.Status = nfstypes.NFS3_OK
-	reply.Resok.Access = nfstypes.Uint32(nfstypes.ACCESS3_READ | nfstypes.ACCESS3_LOOKUP | nfstypes.ACCESS3_MODIFY | nfstypes.ACCESS3_EXTEND | nfstypes.ACCESS3_DELETE | nfstypes.ACCESS3_EXECUTE)
+	nfs.touch(args.Object)
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(args.Object)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	reply.Resok.Obj_attributes.Attributes_follow = true
+	reply.Resok.Obj_attributes.Attributes = ip.MkFattr()
+	reply.Resok.Access = args.Access & nfstypes.Uint32(nfs.access(ip))
+	commitReply(op, &reply.Status)
 	return reply
 }
 
@@ -241,6 +296,10 @@ func (nfs *Nfs) doRead(fh nfstypes.Nfs_fh3, kind nfstypes.Ftype3, offset, count
 	if ip.Kind != kind {
 		return op, nil, false, nfstypes.NFS3ERR_INVAL
 	}
+	// clients execute a file by reading it
+	if kind == nfstypes.NF3REG && nfs.perm(ip)&(permRead|permExec) == 0 {
+		return op, nil, false, nfstypes.NFS3ERR_ACCES
+	}
 	if ip.Kind == nfstypes.NF3LNK {
 		readCount = ip.Size
 	}
@@ -252,6 +311,7 @@ func (nfs *Nfs) NFSPROC3_READ(args nfstypes.READ3args) nfstypes.READ3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_READ, time.Now())
 	var reply nfstypes.READ3res
 	util.DPrintf(1, "NFS Read %v %d %d\n", args.File, args.Offset, args.Count)
+	nfs.touch(args.File)
 	op, data, eof, err := nfs.doRead(args.File, nfstypes.NF3REG,
 		uint64(args.Offset), uint64(args.Count))
 	if err != nfstypes.NFS3_OK {
@@ -265,6 +325,11 @@ func (nfs *Nfs) NFSPROC3_READ(args nfstypes.READ3args) nfstypes.READ3res {
 	return reply
 }
 
+// MAXWRITERETRY bounds how many times WRITE waits for shrinker threads
+// to free blocks and retries, so that a full disk that other clients keep
+// shrinking and refilling can't hold a WRITE forever
+const MAXWRITERETRY = 3
+
 // XXX Mtime
 func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_WRITE, time.Now())
@@ -273,26 +338,49 @@ func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
 
 	util.DPrintf(1, "NFS Write %v off %d cnt %d how %d\n", args.File, args.Offset,
 		args.Count, args.Stable)
+	nfs.touch(args.File)
 
-	op, ip, err := nfs.getShrink(args.File)
-	if err != nfstypes.NFS3_OK {
-		errRet(op, &reply.Status, err)
-		return reply
+	var op *fstxn.FsTxn
+	var ip *inode.Inode
+	var count uint64
+	for retry := 0; ; retry++ {
+		var err nfstypes.Nfsstat3
+		op, ip, err = nfs.getShrink(args.File)
+		if err != nfstypes.NFS3_OK {
+			errRet(op, &reply.Status, err)
+			return reply
 
-	}
-	if ip.Kind != nfstypes.NF3REG {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
-		return reply
-	}
-	if uint64(args.Count) >= jrnl.LogBytes {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
-		return reply
-	}
-	count, writeOk := ip.Write(op.Atxn, uint64(args.Offset), uint64(args.Count),
-		args.Data)
-	if !writeOk {
+		}
+		if ip.Kind != nfstypes.NF3REG {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
+			return reply
+		}
+		if !nfs.allowed(ip, permWrite) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+			return reply
+		}
+		if uint64(args.Count) >= jrnl.LogBytes {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
+			return reply
+		}
+		if uint64(args.Offset)+uint64(args.Count) >
+			inode.MaxFileSize(nfs.fsstate.Super.Legacy()) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_FBIG)
+			return reply
+		}
+		var writeOk bool
+		count, writeOk = ip.Write(op.Atxn, uint64(args.Offset), uint64(args.Count),
+			args.Data)
+		if writeOk {
+			break
+		}
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
-		return reply
+		// shrinker threads may be about to free blocks; if so, wait
+		// for them and retry.
+		if retry == MAXWRITERETRY || !nfs.shrinkst.Wait() {
+			return reply
+		}
+		util.DPrintf(1, "Write: retry after shrinking\n")
 	}
 	// if not supporting unstable writes, upgrade stability
 	if !nfs.Unstable {
@@ -322,12 +410,13 @@ func (nfs *Nfs) NFSPROC3_WRITE(args nfstypes.WRITE3args) nfstypes.WRITE3res {
 		// the value of verf and that it will not
 		// commit the data and metadata at a level
 		// less than that requested by the client."
-		ok = op.CommitUnstable()
+		ok = op.CommitUnstable(ip.Inum, uint64(args.Offset), count)
 	}
 	if ok {
 		reply.Status = nfstypes.NFS3_OK
 		reply.Resok.Count = nfstypes.Count3(count)
 		reply.Resok.Committed = args.Stable
+		reply.Resok.Verf = nfs.verf
 		reply.Resok.File_wcc.After.Attributes_follow = true
 		reply.Resok.File_wcc.After.Attributes = ip.MkFattr()
 	} else {
@@ -349,6 +438,18 @@ func (nfs *Nfs) getAlloc(op *fstxn.FsTxn, dfh nfstypes.Nfs_fh3, name nfstypes.Fi
 			err = nfstypes.NFS3ERR_STALE
 			break
 		}
+		if !nfs.allowed(dip, permWrite|permExec) {
+			err = nfstypes.NFS3ERR_ACCES
+			break
+		}
+		if dir.IllegalName(name) {
+			err = nfstypes.NFS3ERR_INVAL
+			break
+		}
+		if dir.NameTooLong(dip, op, name) {
+			err = nfstypes.NFS3ERR_NAMETOOLONG
+			break
+		}
 		inum, _ := dir.LookupName(dip, op, name)
 		if inum != common.NULLINUM {
 			err = nfstypes.NFS3ERR_EXIST
@@ -379,7 +480,11 @@ func (nfs *Nfs) getAlloc(op *fstxn.FsTxn, dfh nfstypes.Nfs_fh3, name nfstypes.Fi
 
 func (nfs *Nfs) doDecLink(op *fstxn.FsTxn, ip *inode.Inode) {
 	if ip.DecLink(op.Atxn) {
-		shrink := ip.Resize(op.Atxn, 0)
+		if nfs.keepOrphan(op, ip) {
+			return
+		}
+		// truncating needs no block, so it can't fail
+		shrink, _ := ip.Resize(op.Atxn, 0)
 		ip.FreeInode(op.Atxn)
 		if shrink {
 			nfs.shrinkst.StartShrinker(ip.Inum)
@@ -388,7 +493,7 @@ func (nfs *Nfs) doDecLink(op *fstxn.FsTxn, ip *inode.Inode) {
 }
 
 func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfstypes.Ftype3,
-	data []byte) (op *fstxn.FsTxn, err nfstypes.Nfsstat3, fh3 nfstypes.Nfs_fh3, fattr nfstypes.Fattr3) {
+	attr nfstypes.Sattr3, data []byte) (op *fstxn.FsTxn, err nfstypes.Nfsstat3, fh3 nfstypes.Nfs_fh3, fattr nfstypes.Fattr3) {
 	beginOp := fstxn.Begin(nfs.fsstate)
 	var dip, ip *inode.Inode
 	op, dip, ip, err = nfs.getAlloc(beginOp, dfh, name, kind)
@@ -399,15 +504,33 @@ func (nfs *Nfs) doCreate(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, kind nfs
 		err = nfstypes.NFS3ERR_NOSPC
 		return
 	}
+	// VERSION0 inodes can't store mode, uid, and gid
+	if !nfs.fsstate.Super.Legacy() {
+		if nfs.cred != nil {
+			ip.Uid = nfs.cred.Uid
+			ip.Gid = nfs.cred.Gid
+		}
+		err = nfs.checkSetattr(ip, attr)
+		if err != nfstypes.NFS3_OK {
+			nfs.doDecLink(op, ip)
+			return
+		}
+		setOwnerMode(ip, attr)
+		ip.WriteInode(op.Atxn)
+	}
 	if kind == nfstypes.NF3DIR {
+		if dip.Nlink >= inode.MAXLINK {
+			nfs.doDecLink(op, ip)
+			err = nfstypes.NFS3ERR_MLINK
+			return
+		}
 		ok := dir.InitDir(ip, op, dip.Inum)
 		if !ok {
 			nfs.doDecLink(op, ip)
 			err = nfstypes.NFS3ERR_NOSPC
 			return
 		}
-		dip.Nlink = dip.Nlink + 1 // for ..
-		dip.WriteInode(op.Atxn)
+		dip.IncLink(op.Atxn) // for ..
 	}
 	if kind == nfstypes.NF3LNK {
 		_, ok := ip.Write(op.Atxn, uint64(0), uint64(len(data)), data)
@@ -433,12 +556,38 @@ func (nfs *Nfs) NFSPROC3_CREATE(args nfstypes.CREATE3args) nfstypes.CREATE3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_CREATE, time.Now())
 	var reply nfstypes.CREATE3res
 	util.DPrintf(1, "NFS Create %v\n", args)
-	// XXX deal with how
-	if args.How.Mode == nfstypes.EXCLUSIVE {
+	exclusive := args.How.Mode == nfstypes.EXCLUSIVE
+	if exclusive && nfs.fsstate.Super.Legacy() {
+		// VERSION0 inodes can't store the verifier
 		reply.Status = nfstypes.NFS3ERR_NOTSUPP
 		return reply
 	}
-	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3REG, nil)
+	var op *fstxn.FsTxn
+	var err nfstypes.Nfsstat3
+	var fh3 nfstypes.Nfs_fh3
+	var fattr nfstypes.Fattr3
+	for {
+		op, err, fh3, fattr = nfs.doCreate(args.Where.Dir, args.Where.Name,
+			nfstypes.NF3REG, args.How.Obj_attributes, nil)
+		if err != nfstypes.NFS3ERR_EXIST || args.How.Mode == nfstypes.GUARDED {
+			break
+		}
+		op.Abort()
+		if exclusive {
+			op, err, fh3, fattr = nfs.lookupExclusive(args.Where, args.How.Verf)
+		} else {
+			op, err, fh3, fattr = nfs.createExisting(args.Where, args.How.Obj_attributes)
+		}
+		if err != nfstypes.NFS3ERR_NOENT {
+			break
+		}
+		op.Abort() // removed since; try again
+	}
+	if exclusive && err == nfstypes.NFS3_OK {
+		ip := op.GetInodeUnlocked(fh.MakeFh(fh3).Ino)
+		ip.SetVerf(args.How.Verf)
+		ip.WriteInode(op.Atxn)
+	}
 	if err != nfstypes.NFS3_OK {
 		util.DPrintf(1, "Create %v\n", err)
 		errRet(op, &reply.Status, err)
@@ -454,12 +603,71 @@ func (nfs *Nfs) NFSPROC3_CREATE(args nfstypes.CREATE3args) nfstypes.CREATE3res {
 	return reply
 }
 
+// lookupExclusive handles an EXCLUSIVE create of a name that exists.  If
+// the name refers to a file created with verf, the create is a
+// retransmission and succeeds again.
+func (nfs *Nfs) lookupExclusive(where nfstypes.Diropargs3, verf nfstypes.Createverf3) (*fstxn.FsTxn, nfstypes.Nfsstat3, nfstypes.Nfs_fh3, nfstypes.Fattr3) {
+	var fh3 nfstypes.Nfs_fh3
+	var fattr nfstypes.Fattr3
+	op, inodes, err := nfs.getInodesLocked(where.Dir, where.Name)
+	if err != nfstypes.NFS3_OK {
+		return op, err, fh3, fattr
+	}
+	ip := inodes[0]
+	if ip.Kind != nfstypes.NF3REG || !ip.CreatedWith(verf) {
+		return op, nfstypes.NFS3ERR_EXIST, fh3, fattr
+	}
+	util.DPrintf(1, "lookupExclusive: retransmitted create of # %v\n", ip.Inum)
+	fh3 = fh.Fh{Ino: ip.Inum, Gen: ip.Gen}.MakeFh3()
+	fattr = ip.MkFattr()
+	return op, nfstypes.NFS3_OK, fh3, fattr
+}
+
+// createExisting handles an UNCHECKED create of a name that exists.  As
+// RFC 1813 says, the create succeeds if the name is a regular file, and
+// applies attr to it, truncating it if attr sets a size.  As in knfsd, a
+// caller that doesn't own the file may only truncate it.
+func (nfs *Nfs) createExisting(where nfstypes.Diropargs3, attr nfstypes.Sattr3) (*fstxn.FsTxn, nfstypes.Nfsstat3, nfstypes.Nfs_fh3, nfstypes.Fattr3) {
+	var fh3 nfstypes.Nfs_fh3
+	var fattr nfstypes.Fattr3
+	for {
+		op, inodes, err := nfs.getInodesLocked(where.Dir, where.Name)
+		if err != nfstypes.NFS3_OK {
+			return op, err, fh3, fattr
+		}
+		ip := inodes[0]
+		if ip.Kind != nfstypes.NF3REG {
+			return op, nfstypes.NFS3ERR_EXIST, fh3, fattr
+		}
+		if ip.IsShrinking() {
+			inum := ip.Inum
+			op.Abort()
+			if !nfs.shrinkst.DoShrink(inum) {
+				return fstxn.Begin(nfs.fsstate), nfstypes.NFS3ERR_SERVERFAULT, fh3, fattr
+			}
+			continue
+		}
+		if !nfs.isOwner(ip) {
+			attr = nfstypes.Sattr3{Size: attr.Size}
+		}
+		err = nfs.setattr(op, ip, attr)
+		if err != nfstypes.NFS3_OK {
+			return op, err, fh3, fattr
+		}
+		util.DPrintf(1, "createExisting: # %v\n", ip.Inum)
+		fh3 = fh.Fh{Ino: ip.Inum, Gen: ip.Gen}.MakeFh3()
+		fattr = ip.MkFattr()
+		return op, nfstypes.NFS3_OK, fh3, fattr
+	}
+}
+
 func (nfs *Nfs) NFSPROC3_MKDIR(args nfstypes.MKDIR3args) nfstypes.MKDIR3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_MKDIR, time.Now())
 	var reply nfstypes.MKDIR3res
 
 	util.DPrintf(1, "NFS Mkdir %v\n", args)
-	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3DIR, nil)
+	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3DIR,
+		args.Attributes, nil)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
@@ -479,7 +687,8 @@ func (nfs *Nfs) NFSPROC3_SYMLINK(args nfstypes.SYMLINK3args) nfstypes.SYMLINK3re
 	util.DPrintf(1, "NFS SymLink %v\n", args)
 
 	data := []byte(args.Symlink.Symlink_data)
-	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3LNK, data)
+	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name, nfstypes.NF3LNK,
+		args.Symlink.Symlink_attributes, data)
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
 		return reply
@@ -498,6 +707,7 @@ func (nfs *Nfs) NFSPROC3_SYMLINK(args nfstypes.SYMLINK3args) nfstypes.SYMLINK3re
 func (nfs *Nfs) NFSPROC3_READLINK(args nfstypes.READLINK3args) nfstypes.READLINK3res {
 	var reply nfstypes.READLINK3res
 	util.DPrintf(1, "NFS ReadLink %v\n", args)
+	nfs.touch(args.Symlink)
 	op, data, _, err := nfs.doRead(args.Symlink, nfstypes.NF3LNK, uint64(0), uint64(0))
 	if err != nfstypes.NFS3_OK {
 		errRet(op, &reply.Status, err)
@@ -509,11 +719,45 @@ func (nfs *Nfs) NFSPROC3_READLINK(args nfstypes.READLINK3args) nfstypes.READLINK
 }
 
 func (nfs *Nfs) NFSPROC3_MKNOD(args nfstypes.MKNOD3args) nfstypes.MKNOD3res {
+	defer nfs.recordOp(nfstypes.NFSPROC3_MKNOD, time.Now())
 	var reply nfstypes.MKNOD3res
 	util.DPrintf(1, "NFS MakeNod %v\n", args)
-	err := nfstypes.NFS3ERR_NOTSUPP
-	util.DPrintf(2, "errRet %v", err)
-	reply.Status = err
+	var attr nfstypes.Sattr3
+	var rdev nfstypes.Specdata3
+	switch args.What.Ftype {
+	case nfstypes.NF3FIFO, nfstypes.NF3SOCK:
+		attr = args.What.Pipe_attributes
+	case nfstypes.NF3CHR, nfstypes.NF3BLK:
+		if nfs.fsstate.Super.Legacy() {
+			// VERSION0 inodes can't store rdev
+			reply.Status = nfstypes.NFS3ERR_NOTSUPP
+			return reply
+		}
+		attr = args.What.Device.Dev_attributes
+		rdev = args.What.Device.Spec
+	default:
+		reply.Status = nfstypes.NFS3ERR_BADTYPE
+		return reply
+	}
+	op, err, fh3, fattr := nfs.doCreate(args.Where.Dir, args.Where.Name,
+		args.What.Ftype, attr, nil)
+	if err != nfstypes.NFS3_OK {
+		errRet(op, &reply.Status, err)
+		return reply
+	}
+	if rdev != (nfstypes.Specdata3{}) {
+		ip := op.GetInodeUnlocked(fh.MakeFh(fh3).Ino)
+		ip.Rdev = rdev
+		ip.WriteInode(op.Atxn)
+		fattr = ip.MkFattr()
+	}
+	reply.Resok.Obj = nfstypes.Post_op_fh3{
+		Handle_follows: true,
+		Handle:         fh3,
+	}
+	reply.Resok.Obj_attributes.Attributes_follow = true
+	reply.Resok.Obj_attributes.Attributes = fattr
+	commitReply(op, &reply.Status)
 	return reply
 }
 
@@ -526,6 +770,9 @@ func (nfs *Nfs) doRemove(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, isdir bo
 	if err != nfstypes.NFS3_OK {
 		return op, err
 	}
+	if !nfs.mayDelete(inodes[1], inodes[0]) {
+		return op, nfstypes.NFS3ERR_ACCES
+	}
 	if isdir && inodes[0].Kind != nfstypes.NF3DIR {
 		util.DPrintf(0, "Remove not a directory %v\n", inodes[0].Kind)
 		return op, nfstypes.NFS3ERR_INVAL
@@ -538,6 +785,10 @@ func (nfs *Nfs) doRemove(dfh nfstypes.Nfs_fh3, name nfstypes.Filename3, isdir bo
 		util.DPrintf(0, "Remove failed\n")
 		return op, nfstypes.NFS3ERR_IO
 	}
+	nfs.compactLater(op, inodes[1], name)
+	if isdir {
+		inodes[1].DecLink(op.Atxn) // for ..
+	}
 	nfs.doDecLink(op, inodes[0])
 	return op, nfstypes.NFS3_OK
 }
@@ -568,31 +819,20 @@ func (nfs *Nfs) NFSPROC3_RMDIR(args nfstypes.RMDIR3args) nfstypes.RMDIR3res {
 	return reply
 }
 
-func validateRename(op *fstxn.FsTxn, inodes []*inode.Inode, fromfh fh.Fh, tofh fh.Fh,
-	fromn nfstypes.Filename3, ton nfstypes.Filename3) bool {
-	var dipto *inode.Inode
-	var dipfrom *inode.Inode
-	var from *inode.Inode
-	var to *inode.Inode
-	if len(inodes) == 3 {
-		dipfrom = inodes[0]
-		dipto = inodes[0]
-		from = inodes[1]
-		to = inodes[2]
-	} else {
-		dipfrom = inodes[0]
-		dipto = inodes[1]
-		from = inodes[2]
-		to = inodes[3]
-	}
+func validateRename(op *fstxn.FsTxn, dipfrom, dipto, from, to *inode.Inode,
+	fromfh fh.Fh, tofh fh.Fh, fromn nfstypes.Filename3, ton nfstypes.Filename3) bool {
 	if dipfrom.Inum != fromfh.Ino || dipfrom.Gen != fromfh.Gen ||
 		dipto.Inum != tofh.Ino || dipto.Gen != tofh.Gen {
 		util.DPrintf(10, "revalidate ino failed\n")
 		return false
 	}
-	frominum, _ := dir.LookupName(dipfrom, op, fromn)
-	toinum, _ := dir.LookupName(dipto, op, ton)
-	if from.Inum != frominum || toinum != to.Inum {
+	var toinum = common.NULLINUM
+	if to != nil {
+		toinum = to.Inum
+	}
+	frominumLookup, _ := dir.LookupName(dipfrom, op, fromn)
+	toinumLookup, _ := dir.LookupName(dipto, op, ton)
+	if from.Inum != frominumLookup || toinum != toinumLookup {
 		util.DPrintf(10, "revalidate inums failed\n")
 		return false
 	}
@@ -604,6 +844,7 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 	var reply nfstypes.RENAME3res
 	var dipto *inode.Inode
 	var dipfrom *inode.Inode
+	var from *inode.Inode
 	var op *fstxn.FsTxn
 	var inodes []*inode.Inode
 	var frominum common.Inum
@@ -613,12 +854,13 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 
 	for !success {
 		op = fstxn.Begin(nfs.fsstate)
+		from = nil
 		util.DPrintf(1, "NFS Rename %v\n", args)
 
 		toh := fh.MakeFh(args.To.Dir)
 		fromh := fh.MakeFh(args.From.Dir)
 
-		if dir.IllegalName(args.From.Name) {
+		if dir.IllegalName(args.From.Name) || dir.IllegalName(args.To.Name) {
 			errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 			done = true
 			break
@@ -655,51 +897,65 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 		}
 		util.DPrintf(3, "frominum %d toinum %d\n", frominum, toinum)
 
+		if dir.NameTooLong(dipto, op, args.To.Name) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_NAMETOOLONG)
+			done = true
+			break
+		}
+
 		toInumLookup, _ := dir.LookupName(dipto, op, args.To.Name)
 		toinum = toInumLookup
 
 		util.DPrintf(3, "frominum %d toinum %d\n", frominum, toinum)
 
-		// rename to itself?
-		if dipto == dipfrom && toinum == frominum {
+		// rename to itself, or to another link to the same file?
+		if toinum == frominum {
 			reply.Status = nfstypes.NFS3_OK
 			op.Commit()
 			done = true
 			break
 		}
 
-		// does to exist?
-		if toinum != common.NULLINUM {
-			// must lock 3 or 4 inodes in order
+		// Lock from, whose ctime changes, and to, if it exists,
+		// together with the directories, in inum order.
+		{
 			var to *inode.Inode
-			var from *inode.Inode
 			op.Abort()
 			op = fstxn.Begin(nfs.fsstate)
-			if dipto != dipfrom {
-				inums := make([]common.Inum, 4)
-				inums[0] = dipfrom.Inum
-				inums[1] = dipto.Inum
-				inums[2] = frominum
-				inums[3] = toinum
-				inodes = lockInodes(op, inums)
-				dipfrom = inodes[0]
-				dipto = inodes[1]
-				from = inodes[2]
+			inums := make([]common.Inum, 3)
+			inums[0] = dipfrom.Inum
+			inums[1] = dipto.Inum
+			inums[2] = frominum
+			if toinum != common.NULLINUM {
+				inums = append(inums, toinum)
+			}
+			inodes = lockInodes(op, inums)
+			if inodes == nil { // an inode was freed; retry
+				continue
+			}
+			dipfrom = inodes[0]
+			dipto = inodes[1]
+			from = inodes[2]
+			if toinum != common.NULLINUM {
 				to = inodes[3]
-			} else {
-				inums := make([]common.Inum, 3)
-				inums[0] = dipfrom.Inum
-				inums[1] = frominum
-				inums[2] = toinum
-				inodes = lockInodes(op, inums)
-				dipfrom = inodes[0]
-				dipto = inodes[0]
-				from = inodes[1]
-				to = inodes[2]
 			}
 			util.DPrintf(1, "inodes %v\n", inodes)
-			if validateRename(op, inodes, fromh, toh,
+			if !validateRename(op, dipfrom, dipto, from, to, fromh, toh,
 				args.From.Name, args.To.Name) {
+				op.Abort() // retry
+				continue
+			}
+			if from.Kind == nfstypes.NF3DIR && from.Inum == dipto.Inum {
+				errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
+				done = true
+				break
+			}
+			if !nfs.mayRename(dipfrom, dipto, from, to) {
+				errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+				done = true
+				break
+			}
+			if to != nil {
 				if to.Kind != from.Kind {
 					errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 					done = true
@@ -716,14 +972,13 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 					done = true
 					break
 				}
+				if to.Kind == nfstypes.NF3DIR {
+					dipto.DecLink(op.Atxn) // for to's ..
+				}
 				nfs.doDecLink(op, to)
-				success = true
-			} else { // retry
-				op.Abort()
 			}
-		} else {
-			success = true
 		}
+		success = true
 	}
 	if done {
 		return reply
@@ -733,21 +988,91 @@ func (nfs *Nfs) NFSPROC3_RENAME(args nfstypes.RENAME3args) nfstypes.RENAME3res {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
 		return reply
 	}
+	nfs.compactLater(op, dipfrom, args.From.Name)
 	ok1 := dir.AddName(dipto, op, frominum, args.To.Name)
 	if !ok1 {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
 		return reply
 	}
+	from.Changed()
+	from.WriteInode(op.Atxn)
+	if from.Kind == nfstypes.NF3DIR && dipto != dipfrom {
+		if !dir.SetParent(from, op, dipto.Inum) {
+			errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
+			return reply
+		}
+		dipfrom.DecLink(op.Atxn)
+		dipto.IncLink(op.Atxn)
+	}
 	commitReply(op, &reply.Status)
 	return reply
 }
 
 func (nfs *Nfs) NFSPROC3_LINK(args nfstypes.LINK3args) nfstypes.LINK3res {
+	defer nfs.recordOp(nfstypes.NFSPROC3_LINK, time.Now())
 	var reply nfstypes.LINK3res
 	util.DPrintf(1, "NFS Link %v\n", args)
-	err := nfstypes.NFS3ERR_NOTSUPP
-	util.DPrintf(2, "errRet %v", err)
-	reply.Status = err
+	if dir.IllegalName(args.Link.Name) {
+		reply.Status = nfstypes.NFS3ERR_INVAL
+		return reply
+	}
+	if uint64(len(args.Link.Name)) > dir.MAXNAMELEN {
+		reply.Status = nfstypes.NFS3ERR_NAMETOOLONG
+		return reply
+	}
+	op := fstxn.Begin(nfs.fsstate)
+	fileh := fh.MakeFh(args.File)
+	dirh := fh.MakeFh(args.Link.Dir)
+	inodes := lockInodes(op, twoInums(fileh.Ino, dirh.Ino))
+	if inodes == nil {
+		reply.Status = nfstypes.NFS3ERR_STALE
+		return reply
+	}
+	ip := inodes[0]
+	dip := inodes[1]
+	if ip.Gen != fileh.Gen || dip.Gen != dirh.Gen {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	if dip.Kind != nfstypes.NF3DIR {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOTDIR)
+		return reply
+	}
+	if !nfs.allowed(dip, permWrite|permExec) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+		return reply
+	}
+	if dir.NameTooLong(dip, op, args.Link.Name) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_NAMETOOLONG)
+		return reply
+	}
+	if ip.Kind == nfstypes.NF3DIR {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
+		return reply
+	}
+	// an orphan can't get a name back
+	if ip.Nlink == 0 {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	if ip.Nlink >= inode.MAXLINK {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_MLINK)
+		return reply
+	}
+	inum, _ := dir.LookupName(dip, op, args.Link.Name)
+	if inum != common.NULLINUM {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_EXIST)
+		return reply
+	}
+	ok := dir.AddName(dip, op, ip.Inum, args.Link.Name)
+	if !ok {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_NOSPC)
+		return reply
+	}
+	ip.IncLink(op.Atxn)
+	reply.Resok.File_attributes.Attributes_follow = true
+	reply.Resok.File_attributes.Attributes = ip.MkFattr()
+	commitReply(op, &reply.Status)
 	return reply
 }
 
@@ -764,8 +1089,18 @@ func (nfs *Nfs) NFSPROC3_READDIR(args nfstypes.READDIR3args) nfstypes.READDIR3re
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
 	}
+	if !nfs.allowed(ip, permRead) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+		return reply
+	}
+	if badCookie(ip, op, args.Cookie, args.Cookieverf) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_BAD_COOKIE)
+		return reply
+	}
 	dirlist := Readdir3(ip, op, args.Cookie, args.Count)
+	reply.Resok.Cookieverf = cookieVerf(dir.Generation(ip, op))
 	reply.Resok.Reply = dirlist
+	nfs.readDir(ip.Inum)
 	commitReply(op, &reply.Status)
 	return reply
 }
@@ -784,16 +1119,47 @@ func (nfs *Nfs) NFSPROC3_READDIRPLUS(args nfstypes.READDIRPLUS3args) nfstypes.RE
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
 	}
+	if !nfs.allowed(ip, permRead) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_ACCES)
+		return reply
+	}
+	if badCookie(ip, op, args.Cookie, args.Cookieverf) {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_BAD_COOKIE)
+		return reply
+	}
 	dirlist := Ls3(ip, op, args.Cookie, args.Dircount, args.Maxcount)
+	reply.Resok.Cookieverf = cookieVerf(dir.Generation(ip, op))
 	reply.Resok.Reply = dirlist
+	nfs.readDir(ip.Inum)
 	commitReply(op, &reply.Status)
+	for e := dirlist.Entries; e != nil; e = e.Nextentry {
+		nfs.touch(e.Name_handle.Handle)
+	}
 	return reply
 }
 
 func (nfs *Nfs) NFSPROC3_FSSTAT(args nfstypes.FSSTAT3args) nfstypes.FSSTAT3res {
 	var reply nfstypes.FSSTAT3res
 	util.DPrintf(1, "NFS FsStat %v\n", args)
-	reply.Status = nfstypes.NFS3ERR_NOTSUPP
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(args.Fsroot)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	reply.Resok.Obj_attributes.Attributes_follow = true
+	reply.Resok.Obj_attributes.Attributes = ip.MkFattr()
+	super := nfs.fsstate.Super
+	nblk := uint64(super.MaxBnum() - super.DataStart())
+	nfree := nfs.fsstate.Balloc.NumFree()
+	reply.Resok.Tbytes = nfstypes.Size3(nblk * disk.BlockSize)
+	reply.Resok.Fbytes = nfstypes.Size3(nfree * disk.BlockSize)
+	reply.Resok.Abytes = reply.Resok.Fbytes
+	// inode 0 is never allocated
+	reply.Resok.Tfiles = nfstypes.Size3(uint64(super.NInode()) - 1)
+	reply.Resok.Ffiles = nfstypes.Size3(nfs.fsstate.Ialloc.NumFree())
+	reply.Resok.Afiles = reply.Resok.Ffiles
+	commitReply(op, &reply.Status)
 	return reply
 }
 
@@ -808,19 +1174,51 @@ func (nfs *Nfs) NFSPROC3_FSINFO(args nfstypes.FSINFO3args) nfstypes.FSINFO3res {
 	reply.Resok.Wtpref = 16 * 4096
 	reply.Resok.Wtmult = 4096
 	reply.Resok.Dtpref = 16 * 4096
-	reply.Resok.Maxfilesize = nfstypes.Size3(inode.MaxFileSize())
+	reply.Resok.Maxfilesize = nfstypes.Size3(inode.MaxFileSize(nfs.fsstate.Super.Legacy()))
 	reply.Resok.Properties = nfstypes.Uint32(nfstypes.FSF3_HOMOGENEOUS | nfstypes.FSF3_SYMLINK)
 	commitReply(op, &reply.Status)
 	return reply
 }
 
+// MAXDATAGRAMXFER bounds the transfer sizes that FSINFO offers clients
+// over UDP, since a call or reply must fit in one datagram
+const MAXDATAGRAMXFER = 32 * 1024
+
+// datagramFsinfo lowers the transfer sizes in reply to MAXDATAGRAMXFER
+func datagramFsinfo(reply *nfstypes.FSINFO3res) {
+	lower := func(x *nfstypes.Uint32) {
+		if *x > MAXDATAGRAMXFER {
+			*x = MAXDATAGRAMXFER
+		}
+	}
+	lower(&reply.Resok.Rtmax)
+	lower(&reply.Resok.Rtpref)
+	lower(&reply.Resok.Wtmax)
+	lower(&reply.Resok.Wtpref)
+	lower(&reply.Resok.Dtpref)
+}
+
 func (nfs *Nfs) NFSPROC3_PATHCONF(args nfstypes.PATHCONF3args) nfstypes.PATHCONF3res {
 	var reply nfstypes.PATHCONF3res
 	util.DPrintf(1, "NFS PathConf %v\n", args)
+	op := fstxn.Begin(nfs.fsstate)
+	ip := op.GetInodeFh(args.Object)
+	if ip == nil {
+		errRet(op, &reply.Status, nfstypes.NFS3ERR_STALE)
+		return reply
+	}
+	// the limit of the directory, or of new directories
+	if ip.Kind == nfstypes.NF3DIR {
+		reply.Resok.Name_max = nfstypes.Uint32(dir.NameMax(ip, op))
+	} else if nfs.fsstate.Super.Legacy() {
+		reply.Resok.Name_max = nfstypes.Uint32(dir.LINEARNAMELEN - 1)
+	} else {
+		reply.Resok.Name_max = nfstypes.Uint32(dir.MAXNAMELEN)
+	}
+	op.Abort()
 	reply.Status = nfstypes.NFS3_OK
-	reply.Resok.Name_max = nfstypes.Uint32(dir.MAXNAMELEN)
 	reply.Resok.No_trunc = true
-	reply.Resok.Linkmax = 1
+	reply.Resok.Linkmax = nfstypes.Uint32(inode.MAXLINK)
 	reply.Resok.Case_preserving = true
 	return reply
 }
@@ -832,6 +1230,7 @@ func (nfs *Nfs) NFSPROC3_COMMIT(args nfstypes.COMMIT3args) nfstypes.COMMIT3res {
 	defer nfs.recordOp(nfstypes.NFSPROC3_COMMIT, time.Now())
 	var reply nfstypes.COMMIT3res
 	util.DPrintf(1, "NFS Commit %v\n", args)
+	nfs.touch(args.File)
 	op := fstxn.Begin(nfs.fsstate)
 	ip := op.GetInodeFh(args.File)
 	if ip == nil {
@@ -842,13 +1241,10 @@ func (nfs *Nfs) NFSPROC3_COMMIT(args nfstypes.COMMIT3args) nfstypes.COMMIT3res {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
 		return reply
 	}
-	if uint64(args.Offset)+uint64(args.Count) > ip.Size {
-		errRet(op, &reply.Status, nfstypes.NFS3ERR_INVAL)
-		return reply
-	}
-	ok := op.CommitFh()
+	ok := op.CommitRange(ip.Inum, uint64(args.Offset), uint64(args.Count))
 	if ok {
 		reply.Status = nfstypes.NFS3_OK
+		reply.Resok.Verf = nfs.verf
 	} else {
 		errRet(op, &reply.Status, nfstypes.NFS3ERR_IO)
 	}
@@ -1,26 +1,41 @@
 package nfs
 
 import (
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/goose-lang/primitive/disk"
 	"github.com/stretchr/testify/require"
+	"github.com/tchajed/marshal"
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
 
 	"testing"
+	"time"
 
 	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/obj"
+	"github.com/mit-pdos/go-journal/wal"
 	"github.com/mit-pdos/go-nfsd/dir"
 	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/fsck"
+	"github.com/mit-pdos/go-nfsd/fstxn"
 	"github.com/mit-pdos/go-nfsd/inode"
 	"github.com/mit-pdos/go-nfsd/nfstypes"
+	"github.com/mit-pdos/go-nfsd/rpcsrv"
+	"github.com/mit-pdos/go-nfsd/shrinker"
+	"github.com/mit-pdos/go-nfsd/super"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -176,11 +191,22 @@ func (ts *TestState) RenameFhs(fhfrom nfstypes.Nfs_fh3, from string, fhto nfstyp
 	assert.Equal(ts.t, status, nfstypes.NFS3_OK)
 }
 
+func (ts *TestState) Link(fh3 nfstypes.Nfs_fh3, name string) {
+	reply := ts.clnt.LinkOp(fh3, fh.MkRootFh3(), name)
+	assert.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+}
+
 func (ts *TestState) RenameFail(from string, to string) {
 	status := ts.clnt.RenameOp(fh.MkRootFh3(), from, fh.MkRootFh3(), to)
 	assert.Equal(ts.t, nfstypes.NFS3ERR_NOTEMPTY, status)
 }
 
+func (ts *TestState) Fsstat() nfstypes.FSSTAT3resok {
+	reply := ts.clnt.FsstatOp(fh.MkRootFh3())
+	assert.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+	return reply.Resok
+}
+
 func mkdata(sz uint64) []byte {
 	data := make([]byte, sz)
 	for i := range data {
@@ -222,7 +248,7 @@ func MkNfs(sz uint64) (string, *Nfs) {
 	if err != nil {
 		panic(err)
 	}
-	return n, MakeNfs(d)
+	return n, mkfsNfs(d)
 }
 
 func newTestDiskOrMem(t *testing.T, mem bool) *TestState {
@@ -235,8 +261,65 @@ func newTestDiskOrMem(t *testing.T, mem bool) *TestState {
 		ts.clnt = &NfsClient{srv: clnt}
 	} else {
 		d := disk.NewMemDisk(DISKSZ)
-		ts.clnt = &NfsClient{srv: MakeNfs(d)}
+		ts.clnt = &NfsClient{srv: mkfsNfs(d)}
+	}
+	return ts
+}
+
+// mkfsNfs makes a file system on d and opens it as root
+func mkfsNfs(d disk.Disk) *Nfs {
+	err := Mkfs(d, super.DEFNINODE, "")
+	if err != nil {
+		panic(err)
+	}
+	return testNfs(d)
+}
+
+// testNfs opens the file system on d as root.  Removed files are freed
+// at once, so that tests can count the space they get back; tests of
+// orphans set a grace period.
+func testNfs(d disk.Disk) *Nfs {
+	nfs := MakeNfs(d).WithCred(RootCred())
+	nfs.SetOrphanGrace(0)
+	return nfs
+}
+
+// newVersion1Test starts a server on a VERSION1 file system, whose
+// superblock has just the magic number and version
+func newVersion1Test(t *testing.T) *TestState {
+	checkFlags()
+	fmt.Printf("%s\n", t.Name())
+	d := disk.NewMemDisk(DISKSZ)
+	err := Mkfs(d, super.DEFNINODE, "")
+	if err != nil {
+		panic(err)
 	}
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(super.MAGIC)
+	enc.PutInt(super.VERSION1)
+	d.Write(common.LOGSIZE, enc.Finish())
+	ts := &TestState{t: t}
+	ts.clnt = &NfsClient{srv: testNfs(d)}
+	assert.Equal(t, super.VERSION1, ts.clnt.srv.fsstate.Super.Version)
+	return ts
+}
+
+// newLegacyTest starts a server on a VERSION0 file system
+func newLegacyTest(t *testing.T) *TestState {
+	checkFlags()
+	fmt.Printf("%s\n", t.Name())
+	d := disk.NewMemDisk(DISKSZ)
+	sb := super.MkLegacyFsSuper(d)
+	log := obj.MkLog(d)
+	makeFs(sb)
+	st := fstxn.MkFsState(sb, log)
+	srv := &Nfs{serverSt: &serverSt{fsstate: st, shrinkst: shrinker.MkShrinkerSt(st),
+		orphans: mkOrphanSt(), compact: mkCompactSt()}, cred: RootCred()}
+	srv.makeRootDir()
+	srv.ShutdownNfs()
+	ts := &TestState{t: t}
+	ts.clnt = &NfsClient{srv: testNfs(d)}
+	assert.True(t, ts.clnt.srv.fsstate.Super.Legacy())
 	return ts
 }
 
@@ -282,7 +365,8 @@ func TestOneFile(t *testing.T) {
 	sz := uint64(8192)
 	ts.Create("x")
 	attr := ts.GetattrDir(fh.MkRootFh3())
-	assert.Equal(t, 3*dir.DIRENTSZ, uint64(attr.Size))
+	// the header, the table, and one bucket
+	assert.Equal(t, 3*disk.BlockSize, uint64(attr.Size))
 	fh := ts.Lookup("x", true)
 	ts.Getattr(fh, 0)
 	data := mkdata(sz)
@@ -364,7 +448,212 @@ func TestManyFiles(t *testing.T) {
 	}
 }
 
+// readDirAll reads directory fh in pages of cnt bytes, and returns the
+// names it holds, checking that each appears once
+func (ts *TestState) readDirAll(fh nfstypes.Nfs_fh3, cnt uint64) map[string]bool {
+	names := make(map[string]bool)
+	var cookie nfstypes.Cookie3
+	var verf nfstypes.Cookieverf3
+	for {
+		reply := ts.clnt.ReadDirOp(fh, cookie, verf, cnt)
+		require.Equal(ts.t, nfstypes.NFS3_OK, reply.Status)
+		verf = reply.Resok.Cookieverf
+		for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+			assert.False(ts.t, names[string(e.Name)], "%q twice", e.Name)
+			names[string(e.Name)] = true
+			cookie = e.Cookie
+		}
+		if reply.Resok.Reply.Eof {
+			return names
+		}
+	}
+}
+
+func TestLargeDir(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	const N = 20000
+	ts := newTest(t)
+	defer ts.Close()
+
+	for i := 0; i < N; i++ {
+		ts.Create("x" + strconv.Itoa(i))
+	}
+	for i := 0; i < N; i++ {
+		ts.Lookup("x"+strconv.Itoa(i), true)
+	}
+	for i := 0; i < N; i += 2 {
+		ts.Remove("x" + strconv.Itoa(i))
+	}
+	names := ts.readDirAll(fh.MkRootFh3(), 1024)
+	assert.Equal(t, N/2+2, len(names))
+	assert.True(t, names["."] && names[".."])
+	ts.clnt.Shutdown()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+
+	ts.clnt.srv = testNfs(d)
+	for i := 0; i < N; i++ {
+		ts.Lookup("x"+strconv.Itoa(i), i%2 == 1)
+	}
+	ts.MkDir("d")
+	ts.RmDir("d", nfstypes.NFS3_OK)
+}
+
+func TestLongNames(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	pc := ts.clnt.PathconfOp(root)
+	assert.Equal(t, nfstypes.NFS3_OK, pc.Status)
+	assert.Equal(t, nfstypes.Uint32(dir.MAXNAMELEN), pc.Resok.Name_max)
+
+	long := strings.Repeat("l", int(dir.MAXNAMELEN))
+	ts.Create(long)
+	x := ts.Lookup(long, true)
+	ts.Link(x, long[1:]+"k")
+	reply := ts.clnt.CreateOp(root, long+"l")
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, reply.Status)
+	lreply := ts.clnt.LinkOp(x, root, long+"l")
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, lreply.Status)
+	status := ts.clnt.RenameOp(root, long, root, long+"l")
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, status)
+	reply = ts.clnt.CreateOp(root, "")
+	assert.Equal(t, nfstypes.NFS3ERR_INVAL, reply.Status)
+	names := ts.readDirAll(root, 1024)
+	assert.True(t, names[long] && names[long[1:]+"k"])
+
+	// short names pack densely, and removed names leave no holes
+	attr := ts.GetattrDir(root)
+	const N = 150
+	for j := 0; j < 3; j++ {
+		for i := 0; i < N; i++ {
+			ts.Create("s" + strconv.Itoa(i))
+		}
+		for i := 0; i < N; i++ {
+			ts.Remove("s" + strconv.Itoa(i))
+		}
+	}
+	assert.Equal(t, attr.Size, ts.GetattrDir(root).Size)
+	for i := 0; i < N; i++ {
+		ts.Create("s" + strconv.Itoa(i))
+	}
+	assert.LessOrEqual(t, uint64(ts.GetattrDir(root).Size), uint64(8*disk.BlockSize))
+
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+	ts.clnt.srv = testNfs(d)
+	ts.Lookup(long, true)
+	ts.Lookup("s0", true)
+}
+
+func TestLegacyNames(t *testing.T) {
+	ts := newLegacyTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	pc := ts.clnt.PathconfOp(root)
+	assert.Equal(t, nfstypes.Uint32(dir.LINEARNAMELEN-1), pc.Resok.Name_max)
+	name := strings.Repeat("l", int(dir.LINEARNAMELEN-1))
+	ts.Create(name)
+	ts.Lookup(name, true)
+	reply := ts.clnt.CreateOp(root, name+"l")
+	assert.Equal(t, nfstypes.NFS3ERR_NAMETOOLONG, reply.Status)
+}
+
 // Create many files and then delete
+// Readdir during concurrent creates and removes returns each name that
+// exists throughout exactly once
+func TestConcurReadDir(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		var ts *TestState
+		if legacy {
+			ts = newLegacyTest(t)
+		} else {
+			ts = newTest(t)
+		}
+		const N = 100
+		for i := 0; i < N; i++ {
+			ts.Create("s" + strconv.Itoa(i))
+		}
+
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for g := 0; g < 2; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					name := "t" + strconv.Itoa(g) + "." + strconv.Itoa(i%50)
+					if i/50%2 == 0 {
+						ts.Create(name)
+					} else {
+						ts.Remove(name)
+					}
+				}
+			}(g)
+		}
+		for pass := 0; pass < 10; pass++ {
+			names := ts.readDirAll(fh.MkRootFh3(), 512)
+			for i := 0; i < N; i++ {
+				assert.True(t, names["s"+strconv.Itoa(i)], "pass %d: s%d missing", pass, i)
+			}
+		}
+		close(done)
+		wg.Wait()
+		ts.Close()
+	}
+}
+
+func TestReadDirBadCookie(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		var ts *TestState
+		if legacy {
+			ts = newLegacyTest(t)
+		} else {
+			ts = newTest(t)
+		}
+		for i := 0; i < 20; i++ {
+			ts.Create("x" + strconv.Itoa(i))
+		}
+		root := fh.MkRootFh3()
+		reply := ts.clnt.ReadDirOp(root, 0, nfstypes.Cookieverf3{}, 256)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		assert.False(t, reply.Resok.Reply.Eof)
+		verf := reply.Resok.Cookieverf
+		cookie := reply.Resok.Reply.Entries.Cookie
+
+		reply = ts.clnt.ReadDirOp(root, cookie, verf, 256)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+
+		bad := verf
+		bad[0] ^= 0xff
+		reply = ts.clnt.ReadDirOp(root, cookie, bad, 256)
+		assert.Equal(t, nfstypes.NFS3ERR_BAD_COOKIE, reply.Status)
+
+		// cookie 0 ignores the verifier
+		reply = ts.clnt.ReadDirOp(root, 0, bad, 256)
+		assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+
+		if legacy {
+			reply = ts.clnt.ReadDirOp(root, cookie+1, verf, 256)
+			assert.Equal(t, nfstypes.NFS3ERR_BAD_COOKIE, reply.Status)
+		}
+		ts.Close()
+	}
+}
+
 func TestManyFiles1(t *testing.T) {
 	const N = 50
 	ts := newTest(t)
@@ -413,6 +702,121 @@ func TestRename(t *testing.T) {
 	ts.RenameFhs(d1, "f1", d2, "f1")
 }
 
+func TestLink(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	data := mkdata(122)
+	ts.Write(x, data, nfstypes.FILE_SYNC)
+	ts.Link(x, "y")
+	y := ts.Lookup("y", true)
+	assert.Equal(t, x, y)
+	attr := ts.Getattr(x, 122)
+	assert.Equal(t, nfstypes.Uint32(2), attr.Nlink)
+	ts.readcheck(y, 0, data)
+
+	reply := ts.clnt.LinkOp(x, fh.MkRootFh3(), "y")
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+
+	ts.Remove("x")
+	_ = ts.Lookup("x", false)
+	attr = ts.Getattr(y, 122)
+	assert.Equal(t, nfstypes.Uint32(1), attr.Nlink)
+	ts.readcheck(y, 0, data)
+
+	ts.Remove("y")
+	ts.GetattrFail(y)
+}
+
+func TestLinkDir(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	reply := ts.clnt.LinkOp(d, fh.MkRootFh3(), "e")
+	assert.Equal(t, nfstypes.NFS3ERR_INVAL, reply.Status)
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	reply = ts.clnt.LinkOp(d, x, "e")
+	assert.Equal(t, nfstypes.NFS3ERR_NOTDIR, reply.Status)
+}
+
+func TestLinkRename(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.Link(x, "y")
+
+	// rename between two links to the same file is a no-op
+	ts.Rename("x", "y")
+	ts.Lookup("x", true)
+	ts.Lookup("y", true)
+	attr := ts.Getattr(x, 0)
+	assert.Equal(t, nfstypes.Uint32(2), attr.Nlink)
+
+	// rename over another file drops that file's link
+	ts.Create("z")
+	z := ts.Lookup("z", true)
+	ts.Rename("z", "y")
+	_ = ts.Lookup("z", false)
+	y := ts.Lookup("y", true)
+	assert.Equal(t, z, y)
+	attr = ts.Getattr(x, 0)
+	assert.Equal(t, nfstypes.Uint32(1), attr.Nlink)
+
+	// rename one link into another directory
+	ts.Link(x, "w")
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	ts.RenameFhs(fh.MkRootFh3(), "w", d, "w")
+	w := ts.LookupFh(d, "w")
+	assert.Equal(t, x, w)
+	attr = ts.Getattr(x, 0)
+	assert.Equal(t, nfstypes.Uint32(2), attr.Nlink)
+}
+
+func TestDirNlink(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	attr := ts.GetattrDir(root)
+	assert.Equal(t, nfstypes.Uint32(2), attr.Nlink)
+	ts.MkDir("d1")
+	ts.MkDir("d2")
+	d1 := ts.Lookup("d1", true)
+	attr = ts.GetattrDir(root)
+	assert.Equal(t, nfstypes.Uint32(4), attr.Nlink)
+
+	// moving d2 into d1 moves its ".." link too
+	ts.RenameFhs(root, "d2", d1, "d2")
+	attr = ts.GetattrDir(root)
+	assert.Equal(t, nfstypes.Uint32(3), attr.Nlink)
+	attr = ts.GetattrDir(d1)
+	assert.Equal(t, nfstypes.Uint32(3), attr.Nlink)
+	d2 := ts.LookupFh(d1, "d2")
+	dotdot := ts.LookupFh(d2, "..")
+	assert.Equal(t, d1, dotdot)
+
+	// a directory can't be moved into itself
+	status := ts.clnt.RenameOp(root, "d1", d1, "x")
+	assert.Equal(t, nfstypes.NFS3ERR_INVAL, status)
+
+	attr2 := ts.clnt.RmDirOp(d1, "d2")
+	assert.Equal(t, nfstypes.NFS3_OK, attr2.Status)
+	attr = ts.GetattrDir(d1)
+	assert.Equal(t, nfstypes.Uint32(2), attr.Nlink)
+	ts.RmDir("d1", nfstypes.NFS3_OK)
+	attr = ts.GetattrDir(root)
+	assert.Equal(t, nfstypes.Uint32(2), attr.Nlink)
+}
+
 func TestUnstable(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -435,6 +839,106 @@ func TestUnstable(t *testing.T) {
 	ts.readcheck(x, 0, data2)
 }
 
+// A restart changes the write verifier, so that a client resends the
+// UNSTABLE writes that it hasn't seen committed
+func TestWriteVerf(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	sz := uint64(4096)
+
+	w := ts.clnt.WriteOp(x, 0, mkdataval(1, sz), nfstypes.UNSTABLE)
+	assert.Equal(t, nfstypes.NFS3_OK, w.Status)
+	verf := w.Resok.Verf
+	assert.NotEqual(t, nfstypes.Writeverf3{}, verf)
+	w = ts.clnt.WriteOp(x, sz, mkdataval(2, sz), nfstypes.FILE_SYNC)
+	assert.Equal(t, verf, w.Resok.Verf)
+	c := ts.clnt.CommitOp(x, 2*sz)
+	assert.Equal(t, nfstypes.NFS3_OK, c.Status)
+	assert.Equal(t, verf, c.Resok.Verf)
+
+	w = ts.clnt.WriteOp(x, 2*sz, mkdataval(3, sz), nfstypes.UNSTABLE)
+	assert.Equal(t, verf, w.Resok.Verf)
+	ts.clnt.Crash()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = testNfs(d)
+
+	c = ts.clnt.CommitOp(x, 0)
+	assert.Equal(t, nfstypes.NFS3_OK, c.Status)
+	assert.NotEqual(t, verf, c.Resok.Verf)
+	// the client resends the write that it hasn't seen committed
+	w = ts.clnt.WriteOp(x, 2*sz, mkdataval(3, sz), nfstypes.UNSTABLE)
+	assert.Equal(t, c.Resok.Verf, w.Resok.Verf)
+	c = ts.clnt.CommitOp(x, 3*sz)
+	assert.Equal(t, w.Resok.Verf, c.Resok.Verf)
+	ts.readcheck(x, 0, mkdataval(1, sz))
+	ts.readcheck(x, sz, mkdataval(2, sz))
+	ts.readcheck(x, 2*sz, mkdataval(3, sz))
+}
+
+// COMMIT flushes the log only for unstable writes to the range it
+// names that aren't durable yet
+func TestCommitRange(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+	ts.Create("x")
+	ts.Create("y")
+	x := ts.Lookup("x", true)
+	y := ts.Lookup("y", true)
+	sz := uint64(4096)
+	fs := ts.clnt.srv.fsstate
+
+	ts.Write(x, mkdataval(1, 4*sz), nfstypes.FILE_SYNC)
+	ts.WriteOff(y, 0, mkdataval(2, 4*sz), nfstypes.UNSTABLE)
+	n := fs.NFlush()
+	ts.Commit(x, 4*sz)
+	assert.Equal(t, n, fs.NFlush())
+
+	ts.WriteOff(x, sz, mkdataval(3, sz), nfstypes.UNSTABLE)
+	c := ts.clnt.CommitOp(x, sz)
+	assert.Equal(t, nfstypes.NFS3_OK, c.Status)
+	assert.Equal(t, n, fs.NFlush())
+	ts.Commit(x, 0)
+	assert.Equal(t, n+1, fs.NFlush())
+	ts.Commit(x, 0)
+	assert.Equal(t, n+1, fs.NFlush())
+
+	// that flush made y durable too, and a synchronous write makes
+	// the unstable writes before it durable
+	ts.Commit(y, 0)
+	assert.Equal(t, n+1, fs.NFlush())
+	ts.WriteOff(y, sz, mkdataval(4, sz), nfstypes.UNSTABLE)
+	ts.WriteOff(x, 0, mkdataval(5, sz), nfstypes.FILE_SYNC)
+	ts.Commit(y, 0)
+	assert.Equal(t, n+1, fs.NFlush())
+
+	ts.WriteOff(y, 2*sz, mkdataval(6, sz), nfstypes.UNSTABLE)
+	ts.Commit(y, 0)
+	assert.Equal(t, n+2, fs.NFlush())
+
+	// ranges past EOF, or whose end overflows, aren't errors
+	commit := func(fh nfstypes.Nfs_fh3, off uint64, cnt uint32) {
+		c := ts.clnt.srv.NFSPROC3_COMMIT(nfstypes.COMMIT3args{
+			File: fh, Offset: nfstypes.Offset3(off), Count: nfstypes.Count3(cnt)})
+		assert.Equal(t, nfstypes.NFS3_OK, c.Status)
+	}
+	ts.WriteOff(y, 3*sz, mkdataval(7, sz), nfstypes.UNSTABLE)
+	commit(y, 8*sz, 1)
+	assert.Equal(t, n+2, fs.NFlush())
+	commit(y, ^uint64(0)-10, 100)
+	assert.Equal(t, n+2, fs.NFlush())
+	commit(y, 2*sz, uint32(16*sz))
+	assert.Equal(t, n+3, fs.NFlush())
+	ts.clnt.Crash()
+	ts.clnt.srv = testNfs(fs.Super.Disk)
+	ts.readcheck(x, 0, mkdataval(5, sz))
+	ts.readcheck(x, sz, mkdataval(3, sz))
+	ts.readcheck(y, sz, mkdataval(4, sz))
+	ts.readcheck(y, 2*sz, mkdataval(6, sz))
+	ts.readcheck(y, 3*sz, mkdataval(7, sz))
+}
+
 func TestConcurWriteFiles(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -587,7 +1091,7 @@ func TestManyHoles(t *testing.T) {
 		fh := ts.Lookup("x", true)
 		for j := 0; j < n; j++ {
 			off := rand.Uint64()
-			off = off % (inode.MaxFileSize() - sz)
+			off = off % (inode.MaxFileSize(false) - sz)
 			ts.WriteOff(fh, off, data, nfstypes.FILE_SYNC)
 		}
 		ts.Remove("x")
@@ -710,7 +1214,7 @@ func TestBigWrite(t *testing.T) {
 	y := ts.Lookup("y", true)
 	data = mkdataval(byte(0), sz)
 	ts.WriteErr(y, data, nfstypes.UNSTABLE, nfstypes.NFS3ERR_INVAL)
-	ts.CommitErr(y, sz, nfstypes.NFS3ERR_INVAL)
+	ts.Commit(y, sz)
 }
 
 func TestBigUnlink(t *testing.T) {
@@ -792,6 +1296,60 @@ func TestInodeExhaust(t *testing.T) {
 	}
 }
 
+func TestInodeCount(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+
+	// more inodes than fit
+	err := Mkfs(d, d.Size()*disk.BlockSize/super.INODESZ, "")
+	assert.Error(t, err)
+
+	// a partial inode block, and a bitmap covering more inodes
+	// than there are
+	err = Mkfs(d, 100, "0123456789abcdef0123456789abcdefX")
+	assert.Error(t, err)
+	err = Mkfs(d, 100, "small")
+	assert.NoError(t, err)
+	ts.clnt.srv = testNfs(d)
+	ts.Lookup("x", false)
+	assert.Equal(t, "small", ts.clnt.srv.fsstate.Super.LabelString())
+	ninode := uint64(ts.clnt.srv.fsstate.Super.NInode())
+	assert.Equal(t, uint64(112), ninode)
+	assert.Equal(t, uint64(ninode-1), uint64(ts.Fsstat().Tfiles))
+
+	i := 0
+	for ; ; i++ {
+		reply := ts.clnt.CreateOp(fh.MkRootFh3(), "x"+strconv.Itoa(i))
+		if reply.Status != nfstypes.NFS3_OK {
+			assert.Equal(t, nfstypes.NFS3ERR_NOSPC, reply.Status)
+			break
+		}
+	}
+	assert.Equal(t, int(ninode-2), i)
+	assert.Equal(t, uint64(0), uint64(ts.Fsstat().Ffiles))
+
+	// many inodes, so that the data starts beyond the first block
+	// of the block bitmap
+	ts.clnt.Shutdown()
+	d1 := disk.NewMemDisk(2 * common.NBITBLOCK)
+	err = Mkfs(d1, super.NInodeForBytes(d1.Size(), 512), "")
+	assert.NoError(t, err)
+	ts.clnt.srv = testNfs(d1)
+	assert.Greater(t, uint64(ts.clnt.srv.fsstate.Super.DataStart()),
+		common.NBITBLOCK)
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	data := mkdata(8192)
+	ts.Write(y, data, nfstypes.FILE_SYNC)
+	ts.readcheck(y, 0, data)
+	ts.clnt.Shutdown()
+	ts.clnt.srv = testNfs(d)
+}
+
 func TestRestartPersist(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
@@ -799,60 +1357,1534 @@ func TestRestartPersist(t *testing.T) {
 	ts.Create("x")
 	ts.clnt.Shutdown()
 	d := ts.clnt.srv.fsstate.Super.Disk
-	ts.clnt.srv = MakeNfs(d)
+	ts.clnt.srv = testNfs(d)
 	ts.Lookup("x", true)
 	ts.Create("y")
 	ts.Lookup("y", true)
 }
 
-func TestAbortRestart(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode")
-	}
+func TestLinkRestart(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
 
-	sz := ts.maketoolargefile("x", 50)
-	fh3 := ts.Lookup("x", true)
-	attr := ts.clnt.MkDirOp(fh.MkRootFh3(), "d")
-	assert.Equal(ts.t, nfstypes.NFS3ERR_NOSPC, attr.Status)
-	// d better not exist
-	ts.Lookup("d", false)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	data := mkdata(4096)
+	ts.Write(x, data, nfstypes.FILE_SYNC)
+	ts.Link(x, "y")
 	ts.clnt.Shutdown()
 
 	d := ts.clnt.srv.fsstate.Super.Disk
-	ts.clnt.srv = MakeNfs(d)
-	fhx := fh.MakeFh(fh3)
-	fattr := ts.Getattr(fh3, sz)
-	assert.Equal(ts.t, fattr.Fileid, nfstypes.Fileid3(fhx.Ino))
-	assert.Equal(ts.t, sz, uint64(fattr.Size))
-	ts.Lookup("d", false)
+	ts.clnt.srv = testNfs(d)
+	attr := ts.Getattr(x, 4096)
+	assert.Equal(t, nfstypes.Uint32(2), attr.Nlink)
+	ts.Remove("x")
+	ts.clnt.Crash()
+
+	ts.clnt.srv = testNfs(d)
+	_ = ts.Lookup("x", false)
+	y := ts.Lookup("y", true)
+	attr = ts.Getattr(y, 4096)
+	assert.Equal(t, nfstypes.Uint32(1), attr.Nlink)
+	ts.readcheck(y, 0, data)
 }
 
-func TestRestartReclaim(t *testing.T) {
+func TestModeOwner(t *testing.T) {
 	ts := newTest(t)
 	defer ts.Close()
 
-	sz := ts.maketoolargefile("x", 50)
-	fhx3 := ts.Lookup("x", true)
-	fhx := fh.MakeFh(fhx3)
+	root := fh.MkRootFh3()
+	attr := ts.GetattrDir(root)
+	assert.Equal(t, nfstypes.Mode3(inode.DEFMODE), attr.Mode)
+
+	sattr := nfstypes.Sattr3{
+		Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0640},
+		Uid:  nfstypes.Set_uid3{Set_it: true, Uid: 5},
+		Gid:  nfstypes.Set_gid3{Set_it: true, Gid: 6},
+	}
+	reply := ts.clnt.CreateAttrOp(root, "x", sattr)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Mode3(0640), reply.Resok.Obj_attributes.Attributes.Mode)
+	x := ts.Lookup("x", true)
+	attr = ts.Getattr(x, 0)
+	assert.Equal(t, nfstypes.Mode3(0640), attr.Mode)
+	assert.Equal(t, nfstypes.Uid3(5), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(6), attr.Gid)
+
+	// change mode and owner together with size
+	sattr = nfstypes.Sattr3{
+		Mode: nfstypes.Set_mode3{Set_it: true, Mode: 04755},
+		Uid:  nfstypes.Set_uid3{Set_it: true, Uid: 7},
+		Size: nfstypes.Set_size3{Set_it: true, Size: 100},
+	}
+	sreply := ts.clnt.SetattrAttrOp(x, sattr)
+	assert.Equal(t, nfstypes.NFS3_OK, sreply.Status)
+	assert.Equal(t, nfstypes.Mode3(04755), sreply.Resok.Obj_wcc.After.Attributes.Mode)
+
+	mreply := ts.clnt.MkDirOp(root, "d")
+	assert.Equal(t, nfstypes.NFS3_OK, mreply.Status)
+	d := ts.Lookup("d", true)
+	sattr = nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0700}}
+	sreply = ts.clnt.SetattrAttrOp(d, sattr)
+	assert.Equal(t, nfstypes.NFS3_OK, sreply.Status)
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = testNfs(ts.clnt.srv.fsstate.Super.Disk)
+	attr = ts.Getattr(x, 100)
+	assert.Equal(t, nfstypes.Mode3(04755), attr.Mode)
+	assert.Equal(t, nfstypes.Uid3(7), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(6), attr.Gid)
+	attr = ts.GetattrDir(d)
+	assert.Equal(t, nfstypes.Mode3(0700), attr.Mode)
+}
+
+func ctimeBefore(t1 nfstypes.Nfstime3, t2 nfstypes.Nfstime3) bool {
+	return t1.Seconds < t2.Seconds ||
+		(t1.Seconds == t2.Seconds && t1.Nseconds < t2.Nseconds)
+}
+
+func TestCtime(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	attr := ts.Getattr(x, 0)
+	ctime := attr.Ctime
+	assert.Equal(t, attr.Mtime, ctime)
+
+	// each change to x must advance its ctime
+	changed := func() {
+		attr := ts.clnt.GetattrOp(x).Resok.Obj_attributes
+		assert.True(t, ctimeBefore(ctime, attr.Ctime), "ctime did not advance")
+		ctime = attr.Ctime
+	}
+	ts.Write(x, mkdata(4096), nfstypes.FILE_SYNC)
+	changed()
+	assert.Equal(t, ctime, ts.Getattr(x, 4096).Mtime)
+	ts.Setattr(x, 100)
+	changed()
+	ts.Link(x, "y")
+	changed()
+	ts.Rename("y", "z")
+	changed()
+	ts.Remove("z")
+	changed()
+	sattr := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0600}}
+	sreply := ts.clnt.SetattrAttrOp(x, sattr)
+	assert.Equal(t, nfstypes.NFS3_OK, sreply.Status)
+	changed()
+
+	// ctime changes don't touch mtime
+	attr = ts.Getattr(x, 100)
+	assert.True(t, ctimeBefore(attr.Mtime, attr.Ctime))
+
+	// the directory's ctime and mtime advance with its entries
+	dattr := ts.GetattrDir(root)
+	ts.Create("w")
+	dattr1 := ts.GetattrDir(root)
+	assert.True(t, ctimeBefore(dattr.Ctime, dattr1.Ctime))
+	assert.True(t, ctimeBefore(dattr.Mtime, dattr1.Mtime))
+
+	// a guarded SETATTR fails unless the ctime matches
+	sattr = nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0644}}
+	old := nfstypes.Nfstime3{Seconds: ctime.Seconds - 1, Nseconds: ctime.Nseconds}
+	sreply = ts.clnt.SetattrGuardOp(x, sattr, old)
+	assert.Equal(t, nfstypes.NFS3ERR_NOT_SYNC, sreply.Status)
+	assert.Equal(t, nfstypes.Mode3(0600), ts.Getattr(x, 100).Mode)
+	sreply = ts.clnt.SetattrGuardOp(x, sattr, ctime)
+	assert.Equal(t, nfstypes.NFS3_OK, sreply.Status)
+	changed()
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = testNfs(ts.clnt.srv.fsstate.Super.Disk)
+	attr = ts.Getattr(x, 100)
+	assert.Equal(t, ctime, attr.Ctime)
+}
+
+func TestFsstat(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st0 := ts.Fsstat()
+	sb := ts.clnt.srv.fsstate.Super
+	assert.Equal(t, nfstypes.Size3(uint64(sb.MaxBnum()-sb.DataStart())*disk.BlockSize), st0.Tbytes)
+	assert.Equal(t, nfstypes.Size3(uint64(sb.NInode())-1), st0.Tfiles)
+	assert.True(t, st0.Fbytes < st0.Tbytes)
+	assert.Equal(t, st0.Tfiles-1, st0.Ffiles) // the root
+
+	const N = 1000
+	ts.writeLargeFile("x", N)
+	ts.MkDir("d")
+	st1 := ts.Fsstat()
+	assert.True(t, uint64(st1.Fbytes)+N*disk.BlockSize < uint64(st0.Fbytes))
+	assert.Equal(t, st0.Ffiles-2, st1.Ffiles)
+	assert.Equal(t, st1.Fbytes, st1.Abytes)
+
+	// a restart recounts the bitmaps
+	ts.clnt.Shutdown()
+	ts.clnt.srv = testNfs(ts.clnt.srv.fsstate.Super.Disk)
+	assert.Equal(t, st1, ts.Fsstat())
+
+	// x is too large to free in one transaction, so the shrinker
+	// frees most of its blocks
 	ts.Remove("x")
-	ts.clnt.Crash()
+	ts.RmDir("d", nfstypes.NFS3_OK)
+	ts.clnt.srv.shrinkst.Wait()
+	st2 := ts.Fsstat()
+	assert.Equal(t, st0.Fbytes, st2.Fbytes)
+	assert.Equal(t, st0.Ffiles, st2.Ffiles)
 
-	d := ts.clnt.srv.fsstate.Super.Disk
-	ts.clnt.srv = MakeNfs(d)
-	ts.Lookup("x", false)
+	ts.clnt.Shutdown()
+	ts.clnt.srv = testNfs(ts.clnt.srv.fsstate.Super.Disk)
+	assert.Equal(t, st2, ts.Fsstat())
+
+	// freeing a free block, as after a repair, doesn't change the count
+	balloc := ts.clnt.srv.fsstate.Balloc
+	bn := balloc.AllocNum()
+	balloc.FreeNum(bn)
+	balloc.FreeNum(bn)
+	assert.Equal(t, st2, ts.Fsstat())
+}
+
+func TestCreateExclusive(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	verf := nfstypes.Createverf3{1, 2, 3, 4, 5, 6, 7, 8}
+	reply := ts.clnt.CreateExclOp(root, "x", verf)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	x := reply.Resok.Obj.Handle
 
-	// Create will try re-allocate inode fhx.Ino, but abort since
-	// it must be shrunk first (because above the server
-	// ''crashed'' immediately after remove). Then, retrying,
-	// Create will allocate the next inode.
+	// a retransmission gets the same file, also after a restart
+	reply = ts.clnt.CreateExclOp(root, "x", verf)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, x, reply.Resok.Obj.Handle)
+	ts.clnt.Shutdown()
+	ts.clnt.srv = testNfs(ts.clnt.srv.fsstate.Super.Disk)
+	reply = ts.clnt.CreateExclOp(root, "x", verf)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, x, reply.Resok.Obj.Handle)
+
+	// another client's create fails
+	reply = ts.clnt.CreateExclOp(root, "x", nfstypes.Createverf3{8})
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+	how := nfstypes.Createhow3{Mode: nfstypes.GUARDED}
+	where := nfstypes.Diropargs3{Dir: root, Name: "x"}
+	creply := ts.clnt.srv.NFSPROC3_CREATE(nfstypes.CREATE3args{Where: where, How: how})
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, creply.Status)
+
+	// the SETATTR that completes the create clears the verifier
+	sattr := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0600}}
+	sreply := ts.clnt.SetattrAttrOp(x, sattr)
+	assert.Equal(t, nfstypes.NFS3_OK, sreply.Status)
+	reply = ts.clnt.CreateExclOp(root, "x", verf)
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+
+	// files created otherwise have no verifier
+	ts.Create("y")
+	reply = ts.clnt.CreateExclOp(root, "y", nfstypes.Createverf3{})
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+	ts.MkDir("d")
+	reply = ts.clnt.CreateExclOp(root, "d", nfstypes.Createverf3{})
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+
+	// a zero verifier is a verifier too
+	reply = ts.clnt.CreateExclOp(root, "z", nfstypes.Createverf3{})
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	z := reply.Resok.Obj.Handle
+	reply = ts.clnt.CreateExclOp(root, "z", nfstypes.Createverf3{})
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, z, reply.Resok.Obj.Handle)
+}
+
+func TestCreateUnchecked(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
 	ts.Create("x")
-	fh3 := ts.Lookup("x", true)
-	fht := fh.MakeFh(fh3)
-	assert.Equal(ts.t, fhx.Ino+1, fht.Ino)
+	x := ts.Lookup("x", true)
+	data := mkdata(8192)
+	ts.Write(x, data, nfstypes.FILE_SYNC)
+
+	// an UNCHECKED create of a file that exists succeeds, and applies
+	// the attributes
+	mode := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0640}}
+	reply := ts.clnt.CreateAttrOp(root, "x", mode)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, x, reply.Resok.Obj.Handle)
+	assert.Equal(t, nfstypes.Mode3(0640), reply.Resok.Obj_attributes.Attributes.Mode)
+	ts.readcheck(x, 0, data)
+
+	// and truncates it if it sets a size
+	trunc := mode
+	trunc.Size = nfstypes.Set_size3{Set_it: true, Size: 0}
+	reply = ts.clnt.CreateAttrOp(root, "x", trunc)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, x, reply.Resok.Obj.Handle)
+	ts.Getattr(x, 0)
+
+	// a caller that doesn't own the file may only truncate it
+	ts.Write(x, data, nfstypes.FILE_SYNC)
+	sattr := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0666}}
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.SetattrAttrOp(x, sattr).Status)
+	alice := ts.asUser(1000, 1000)
+	trunc.Mode.Mode = 0600
+	reply = alice.CreateAttrOp(root, "x", trunc)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Mode3(0666), reply.Resok.Obj_attributes.Attributes.Mode)
+	ts.Getattr(x, 0)
+
+	// other kinds of files still make it fail
+	ts.MkDir("d")
+	reply = ts.clnt.CreateOp(root, "d")
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+}
 
-	ts.maketoolargefile("y", 50)
-	fhx3 = ts.Lookup("y", true)
+func TestMknod(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	root := fh.MkRootFh3()
+	mode := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0620}}
+	fifo := nfstypes.Mknoddata3{Ftype: nfstypes.NF3FIFO, Pipe_attributes: mode}
+	reply := ts.clnt.MknodOp(root, "fifo", fifo)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.NF3FIFO, reply.Resok.Obj_attributes.Attributes.Ftype)
+	assert.Equal(t, nfstypes.Mode3(0620), reply.Resok.Obj_attributes.Attributes.Mode)
+	reply = ts.clnt.MknodOp(root, "sock", nfstypes.Mknoddata3{Ftype: nfstypes.NF3SOCK})
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	spec := nfstypes.Specdata3{Specdata1: 8, Specdata2: 1}
+	chr := nfstypes.Mknoddata3{Ftype: nfstypes.NF3CHR,
+		Device: nfstypes.Devicedata3{Spec: spec}}
+	reply = ts.clnt.MknodOp(root, "chr", chr)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, spec, reply.Resok.Obj_attributes.Attributes.Rdev)
+	blk := nfstypes.Mknoddata3{Ftype: nfstypes.NF3BLK,
+		Device: nfstypes.Devicedata3{Spec: nfstypes.Specdata3{Specdata1: 259}}}
+	reply = ts.clnt.MknodOp(root, "blk", blk)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+
+	reply = ts.clnt.MknodOp(root, "reg", nfstypes.Mknoddata3{Ftype: nfstypes.NF3REG})
+	assert.Equal(t, nfstypes.NFS3ERR_BADTYPE, reply.Status)
+	reply = ts.clnt.MknodOp(root, "fifo", fifo)
+	assert.Equal(t, nfstypes.NFS3ERR_EXIST, reply.Status)
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = testNfs(ts.clnt.srv.fsstate.Super.Disk)
+	attr := ts.clnt.GetattrOp(ts.Lookup("fifo", true)).Resok.Obj_attributes
+	assert.Equal(t, nfstypes.NF3FIFO, attr.Ftype)
+	assert.Equal(t, nfstypes.Mode3(0620), attr.Mode)
+	attr = ts.clnt.GetattrOp(ts.Lookup("sock", true)).Resok.Obj_attributes
+	assert.Equal(t, nfstypes.NF3SOCK, attr.Ftype)
+	attr = ts.clnt.GetattrOp(ts.Lookup("chr", true)).Resok.Obj_attributes
+	assert.Equal(t, nfstypes.NF3CHR, attr.Ftype)
+	assert.Equal(t, spec, attr.Rdev)
+	attr = ts.clnt.GetattrOp(ts.Lookup("blk", true)).Resok.Obj_attributes
+	assert.Equal(t, nfstypes.NF3BLK, attr.Ftype)
+	assert.Equal(t, nfstypes.Specdata3{Specdata1: 259}, attr.Rdev)
+
+	ts.Remove("fifo")
+	ts.Remove("chr")
+	ts.Lookup("fifo", false)
+}
+
+// asUser returns a client whose calls run on behalf of uid and gid
+func (ts *TestState) asUser(uid uint32, gid uint32) *NfsClient {
+	return &NfsClient{srv: ts.clnt.srv.WithCred(&Cred{Uid: uid, Gid: gid})}
+}
+
+func TestPermissions(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	const ACCESSALL = nfstypes.ACCESS3_READ | nfstypes.ACCESS3_LOOKUP |
+		nfstypes.ACCESS3_MODIFY | nfstypes.ACCESS3_EXTEND |
+		nfstypes.ACCESS3_DELETE | nfstypes.ACCESS3_EXECUTE
+	root := fh.MkRootFh3()
+	alice := ts.asUser(1000, 1000)
+	bob := ts.asUser(1001, 1001)
+
+	ts.MkDir("d")
+	d := ts.Lookup("d", true)
+	sattr := nfstypes.Sattr3{
+		Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0755},
+		Uid:  nfstypes.Set_uid3{Set_it: true, Uid: 1000},
+	}
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.SetattrAttrOp(d, sattr).Status)
+
+	// alice owns what she creates
+	mode := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0644}}
+	creply := alice.CreateAttrOp(d, "f", mode)
+	assert.Equal(t, nfstypes.NFS3_OK, creply.Status)
+	f := creply.Resok.Obj.Handle
+	attr := creply.Resok.Obj_attributes.Attributes
+	assert.Equal(t, nfstypes.Uid3(1000), attr.Uid)
+	assert.Equal(t, nfstypes.Gid3(1000), attr.Gid)
+
+	areply := alice.AccessOp(f, ACCESSALL)
+	assert.Equal(t, nfstypes.NFS3_OK, areply.Status)
+	assert.Equal(t, nfstypes.Uint32(nfstypes.ACCESS3_READ|nfstypes.ACCESS3_MODIFY|
+		nfstypes.ACCESS3_EXTEND), areply.Resok.Access)
+	areply = bob.AccessOp(f, ACCESSALL)
+	assert.Equal(t, nfstypes.Uint32(nfstypes.ACCESS3_READ), areply.Resok.Access)
+	areply = bob.AccessOp(d, ACCESSALL)
+	assert.Equal(t, nfstypes.Uint32(nfstypes.ACCESS3_READ|nfstypes.ACCESS3_LOOKUP),
+		areply.Resok.Access)
+	areply = ts.clnt.AccessOp(f, nfstypes.ACCESS3_MODIFY)
+	assert.Equal(t, nfstypes.Uint32(nfstypes.ACCESS3_MODIFY), areply.Resok.Access)
+
+	// bob may read f and look in d, but not change either
+	data := mkdata(100)
+	assert.Equal(t, nfstypes.NFS3_OK, alice.WriteOp(f, 0, data, nfstypes.FILE_SYNC).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, bob.ReadOp(f, 0, 100).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, bob.LookupOp(d, "f").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.WriteOp(f, 0, data, nfstypes.FILE_SYNC).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.SetattrOp(f, 0).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.CreateOp(d, "g").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.MkDirOp(d, "g").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.RemoveOp(d, "f").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.RenameOp(d, "f", root, "f"))
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.LinkOp(f, d, "g").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, bob.SetattrAttrOp(f, mode).Status)
+
+	// only root gives files away
+	chown := nfstypes.Sattr3{Uid: nfstypes.Set_uid3{Set_it: true, Uid: 1001}}
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, alice.SetattrAttrOp(f, chown).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, alice.CreateAttrOp(d, "g", chown).Status)
+	chgrp := nfstypes.Sattr3{Gid: nfstypes.Set_gid3{Set_it: true, Gid: 1001}}
+	assert.Equal(t, nfstypes.NFS3ERR_PERM, alice.SetattrAttrOp(f, chgrp).Status)
+
+	// once alice makes f private, bob can't read it
+	private := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0600}}
+	assert.Equal(t, nfstypes.NFS3_OK, alice.SetattrAttrOp(f, private).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.ReadOp(f, 0, 100).Status)
+	private.Mode.Mode = 0700
+	assert.Equal(t, nfstypes.NFS3_OK, alice.SetattrAttrOp(d, private).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.LookupOp(d, "f").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, bob.ReadDirPlusOp(d, 1000).Status)
+
+	// alice may truncate her read-only file, but not write it
+	readonly := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0400}}
+	assert.Equal(t, nfstypes.NFS3_OK, alice.SetattrAttrOp(f, readonly).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, alice.WriteOp(f, 0, data, nfstypes.FILE_SYNC).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, alice.SetattrOp(f, 0).Status)
+
+	assert.Equal(t, nfstypes.NFS3_OK, alice.RenameOp(d, "f", d, "g"))
+	assert.Equal(t, nfstypes.NFS3_OK, alice.RemoveOp(d, "g").Status)
+
+	// in a sticky directory, only owners remove names
+	ts.MkDir("tmp")
+	tmp := ts.Lookup("tmp", true)
+	sticky := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 01777}}
+	assert.Equal(t, nfstypes.NFS3_OK, ts.clnt.SetattrAttrOp(tmp, sticky).Status)
+	assert.Equal(t, nfstypes.NFS3_OK, bob.CreateAttrOp(tmp, "b", mode).Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, alice.RemoveOp(tmp, "b").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, alice.RenameOp(tmp, "b", tmp, "a"))
+	assert.Equal(t, nfstypes.NFS3_OK, bob.RemoveOp(tmp, "b").Status)
+
+	// a view without a cred may do nothing that needs permission
+	nocred := &NfsClient{srv: ts.clnt.srv.WithCred(nil)}
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, nocred.CreateOp(tmp, "n").Status)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, nocred.LookupOp(d, "f").Status)
+
+	// views share the server's state
+	alice.srv.Unstable = false
+	assert.False(t, ts.clnt.srv.Unstable)
+	alice.srv.Unstable = true
+}
+
+func authUnix(uid uint32, gid uint32) rfc1057.Opaque_auth {
+	au := rfc1057.Auth_unix{Machinename: "test", Uid: uid, Gid: gid}
+	wr := xdr.MakeWriter(nil)
+	au.Xdr(wr)
+	return rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_UNIX, Body: wr.WriteBuf()}
+}
+
+func TestRootSquash(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	srv := ts.clnt.srv
+	cred := srv.mkCred(authUnix(0, 0))
+	assert.Equal(t, uint32(0), cred.Uid)
+	srv.RootSquash = true
+	cred = srv.mkCred(authUnix(0, 0))
+	assert.Equal(t, NOBODY, cred.Uid)
+	assert.Equal(t, NOBODY, cred.Gid)
+	cred = srv.mkCred(authUnix(1000, 0))
+	assert.Equal(t, uint32(1000), cred.Uid)
+	assert.Equal(t, NOBODY, cred.Gid)
+	cred = srv.mkCred(rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_NONE})
+	assert.Equal(t, NOBODY, cred.Uid)
+}
+
+// TestRpcCred runs calls through an rpcsrv.Server, checking that they
+// run with the caller's credential
+func TestRpcCred(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	srv := rpcsrv.MakeServer()
+	ts.clnt.srv.RootSquash = true
+	ts.clnt.srv.Register(srv)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go srv.Run(c2)
+	clnt := rfc1057.MakeClient(c1, nfstypes.NFS_PROGRAM, nfstypes.NFS_V3)
+
+	root := fh.MkRootFh3()
+	none := rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_NONE}
+	mode := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0644}}
+	args := nfstypes.CREATE3args{
+		Where: nfstypes.Diropargs3{Dir: root, Name: "x"},
+		How:   nfstypes.Createhow3{Obj_attributes: mode},
+	}
+	var reply nfstypes.CREATE3res
+	err := clnt.Call(nfstypes.NFSPROC3_CREATE, authUnix(1000, 1000), none, &args, &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Uid3(1000), reply.Resok.Obj_attributes.Attributes.Uid)
+
+	args.Where.Name = "y"
+	err = clnt.Call(nfstypes.NFSPROC3_CREATE, authUnix(0, 0), none, &args, &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, nfstypes.Uid3(NOBODY), reply.Resok.Obj_attributes.Attributes.Uid)
+
+	// AUTH_NONE callers are nobody, who may not write x
+	x := ts.Lookup("x", true)
+	wargs := nfstypes.WRITE3args{File: x, Count: 1,
+		Stable: nfstypes.FILE_SYNC, Data: []byte{1}}
+	var wreply nfstypes.WRITE3res
+	err = clnt.Call(nfstypes.NFSPROC3_WRITE, none, none, &wargs, &wreply)
+	assert.Nil(t, err)
+	assert.Equal(t, nfstypes.NFS3ERR_ACCES, wreply.Status)
+}
+
+// recConn records the last call written to it, so that a test can
+// retransmit it
+type recConn struct {
+	net.Conn
+	last []byte
+}
+
+func (c *recConn) Write(b []byte) (int, error) {
+	c.last = append([]byte{}, b...)
+	return c.Conn.Write(b)
+}
+
+// resend sends call again, and decodes the reply into res
+func (c *recConn) resend(call []byte, res xdr.Xdrable) error {
+	_, err := c.Conn.Write(call)
+	if err != nil {
+		return err
+	}
+	var hdr [4]byte
+	_, err = io.ReadFull(c.Conn, hdr[:])
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(hdr[:])&0x7fffffff)
+	_, err = io.ReadFull(c.Conn, buf)
+	if err != nil {
+		return err
+	}
+	rd := xdr.MakeReader(buf)
+	var msg rfc1057.Rpc_msg
+	msg.Xdr(rd)
+	res.Xdr(rd)
+	return rd.Error()
+}
+
+func TestDRC(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	srv := rpcsrv.MakeServer()
+	ts.clnt.srv.Register(srv)
+	drc := rpcsrv.MkDRC(2)
+	srv.SetDRC(drc)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go srv.Run(c2)
+	conn := &recConn{Conn: c1}
+	clnt := rfc1057.MakeClient(conn, nfstypes.NFS_PROGRAM, nfstypes.NFS_V3)
+
+	root := fh.MkRootFh3()
+	none := rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_NONE}
+	remove := func(name string) nfstypes.Nfsstat3 {
+		args := nfstypes.REMOVE3args{
+			Object: nfstypes.Diropargs3{Dir: root, Name: nfstypes.Filename3(name)},
+		}
+		var reply nfstypes.REMOVE3res
+		err := clnt.Call(nfstypes.NFSPROC3_REMOVE, none, none, &args, &reply)
+		assert.Nil(t, err)
+		return reply.Status
+	}
+	resend := func(call []byte) nfstypes.Nfsstat3 {
+		var reply nfstypes.REMOVE3res
+		err := conn.resend(call, &reply)
+		assert.Nil(t, err)
+		return reply.Status
+	}
+
+	// a retransmitted REMOVE gets the first call's reply, but a new
+	// call with another xid runs
+	ts.Create("x")
+	assert.Equal(t, nfstypes.NFS3_OK, remove("x"))
+	first := conn.last
+	assert.Equal(t, nfstypes.NFS3_OK, resend(first))
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, remove("x"))
+	hits, misses := drc.Stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(2), misses)
+
+	// LOOKUP is idempotent, so the cache doesn't see it
+	ts.Lookup("x", false)
+	largs := nfstypes.LOOKUP3args{What: nfstypes.Diropargs3{Dir: root, Name: "x"}}
+	var lreply nfstypes.LOOKUP3res
+	err := clnt.Call(nfstypes.NFSPROC3_LOOKUP, none, none, &largs, &lreply)
+	assert.Nil(t, err)
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, lreply.Status)
+	hits, misses = drc.Stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(2), misses)
+
+	// once evicted, the first call runs again
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, remove("y"))
+	assert.Equal(t, nfstypes.NFS3ERR_NOENT, resend(first))
+	hits, misses = drc.Stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(4), misses)
+}
+
+// udpCall sends a call to NFS proc with xid in one datagram on conn, and
+// decodes the reply into res if the server ran the call
+func udpCall(conn net.Conn, xid uint32, proc uint32, args xdr.Xdrable,
+	res xdr.Xdrable) (rfc1057.Accept_stat, error) {
+	var req rfc1057.Rpc_msg
+	req.Xid = xid
+	req.Body.Mtype = rfc1057.CALL
+	req.Body.Cbody.Rpcvers = 2
+	req.Body.Cbody.Prog = nfstypes.NFS_PROGRAM
+	req.Body.Cbody.Vers = nfstypes.NFS_V3
+	req.Body.Cbody.Proc = proc
+	req.Body.Cbody.Cred = authUnix(0, 0)
+	wr := xdr.MakeWriter(nil)
+	req.Xdr(wr)
+	args.Xdr(wr)
+	_, err := conn.Write(wr.WriteBuf())
+	if err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 1<<16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	rd := xdr.MakeReader(buf[:n])
+	var msg rfc1057.Rpc_msg
+	msg.Xdr(rd)
+	if msg.Xid != xid {
+		return 0, fmt.Errorf("xid %d != %d", msg.Xid, xid)
+	}
+	stat := msg.Body.Rbody.Areply.Reply_data.Stat
+	if stat == rfc1057.SUCCESS {
+		res.Xdr(rd)
+	}
+	return stat, rd.Error()
+}
+
+func TestUDP(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	srv := rpcsrv.MakeServer()
+	ts.clnt.srv.Register(srv)
+	srv.SetDRC(rpcsrv.MkDRC(16))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no UDP: %v", err)
+	}
+	defer pc.Close()
+	go srv.RunUDP(pc)
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// FSINFO offers transfers that fit in a datagram
+	root := fh.MkRootFh3()
+	var fsinfo nfstypes.FSINFO3res
+	stat, err := udpCall(conn, 1, nfstypes.NFSPROC3_FSINFO,
+		&nfstypes.FSINFO3args{Fsroot: root}, &fsinfo)
+	assert.Nil(t, err)
+	assert.Equal(t, rfc1057.SUCCESS, stat)
+	assert.Equal(t, nfstypes.NFS3_OK, fsinfo.Status)
+	assert.Equal(t, nfstypes.Uint32(MAXDATAGRAMXFER), fsinfo.Resok.Rtmax)
+	assert.Equal(t, nfstypes.Uint32(MAXDATAGRAMXFER), fsinfo.Resok.Wtmax)
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	data := mkdataval(7, MAXDATAGRAMXFER)
+	for i := uint32(0); i < 2; i++ {
+		wargs := nfstypes.WRITE3args{File: x,
+			Offset: nfstypes.Offset3(i * MAXDATAGRAMXFER),
+			Count:  MAXDATAGRAMXFER, Stable: nfstypes.FILE_SYNC, Data: data}
+		var wreply nfstypes.WRITE3res
+		stat, err = udpCall(conn, 2+i, nfstypes.NFSPROC3_WRITE, &wargs, &wreply)
+		assert.Nil(t, err)
+		assert.Equal(t, rfc1057.SUCCESS, stat)
+		assert.Equal(t, nfstypes.NFS3_OK, wreply.Status)
+		assert.Equal(t, nfstypes.Count3(MAXDATAGRAMXFER), wreply.Resok.Count)
+	}
+	rargs := nfstypes.READ3args{File: x, Count: MAXDATAGRAMXFER}
+	var rreply nfstypes.READ3res
+	stat, err = udpCall(conn, 4, nfstypes.NFSPROC3_READ, &rargs, &rreply)
+	assert.Nil(t, err)
+	assert.Equal(t, rfc1057.SUCCESS, stat)
+	assert.Equal(t, data, rreply.Resok.Data)
+
+	// a reply that doesn't fit in a datagram is an error
+	rargs.Count = 2 * MAXDATAGRAMXFER
+	stat, err = udpCall(conn, 5, nfstypes.NFSPROC3_READ, &rargs, &rreply)
+	assert.Nil(t, err)
+	assert.Equal(t, rpcsrv.SYSTEM_ERR, stat)
+
+	// a retransmitted REMOVE gets the first call's reply
+	args := nfstypes.REMOVE3args{Object: nfstypes.Diropargs3{Dir: root, Name: "x"}}
+	for _, xid := range []uint32{6, 6, 7} {
+		var reply nfstypes.REMOVE3res
+		stat, err = udpCall(conn, xid, nfstypes.NFSPROC3_REMOVE, &args, &reply)
+		assert.Nil(t, err)
+		assert.Equal(t, rfc1057.SUCCESS, stat)
+		if xid == 6 {
+			assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+		} else {
+			assert.Equal(t, nfstypes.NFS3ERR_NOENT, reply.Status)
+		}
+	}
+}
+
+func TestSuper(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	sb := ts.clnt.srv.fsstate.Super
+	assert.Equal(t, super.VERSION, sb.Version)
+	assert.NotEqual(t, uint64(0), sb.Created)
+	assert.NotEqual(t, make([]byte, super.UUIDSZ), sb.UUID)
+	created := sb.Created
+	uuid := append([]byte{}, sb.UUID...)
+
+	ts.Create("x")
+	ts.clnt.Shutdown()
+	d := sb.Disk
+	ts.clnt.srv = testNfs(d)
+	sb = ts.clnt.srv.fsstate.Super
+	assert.Equal(t, created, sb.Created)
+	assert.Equal(t, uuid, sb.UUID)
+	ts.Lookup("x", true)
+	ts.clnt.Shutdown()
+
+	// the same file system on a larger disk
+	d1 := disk.NewMemDisk(d.Size() + 100)
+	for bn := uint64(0); bn < d.Size(); bn++ {
+		d1.Write(bn, d.Read(bn))
+	}
+	_, err := OpenNfs(d1)
+	assert.Error(t, err)
+
+	// a version from the future
+	blk := d.Read(common.LOGSIZE)
+	blk[8] = 99
+	d1 = disk.NewMemDisk(d.Size())
+	d1.Write(common.LOGSIZE, blk)
+	_, err = OpenNfs(d1)
+	assert.Error(t, err)
+
+	// something else
+	d1 = disk.NewMemDisk(d.Size())
+	d1.Write(common.LOGSIZE, mkdata(disk.BlockSize))
+	_, err = OpenNfs(d1)
+	assert.Error(t, err)
+
+	// nothing, which isn't formatted behind the caller's back
+	d1 = disk.NewMemDisk(d.Size())
+	_, err = OpenNfs(d1)
+	assert.Error(t, err)
+	assert.Equal(t, make(disk.Block, disk.BlockSize), d1.Read(common.LOGSIZE))
+
+	// a VERSION1 superblock, which has no layout of its own
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(super.MAGIC)
+	enc.PutInt(super.VERSION1)
+	d1.Write(common.LOGSIZE, enc.Finish())
+	sb1, serr := super.ReadFsSuper(d1)
+	assert.Equal(t, super.OK, serr)
+	assert.Equal(t, super.VERSION1, sb1.Version)
+	assert.Equal(t, d1.Size(), sb1.Size)
+	assert.Equal(t, common.Inum(super.DEFNINODE), sb1.NInode())
+
+	ts.clnt.srv = testNfs(d)
+	ts.Lookup("x", true)
+}
+
+// fsckKinds checks d and returns the kinds of findings, and whether
+// they were all repaired
+func (ts *TestState) fsckKinds(d disk.Disk, repair bool) (map[string]bool, bool) {
+	report, err := fsck.Check(d, repair)
+	assert.NoError(ts.t, err)
+	kinds := make(map[string]bool)
+	for _, f := range report.Findings {
+		kinds[f.Kind] = true
+	}
+	return kinds, report.Repaired()
+}
+
+func TestFsck(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	// reach the double-indirect block
+	sz := uint64(inode.NDIRECT+inode.NBLKBLK+8) * disk.BlockSize
+	data := mkdata(sz)
+	for off := uint64(0); off < sz; off += 16 * disk.BlockSize {
+		ts.WriteOff(x, off, data[off:off+16*disk.BlockSize], nfstypes.UNSTABLE)
+	}
+	ts.Link(x, "y")
+	ts.MkDir("d1")
+	ts.MkDir("d2")
+	ts.Rename("d2", "d1/d2")
+	ts.Create("z")
+	ts.Remove("z")
+	ts.clnt.Shutdown()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+
+	ts.clnt.srv = testNfs(d)
+	ts.Create("o")
+	o := ts.Lookup("o", true)
+	ts.Write(o, mkdata(8192), nfstypes.FILE_SYNC)
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	root := op.GetInodeFh(fh.MkRootFh3())
+	ip := op.GetInodeFh(x)
+	ip.Nlink = 5
+	ip.WriteInode(op.Atxn)
+	// forget "o" without freeing it, and name a free inode
+	assert.True(t, dir.RemName(root, op, "o"))
+	assert.True(t, dir.AddName(root, op, 1000, "ghost"))
+	// leak a block
+	assert.NotEqual(t, common.NULLBNUM, op.Atxn.AllocBlock())
+	assert.True(t, op.Commit())
+	ts.clnt.Shutdown()
+
+	want := map[string]bool{fsck.NLINK: true, fsck.ORPHAN: true,
+		fsck.DIRENT: true, fsck.BLOCKLEAK: true}
+	kinds, repaired := ts.fsckKinds(d, false)
+	assert.Equal(t, want, kinds)
+	assert.False(t, repaired)
+	kinds, repaired = ts.fsckKinds(d, true)
+	assert.Equal(t, want, kinds)
+	assert.True(t, repaired)
+	kinds, _ = ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+
+	ts.clnt.srv = testNfs(d)
+	attr := ts.Getattr(x, sz)
+	assert.Equal(t, nfstypes.Uint32(2), attr.Nlink)
+	ts.Lookup("ghost", false)
+	ts.readcheck(ts.Lookup("y", true), 0, data)
+	ts.Remove("x")
+	ts.Remove("y")
+	ts.clnt.Shutdown()
+	kinds, _ = ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+
+	// checking alone replays the log without writing the disk
+	ts.clnt.srv = testNfs(&dropDisk{Disk: d, keepLog: true})
+	ts.Create("w")
+	ts.clnt.Shutdown()
+	dd := &dropDisk{Disk: d}
+	kinds, _ = ts.fsckKinds(dd, false)
+	assert.Empty(t, kinds)
+	assert.Equal(t, uint64(0), dd.dropped)
+	ts.clnt.srv = testNfs(d)
+	ts.Lookup("w", true)
+}
+
+// dropDisk drops the writes to a disk, except, if keepLog, those that
+// append to the log, as if the server always crashed before installing
+// its transactions
+type dropDisk struct {
+	disk.Disk
+	keepLog bool
+	dropped uint64
+}
+
+func (d *dropDisk) Write(a uint64, v disk.Block) {
+	if d.keepLog && a < common.LOGSIZE && a != uint64(wal.LOGHDR2) {
+		d.Disk.Write(a, v)
+		return
+	}
+	d.dropped++
+}
+
+func TestFsckShrink(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.maketoolargefile("x", 50)
+	ts.Remove("x")
+	ts.clnt.Crash()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Equal(t, map[string]bool{fsck.SHRINK: true}, kinds)
+	kinds, repaired := ts.fsckKinds(d, true)
+	assert.Equal(t, map[string]bool{fsck.SHRINK: true}, kinds)
+	assert.True(t, repaired)
+	kinds, _ = ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+	ts.clnt.srv = testNfs(d)
+}
+
+func TestLegacyFs(t *testing.T) {
+	ts := newLegacyTest(t)
+	defer ts.Close()
+
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	data := mkdata(8192)
+	ts.Write(x, data, nfstypes.FILE_SYNC)
+	ts.MkDir("d")
+	attr := ts.Getattr(x, 8192)
+	assert.Equal(t, nfstypes.Mode3(inode.DEFMODE), attr.Mode)
+
+	sattr := nfstypes.Sattr3{Mode: nfstypes.Set_mode3{Set_it: true, Mode: 0600}}
+	reply := ts.clnt.SetattrAttrOp(x, sattr)
+	assert.Equal(t, nfstypes.NFS3ERR_NOTSUPP, reply.Status)
+	creply := ts.clnt.CreateExclOp(fh.MkRootFh3(), "y", nfstypes.Createverf3{1})
+	assert.Equal(t, nfstypes.NFS3ERR_NOTSUPP, creply.Status)
+	chr := nfstypes.Mknoddata3{Ftype: nfstypes.NF3CHR}
+	mreply := ts.clnt.MknodOp(fh.MkRootFh3(), "chr", chr)
+	assert.Equal(t, nfstypes.NFS3ERR_NOTSUPP, mreply.Status)
+	fifo := nfstypes.Mknoddata3{Ftype: nfstypes.NF3FIFO}
+	mreply = ts.clnt.MknodOp(fh.MkRootFh3(), "fifo", fifo)
+	assert.Equal(t, nfstypes.NFS3_OK, mreply.Status)
+
+	ts.clnt.Shutdown()
+	ts.clnt.srv = testNfs(ts.clnt.srv.fsstate.Super.Disk)
+	assert.True(t, ts.clnt.srv.fsstate.Super.Legacy())
+	x = ts.Lookup("x", true)
+	ts.readcheck(x, 0, data)
+	ts.Lookup("d", true)
+	ts.Remove("x")
+	ts.RmDir("d", nfstypes.NFS3_OK)
+}
+
+func TestAbortRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	ts := newTest(t)
+	defer ts.Close()
+
+	sz := ts.maketoolargefile("x", 50)
+	fh3 := ts.Lookup("x", true)
+	attr := ts.clnt.MkDirOp(fh.MkRootFh3(), "d")
+	assert.Equal(ts.t, nfstypes.NFS3ERR_NOSPC, attr.Status)
+	// d better not exist
+	ts.Lookup("d", false)
+	ts.clnt.Shutdown()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = testNfs(d)
+	fhx := fh.MakeFh(fh3)
+	fattr := ts.Getattr(fh3, sz)
+	assert.Equal(ts.t, fattr.Fileid, nfstypes.Fileid3(fhx.Ino))
+	assert.Equal(ts.t, sz, uint64(fattr.Size))
+	ts.Lookup("d", false)
+}
+
+func TestRestartReclaim(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	free := ts.Fsstat().Fbytes
+	sz := ts.maketoolargefile("x", 50)
+	fhx3 := ts.Lookup("x", true)
+	fhx := fh.MakeFh(fhx3)
+	ts.Remove("x")
+	ts.clnt.Crash()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = testNfs(d)
+	ts.Lookup("x", false)
+
+	// Above the server ''crashed'' immediately after remove, before
+	// shrinking x. The restarted server resumes shrinking, which
+	// frees x's blocks and lets Create re-allocate inode fhx.Ino.
+	ts.clnt.srv.shrinkst.Wait()
+	assert.Equal(ts.t, free, ts.Fsstat().Fbytes)
+	ts.Create("x")
+	fh3 := ts.Lookup("x", true)
+	fht := fh.MakeFh(fh3)
+	assert.Equal(ts.t, fhx.Ino, fht.Ino)
+
+	ts.maketoolargefile("y", 50)
+	fhx3 = ts.Lookup("y", true)
 	ts.Getattr(fhx3, sz)
 }
+
+// Many inodes left shrinking are all shrunk on restart, by a few
+// threads
+func TestRestartReclaimMany(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	fhs := make([]nfstypes.Nfs_fh3, 3*shrinker.NRESUMER+1)
+	for i := range fhs {
+		name := "f" + strconv.Itoa(i)
+		ts.Create(name)
+		fhs[i] = ts.Lookup(name, true)
+	}
+	free := ts.Fsstat().Fbytes
+	data := mkdata(16 * disk.BlockSize)
+	for _, fh3 := range fhs {
+		ts.Write(fh3, data, nfstypes.FILE_SYNC)
+	}
+	assert.Greater(t, uint64(free), uint64(ts.Fsstat().Fbytes))
+	// truncate the files without freeing their blocks, as if the
+	// server stopped before shrinking them
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	for _, fh3 := range fhs {
+		ip := op.GetInodeFh(fh3)
+		ip.ShrinkSize = ip.Size
+		ip.Size = 0
+		ip.WriteInode(op.Atxn)
+	}
+	assert.True(t, op.Commit())
+	ts.clnt.Shutdown()
+
+	ts.clnt.srv = testNfs(ts.clnt.srv.fsstate.Super.Disk)
+	ts.clnt.srv.shrinkst.Wait()
+	for _, fh3 := range fhs {
+		ts.Getattr(fh3, 0)
+	}
+	assert.Equal(t, free, ts.Fsstat().Fbytes)
+}
+
+func TestOrphan(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st0 := ts.Fsstat()
+	ts.clnt.srv.SetOrphanGrace(time.Hour)
+	data := mkdata(8192)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.Write(x, data, nfstypes.FILE_SYNC)
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	ts.Write(y, data, nfstypes.FILE_SYNC)
+	// z isn't used after its creation, so it's freed right away
+	cr := ts.clnt.CreateOp(fh.MkRootFh3(), "z")
+	assert.Equal(t, nfstypes.NFS3_OK, cr.Status)
+	z := cr.Resok.Obj.Handle
+	// w is only looked up, which counts as a use
+	ts.Create("w")
+	w := ts.Lookup("w", true)
+	ts.Remove("x")
+	ts.Remove("y")
+	ts.Remove("w")
+	ts.Remove("z")
+	ts.GetattrFail(z)
+
+	// a use soon after the recorded one isn't recorded
+	xlast, ok := ts.clnt.srv.orphans.lastUse(fh.MakeFh(x).Ino)
+	assert.True(t, ok)
+	attr := ts.Getattr(x, 8192)
+	assert.Equal(t, nfstypes.Uint32(0), attr.Nlink)
+	xlast1, _ := ts.clnt.srv.orphans.lastUse(fh.MakeFh(x).Ino)
+	assert.Equal(t, xlast, xlast1)
+	ts.readcheck(x, 0, data)
+	ts.WriteOff(x, 8192, data, nfstypes.FILE_SYNC)
+	ts.Getattr(x, 2*8192)
+	reply := ts.clnt.LinkOp(x, fh.MkRootFh3(), "x")
+	assert.Equal(t, nfstypes.NFS3ERR_STALE, reply.Status)
+
+	// y's grace period ends, but not x's or w's, which are after and
+	// before y on the list
+	st := ts.clnt.srv.orphans
+	yino := fh.MakeFh(y).Ino
+	st.mu.Lock()
+	st.unlinked[yino] = time.Now().Add(-2 * time.Hour)
+	st.mu.Unlock()
+	st.shard(yino).mu.Lock()
+	st.shard(yino).last[yino] = time.Now().Add(-2 * time.Hour)
+	st.shard(yino).mu.Unlock()
+	ts.clnt.srv.reapOrphans(time.Now())
+	ts.GetattrFail(y)
+	ts.Getattr(x, 2*8192)
+	ts.Getattr(w, 0)
+	ts.clnt.Shutdown()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+
+	// opening the file system frees x and w
+	ts.clnt.srv = testNfs(d)
+	ts.GetattrFail(x)
+	ts.GetattrFail(w)
+	ts.clnt.srv.shrinkst.Wait()
+	st1 := ts.Fsstat()
+	assert.Equal(t, st0.Fbytes, st1.Fbytes)
+	assert.Equal(t, st0.Ffiles, st1.Ffiles)
+}
+
+// compactTest fills the root directory with n names, removes all but
+// every keep-th, and compacts it.  It returns the remaining names, and
+// a page of the directory read before compaction.
+func (ts *TestState) compactTest(n int, keep int) (map[string]bool, nfstypes.READDIR3res) {
+	root := fh.MkRootFh3()
+	for i := 0; i < n; i++ {
+		ts.Create("x" + strconv.Itoa(i))
+	}
+	sz := ts.GetattrDir(root).Size
+	names := map[string]bool{".": true, "..": true}
+	for i := 0; i < n; i++ {
+		if i%keep == 0 {
+			names["x"+strconv.Itoa(i)] = true
+			continue
+		}
+		ts.Remove("x" + strconv.Itoa(i))
+	}
+	page := ts.clnt.ReadDirOp(root, 0, nfstypes.Cookieverf3{}, 512)
+	require.Equal(ts.t, nfstypes.NFS3_OK, page.Status)
+	assert.True(ts.t, ts.clnt.srv.compactDir(common.ROOTINUM))
+	ts.clnt.srv.shrinkst.Wait()
+	assert.Less(ts.t, uint64(ts.GetattrDir(root).Size), uint64(sz)/2)
+	for name := range names {
+		ts.Lookup(name, true)
+	}
+	assert.Equal(ts.t, names, ts.readDirAll(root, 1024))
+
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(ts.t, kinds)
+	ts.clnt.srv = testNfs(d)
+	return names, page
+}
+
+func TestCompactDir(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	names, page := ts.compactTest(5000, 50)
+	assert.Equal(t, uint64(3*disk.BlockSize), uint64(ts.GetattrDir(fh.MkRootFh3()).Size))
+
+	// cookies from before compaction stay valid
+	seen := make(map[string]bool)
+	var last *nfstypes.Entry3
+	for e := page.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+		seen[string(e.Name)] = true
+		last = e
+	}
+	reply := ts.clnt.ReadDirOp(fh.MkRootFh3(), last.Cookie, page.Resok.Cookieverf, 1<<20)
+	require.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.True(t, reply.Resok.Reply.Eof)
+	for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+		seen[string(e.Name)] = true
+	}
+	for name := range names {
+		assert.True(t, seen[name], "%s missing", name)
+	}
+}
+
+func TestCompactLinearDir(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	ts := newLegacyTest(t)
+	defer ts.Close()
+
+	// more moves than fit in a transaction, and a free tail
+	const N = 16000
+	root := fh.MkRootFh3()
+	for i := 0; i < N; i++ {
+		ts.Create("x" + strconv.Itoa(i))
+	}
+	sz := uint64(ts.GetattrDir(root).Size)
+	names := map[string]bool{".": true, "..": true}
+	for i := 0; i < N; i++ {
+		if i%10 == 0 && i < N/2 {
+			names["x"+strconv.Itoa(i)] = true
+			continue
+		}
+		ts.Remove("x" + strconv.Itoa(i))
+	}
+
+	// while a client reads the directory, compaction only truncates
+	// the free tail, and the client's cookies stay valid
+	page := ts.clnt.ReadDirOp(root, 0, nfstypes.Cookieverf3{}, 512)
+	require.Equal(t, nfstypes.NFS3_OK, page.Status)
+	seen := make(map[string]bool)
+	var last *nfstypes.Entry3
+	for e := page.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+		seen[string(e.Name)] = true
+		last = e
+	}
+	assert.True(t, ts.clnt.srv.compactDir(common.ROOTINUM))
+	ts.clnt.srv.shrinkst.Wait()
+	assert.LessOrEqual(t, uint64(ts.GetattrDir(root).Size), sz/2)
+	reply := ts.clnt.ReadDirOp(root, last.Cookie, page.Resok.Cookieverf, 1<<20)
+	require.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.True(t, reply.Resok.Reply.Eof)
+	for e := reply.Resok.Reply.Entries; e != nil; e = e.Nextentry {
+		assert.False(t, seen[string(e.Name)], "%s twice", e.Name)
+		seen[string(e.Name)] = true
+	}
+	assert.Equal(t, names, seen)
+
+	// once no client has read it for READDIRGRACE, the compactor moves
+	// the entries, and old cookies are stale
+	st := ts.clnt.srv.compact
+	st.mu.Lock()
+	assert.True(t, st.pending[common.ROOTINUM])
+	st.read[common.ROOTINUM] = time.Now().Add(-2 * READDIRGRACE)
+	st.mu.Unlock()
+	ts.clnt.srv.compactPending()
+	ts.clnt.srv.shrinkst.Wait()
+	assert.Less(t, uint64(ts.GetattrDir(root).Size), sz/8)
+	reply = ts.clnt.ReadDirOp(root, last.Cookie, page.Resok.Cookieverf, 1024)
+	assert.Equal(t, nfstypes.NFS3ERR_BAD_COOKIE, reply.Status)
+	for name := range names {
+		ts.Lookup(name, true)
+	}
+	assert.Equal(t, names, ts.readDirAll(root, 1024))
+
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+	ts.clnt.srv = testNfs(d)
+}
+
+// Removing names queues their directory for the compactor
+func TestCompactor(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	for i := 0; i < 1000; i++ {
+		ts.Create("x" + strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i++ {
+		ts.Remove("x" + strconv.Itoa(i))
+	}
+	ts.clnt.srv.compact.mu.Lock()
+	assert.True(t, ts.clnt.srv.compact.pending[common.ROOTINUM])
+	ts.clnt.srv.compact.mu.Unlock()
+	ts.clnt.srv.compactPending()
+	assert.Equal(t, uint64(3*disk.BlockSize), uint64(ts.GetattrDir(fh.MkRootFh3()).Size))
+}
+
+// offsets in each of the index trees, the last in the triple-indirect
+// tree
+func treeOffsets() []uint64 {
+	bs := disk.BlockSize
+	dind := (inode.NDIRECT + inode.NBLKBLK) * bs
+	tind := dind + inode.NBLKBLK*inode.NBLKBLK*bs
+	return []uint64{0, inode.NDIRECT * bs, dind, dind + 1000*bs,
+		tind, tind + 12345*bs, inode.MaxFileSize(false) - bs}
+}
+
+// Files on VERSION1 file systems map their blocks with block pointers,
+// the last tree of which is triple indirect
+func TestTripleIndirect(t *testing.T) {
+	ts := newVersion1Test(t)
+	defer ts.Close()
+
+	max := inode.MaxFileSize(false)
+	reply := ts.clnt.FsinfoOp(fh.MkRootFh3())
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	assert.Equal(t, nfstypes.Size3(max), reply.Resok.Maxfilesize)
+	assert.Greater(t, max, uint64(1)<<39)
+
+	st0 := ts.Fsstat()
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ext, _ := ts.runs(x)
+	assert.False(t, ext)
+	offs := treeOffsets()
+	for i, off := range offs {
+		ts.WriteOff(x, off, mkdataval(byte(i+1), 4096), nfstypes.FILE_SYNC)
+	}
+	ts.Getattr(x, max)
+	for i, off := range offs {
+		ts.readcheck(x, off, mkdataval(byte(i+1), 4096))
+	}
+	wreply := ts.clnt.WriteOp(x, max, mkdata(1), nfstypes.FILE_SYNC)
+	assert.Equal(t, nfstypes.NFS3ERR_FBIG, wreply.Status)
+	sreply := ts.clnt.SetattrOp(x, max+1)
+	assert.Equal(t, nfstypes.NFS3ERR_FBIG, sreply.Status)
+
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+	ts.clnt.srv = testNfs(d)
+	for i, off := range offs {
+		ts.readcheck(x, off, mkdataval(byte(i+1), 4096))
+	}
+
+	// shrinking skips the holes
+	ts.Setattr(x, offs[3]+1)
+	ts.clnt.srv.shrinkst.Wait()
+	ts.readcheck(x, offs[2], mkdataval(3, 4096))
+	ts.Remove("x")
+	ts.clnt.srv.shrinkst.Wait()
+	st1 := ts.Fsstat()
+	assert.Equal(t, st0.Fbytes, st1.Fbytes)
+}
+
+// A crash while shrinking a large sparse file leaves the rest of the
+// shrinking to the next mount
+func TestTripleIndirectCrash(t *testing.T) {
+	ts := newVersion1Test(t)
+	defer ts.Close()
+
+	st0 := ts.Fsstat()
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	tind := treeOffsets()[4]
+	for i := uint64(0); i < 300; i++ {
+		off := tind + i*inode.NBLKBLK*inode.NBLKBLK*disk.BlockSize/3
+		ts.WriteOff(x, off, mkdataval(byte(i), 4096), nfstypes.FILE_SYNC)
+	}
+	ts.Remove("x")
+	ts.clnt.Crash()
+
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = testNfs(d)
+	ts.clnt.srv.shrinkst.Wait()
+	st1 := ts.Fsstat()
+	assert.Equal(t, st0.Fbytes, st1.Fbytes)
+	ts.clnt.Shutdown()
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+	ts.clnt.srv = testNfs(d)
+}
+
+// runs returns whether fh3 uses extents, and its number of runs of
+// contiguous blocks
+func (ts *TestState) runs(fh3 nfstypes.Nfs_fh3) (bool, uint64) {
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	ip := op.GetInodeFh(fh3)
+	ext, n := ip.UseExtents(), ip.NRuns(op.Atxn)
+	op.Abort()
+	return ext, n
+}
+
+func TestExtents(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	const N = 1024
+	sz := uint64(16 * 4096)
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	for i := uint64(0); i < N*4096/sz; i++ {
+		ts.WriteOff(x, i*sz, mkdataval(byte(i), sz), nfstypes.UNSTABLE)
+	}
+	ts.Commit(x, N*4096)
+	ext, n := ts.runs(x)
+	assert.True(t, ext)
+	assert.Equal(t, uint64(1), n)
+
+	// every other block, so that each is an extent, and the tree
+	// grows interior nodes
+	st0 := ts.Fsstat()
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	for i := uint64(0); i < 2*N; i += 2 {
+		ts.WriteOff(y, i*4096, mkdataval(byte(i), 4096), nfstypes.FILE_SYNC)
+	}
+	_, n = ts.runs(y)
+	assert.Equal(t, uint64(N), n)
+
+	ts.clnt.Shutdown()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+	ts.clnt.srv = testNfs(d)
+	for i := uint64(0); i < N*4096/sz; i++ {
+		ts.readcheck(x, i*sz, mkdataval(byte(i), sz))
+	}
+	for i := uint64(0); i < 2*N; i += 2 {
+		ts.readcheck(y, i*4096, mkdataval(byte(i), 4096))
+	}
+
+	ts.Setattr(y, N*4096+1)
+	ts.clnt.srv.shrinkst.Wait()
+	last := uint64(N - 2)
+	ts.readcheck(y, last*4096, mkdataval(byte(last), 4096))
+	_, n = ts.runs(y)
+	assert.Equal(t, uint64(N/2+1), n)
+	ts.Remove("y")
+	ts.clnt.srv.shrinkst.Wait()
+	st1 := ts.Fsstat()
+	assert.Equal(t, st0.Fbytes, st1.Fbytes)
+
+	ts.clnt.Shutdown()
+	kinds, _ = ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+	ts.clnt.srv = testNfs(d)
+}
+
+// New files on a VERSION1 file system map their blocks with block
+// pointers, which servers from before extents can read
+func TestExtentsOldFormat(t *testing.T) {
+	ts := newVersion1Test(t)
+	defer ts.Close()
+
+	ts.Create("p")
+	p := ts.Lookup("p", true)
+	for i := uint64(0); i < 100; i++ {
+		ts.WriteOff(p, i*4096, mkdataval(byte(i), 4096), nfstypes.UNSTABLE)
+	}
+	ts.Commit(p, 100*4096)
+	ext, _ := ts.runs(p)
+	assert.False(t, ext)
+	reply := ts.clnt.SymLinkOp(fh.MkRootFh3(), "l", "p")
+	assert.Equal(t, nfstypes.NFS3_OK, reply.Status)
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	ip := op.GetInodeFh(reply.Resok.Obj.Handle)
+	assert.Equal(t, uint32(0), ip.Flags)
+	op.Abort()
+
+	ts.clnt.Crash()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = testNfs(d)
+	for i := uint64(0); i < 100; i++ {
+		ts.readcheck(p, i*4096, mkdataval(byte(i), 4096))
+	}
+	ts.Setattr(p, 4096)
+	ts.clnt.Shutdown()
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+	ts.clnt.srv = testNfs(d)
+}
+
+func (ts *TestState) isInline(fh3 nfstypes.Nfs_fh3) bool {
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	ip := op.GetInodeFh(fh3)
+	inline := ip.IsInline()
+	op.Abort()
+	return inline
+}
+
+func TestInline(t *testing.T) {
+	ts := newTest(t)
+	defer ts.Close()
+
+	st0 := ts.Fsstat()
+	ts.Create("x")
+	x := ts.Lookup("x", true)
+	ts.Write(x, mkdataval(1, 10), nfstypes.FILE_SYNC)
+	short := "short/target"
+	ts.SymLink("s", short)
+	s := ts.Lookup("s", true)
+	long := string(mkdataval('l', inode.MAXINLINE+1))
+	ts.SymLink("l", long)
+	l := ts.Lookup("l", true)
+	assert.True(t, ts.isInline(x))
+	assert.True(t, ts.isInline(s))
+	assert.False(t, ts.isInline(l))
+	st1 := ts.Fsstat()
+	assert.Equal(t, uint64(st0.Fbytes)-disk.BlockSize, uint64(st1.Fbytes))
+	ts.readcheck(x, 0, mkdataval(1, 10))
+	assert.Equal(t, short, ts.ReadLink(s))
+	assert.Equal(t, long, ts.ReadLink(l))
+
+	// truncating zeroes what growing brings back
+	ts.Setattr(x, 5)
+	ts.Setattr(x, 20)
+	ts.readcheck(x, 0, append(mkdataval(1, 5), mkdataval(0, 15)...))
+	assert.True(t, ts.isInline(x))
+
+	// writing past MAXINLINE moves the contents to a block
+	ts.WriteOff(x, inode.MAXINLINE, mkdataval(2, 10), nfstypes.FILE_SYNC)
+	assert.False(t, ts.isInline(x))
+	ts.readcheck(x, 0, append(mkdataval(1, 5), mkdataval(0, inode.MAXINLINE-5)...))
+	ts.readcheck(x, inode.MAXINLINE, mkdataval(2, 10))
+
+	// and so does growing past it
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	ts.Write(y, mkdataval(3, 10), nfstypes.FILE_SYNC)
+	ts.Setattr(y, 8192)
+	assert.False(t, ts.isInline(y))
+	ts.readcheck(y, 0, append(mkdataval(3, 10), mkdataval(0, 8192-10)...))
+
+	ts.clnt.Crash()
+	d := ts.clnt.srv.fsstate.Super.Disk
+	ts.clnt.srv = testNfs(d)
+	ts.readcheck(x, inode.MAXINLINE, mkdataval(2, 10))
+	ts.readcheck(y, 0, mkdataval(3, 10))
+	assert.Equal(t, short, ts.ReadLink(s))
+	ts.Remove("x")
+	ts.Remove("y")
+	ts.Remove("s")
+	ts.Remove("l")
+	ts.clnt.srv.shrinkst.Wait()
+	st2 := ts.Fsstat()
+	assert.Equal(t, st0.Fbytes, st2.Fbytes)
+	ts.clnt.Shutdown()
+	kinds, _ := ts.fsckKinds(d, false)
+	assert.Empty(t, kinds)
+	ts.clnt.srv = testNfs(d)
+}
+
+// Growing an inline file past MAXINLINE fails with NOSPC, and leaves
+// the file alone, when there is no block for its contents
+func TestInlineNoSpace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	ts := newTest(t)
+	defer ts.Close()
+
+	ts.Create("y")
+	y := ts.Lookup("y", true)
+	ts.Write(y, mkdataval(3, 10), nfstypes.FILE_SYNC)
+	ts.maketoolargefile("x", 50)
+	ts.maketoolargefile("z", 1)
+
+	reply := ts.clnt.SetattrOp(y, 8192)
+	assert.Equal(t, nfstypes.NFS3ERR_NOSPC, reply.Status)
+	op := fstxn.Begin(ts.clnt.srv.fsstate)
+	ip := op.GetInodeFh(y)
+	shrink, ok := ip.Resize(op.Atxn, 8192)
+	assert.False(t, shrink)
+	assert.False(t, ok)
+	assert.True(t, ip.IsInline())
+	assert.Equal(t, uint64(10), ip.Size)
+	op.Abort()
+	ts.readcheck(y, 0, mkdataval(3, 10))
+
+	ts.Remove("x")
+	ts.clnt.srv.shrinkst.Wait()
+	ts.Setattr(y, 8192)
+	assert.False(t, ts.isInline(y))
+	ts.readcheck(y, 0, append(mkdataval(3, 10), mkdataval(0, 8192-10)...))
+}
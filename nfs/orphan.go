@@ -0,0 +1,291 @@
+package nfs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mit-pdos/go-journal/common"
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/fh"
+	"github.com/mit-pdos/go-nfsd/fstxn"
+	"github.com/mit-pdos/go-nfsd/inode"
+	"github.com/mit-pdos/go-nfsd/nfstypes"
+)
+
+//
+// Orphans.  NFS has no open, so the server can't tell whether a client
+// still uses a file whose last name was removed.  Instead of freeing
+// such a file right away, doDecLink keeps it as an orphan if a client
+// used its file handle within the grace period.  Orphans are on a list
+// on disk, chained through the inodes' Next fields, with its head in
+// the unused inode 0; the reaper frees an orphan once no client has
+// used it for the grace period, and opening the file system frees the
+// orphans left from before.
+//
+// Updating the list locks inode 0 after the inodes of the operation,
+// out of lock order.  This can't deadlock because no operation waits
+// for another inode while it holds inode 0: keepOrphan locks it last,
+// at the end of REMOVE or RENAME, and freeOrphan finds the orphan
+// before the one it frees without holding inode 0, and then locks the
+// two orphans before inode 0.
+//
+// Every operation on a file handle records its use, so the uses are in
+// NUSESHARD maps, each with its own lock, and a use within grace/2 of
+// the recorded one isn't recorded.  A recorded use may thus be up to
+// grace/2 old, and an orphan stays until no use is recorded for
+// grace+grace/2, so that it stays usable for at least grace after its
+// last use.
+//
+
+const REAPINTERVAL = time.Second
+
+// DEFORPHANGRACE is how long an orphan stays usable, unless the server
+// sets another grace period
+const DEFORPHANGRACE = time.Minute
+
+const NUSESHARD = 64
+
+type useShard struct {
+	mu   *sync.Mutex
+	last map[common.Inum]time.Time // last use through a file handle
+}
+
+type orphanSt struct {
+	grace    int64 // a time.Duration; atomic, since touch reads it
+	uses     []*useShard
+	mu       *sync.Mutex
+	unlinked map[common.Inum]time.Time // when each orphan lost its last name
+	done     chan struct{}
+	wg       *sync.WaitGroup
+}
+
+func mkOrphanSt() *orphanSt {
+	st := &orphanSt{
+		grace:    int64(DEFORPHANGRACE),
+		uses:     make([]*useShard, NUSESHARD),
+		mu:       new(sync.Mutex),
+		unlinked: make(map[common.Inum]time.Time),
+		done:     make(chan struct{}),
+		wg:       new(sync.WaitGroup),
+	}
+	for i := range st.uses {
+		st.uses[i] = &useShard{mu: new(sync.Mutex),
+			last: make(map[common.Inum]time.Time)}
+	}
+	return st
+}
+
+func (st *orphanSt) getGrace() time.Duration {
+	return time.Duration(atomic.LoadInt64(&st.grace))
+}
+
+func (st *orphanSt) shard(inum common.Inum) *useShard {
+	return st.uses[uint64(inum)%NUSESHARD]
+}
+
+// lastUse returns the recorded last use of inum
+func (st *orphanSt) lastUse(inum common.Inum) (time.Time, bool) {
+	sh := st.shard(inum)
+	sh.mu.Lock()
+	t, ok := sh.last[inum]
+	sh.mu.Unlock()
+	return t, ok
+}
+
+// expired reports whether a file last used at last, as recorded, may
+// be freed at now
+func (st *orphanSt) expired(last time.Time, now time.Time) bool {
+	grace := st.getGrace()
+	return now.Sub(last) >= grace+grace/2
+}
+
+// SetOrphanGrace sets how long a file stays usable through its file
+// handle after its last name is removed, counting from the last use.
+// 0 frees files as soon as their last name is removed.
+func (nfs *Nfs) SetOrphanGrace(grace time.Duration) {
+	atomic.StoreInt64(&nfs.orphans.grace, int64(grace))
+}
+
+// touch records that a client used fh3
+func (nfs *Nfs) touch(fh3 nfstypes.Nfs_fh3) {
+	st := nfs.orphans
+	grace := st.getGrace()
+	if grace == 0 {
+		return
+	}
+	inum := fh.MakeFh(fh3).Ino
+	now := time.Now()
+	sh := st.shard(inum)
+	sh.mu.Lock()
+	t, ok := sh.last[inum]
+	if !ok || now.Sub(t) >= grace/2 {
+		sh.last[inum] = now
+	}
+	sh.mu.Unlock()
+}
+
+// keepOrphan puts ip, whose last name op removed, on the orphan list if
+// a client used it recently, and reports whether it did
+func (nfs *Nfs) keepOrphan(op *fstxn.FsTxn, ip *inode.Inode) bool {
+	if nfs.fsstate.Super.Legacy() || ip.Kind == nfstypes.NF3DIR ||
+		op.OwnInum(common.NULLINUM) {
+		return false
+	}
+	st := nfs.orphans
+	now := time.Now()
+	last, ok := st.lastUse(ip.Inum)
+	if !ok || st.expired(last, now) {
+		return false
+	}
+
+	head := op.GetInodeInumFree(common.NULLINUM)
+	ip.Next = head.Next
+	head.Next = ip.Inum
+	ip.WriteInode(op.Atxn)
+	head.WriteInode(op.Atxn)
+	util.DPrintf(1, "keepOrphan # %d\n", ip.Inum)
+
+	st.mu.Lock()
+	st.unlinked[ip.Inum] = now
+	st.mu.Unlock()
+	return true
+}
+
+// freeOrphan takes inum off the orphan list and frees it.  It returns
+// false if inum isn't on the list.
+func (nfs *Nfs) freeOrphan(inum common.Inum) bool {
+	for {
+		prev, ok := nfs.orphanPrev(inum)
+		if !ok {
+			return false
+		}
+		op := fstxn.Begin(nfs.fsstate)
+		var pip *inode.Inode
+		if prev != common.NULLINUM && prev < inum {
+			pip = op.GetInodeInumFree(prev)
+		}
+		ip := op.GetInodeInumFree(inum)
+		if prev > inum {
+			pip = op.GetInodeInumFree(prev)
+		}
+		head := op.GetInodeInumFree(common.NULLINUM)
+		if prev == common.NULLINUM {
+			pip = head
+		}
+		// the list changed since orphanPrev looked
+		if pip.Next != inum {
+			op.Abort()
+			continue
+		}
+		pip.Next = ip.Next
+		pip.WriteInode(op.Atxn)
+		ip.Next = common.NULLINUM
+		// truncating needs no block, so it can't fail
+		shrink, _ := ip.Resize(op.Atxn, 0)
+		ip.FreeInode(op.Atxn)
+		if !op.Commit() {
+			return false
+		}
+		util.DPrintf(1, "freeOrphan # %d\n", inum)
+		if shrink {
+			nfs.shrinkst.StartShrinker(inum)
+		}
+		return true
+	}
+}
+
+// orphanPrev returns the inode before inum on the orphan list (inode 0
+// if inum is first), and false if inum isn't on the list.  It reads
+// the list one inode at a time, so that it holds none while it waits.
+func (nfs *Nfs) orphanPrev(inum common.Inum) (common.Inum, bool) {
+	var prev = common.NULLINUM
+	for i := common.Inum(0); i < nfs.fsstate.Super.NInode(); i++ {
+		op := fstxn.Begin(nfs.fsstate)
+		next := op.GetInodeInumFree(prev).Next
+		op.Abort()
+		if next == inum {
+			return prev, true
+		}
+		if next == common.NULLINUM {
+			break
+		}
+		prev = next
+	}
+	return common.NULLINUM, false
+}
+
+// freeOrphans frees all orphans on the list, which no client can be
+// using when the file system has just been opened
+func (nfs *Nfs) freeOrphans() {
+	for {
+		op := fstxn.Begin(nfs.fsstate)
+		head := op.GetInodeInumFree(common.NULLINUM)
+		next := head.Next
+		op.Abort()
+		if next == common.NULLINUM || !nfs.freeOrphan(next) {
+			break
+		}
+	}
+}
+
+// reapOrphans frees the orphans that no client has used for the grace
+// period as of now, and forgets uses older than that
+func (nfs *Nfs) reapOrphans(now time.Time) {
+	st := nfs.orphans
+	var expired []common.Inum
+	st.mu.Lock()
+	for inum, t := range st.unlinked {
+		last := t
+		if a, ok := st.lastUse(inum); ok && a.After(last) {
+			last = a
+		}
+		if st.expired(last, now) {
+			expired = append(expired, inum)
+		}
+	}
+	st.mu.Unlock()
+	for _, sh := range st.uses {
+		sh.mu.Lock()
+		for inum, t := range sh.last {
+			if st.expired(t, now) {
+				delete(sh.last, inum)
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	for _, inum := range expired {
+		nfs.freeOrphan(inum)
+		st.mu.Lock()
+		delete(st.unlinked, inum)
+		st.mu.Unlock()
+		sh := st.shard(inum)
+		sh.mu.Lock()
+		delete(sh.last, inum)
+		sh.mu.Unlock()
+	}
+}
+
+func (nfs *Nfs) startReaper() {
+	st := nfs.orphans
+	st.wg.Add(1)
+	go func() {
+		defer st.wg.Done()
+		t := time.NewTicker(REAPINTERVAL)
+		defer t.Stop()
+		for {
+			select {
+			case <-st.done:
+				return
+			case now := <-t.C:
+				nfs.reapOrphans(now)
+			}
+		}
+	}()
+}
+
+func (nfs *Nfs) stopReaper() {
+	close(nfs.orphans.done)
+	nfs.orphans.wg.Wait()
+}
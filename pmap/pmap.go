@@ -0,0 +1,124 @@
+package pmap
+
+//
+// pmap is a portmapper (RFC 1057, appendix A), for running go-nfsd where
+// there is no rpcbind.  It keeps its mappings in memory.  Only callers
+// on this host may SET and UNSET mappings.  CALLIT isn't supported: it
+// returns port 0 and no results.
+//
+
+import (
+	"net"
+	"sync"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+
+	"github.com/mit-pdos/go-journal/util"
+	"github.com/mit-pdos/go-nfsd/rpcsrv"
+)
+
+type Pmap struct {
+	mu   *sync.Mutex
+	maps []rfc1057.Mapping
+}
+
+// MkPmap makes a portmapper that maps itself to port on prots
+func MkPmap(port uint32, prots []uint32) *Pmap {
+	pm := &Pmap{mu: new(sync.Mutex)}
+	for _, prot := range prots {
+		pm.PMAPPROC_SET(rfc1057.Mapping{Prog: rfc1057.PMAP_PROG,
+			Vers: rfc1057.PMAP_VERS, Prot: prot, Port: port})
+	}
+	return pm
+}
+
+// Register registers the portmapper's procedures with srv.  SET and
+// UNSET from another host return false without changing the mappings.
+func (pm *Pmap) Register(srv *rpcsrv.Server) {
+	for _, r := range rfc1057.PMAP_PROG_PMAP_VERS_regs(pm) {
+		h := r.Handler
+		local := r.Proc == rfc1057.PMAPPROC_SET || r.Proc == rfc1057.PMAPPROC_UNSET
+		srv.Register(r.Prog, r.Vers, r.Proc,
+			func(call *rpcsrv.Call, args *xdr.XdrState) (xdr.Xdrable, error) {
+				if local && !isLoopback(call.Host) {
+					util.DPrintf(1, "PMAP proc %d from %q refused\n",
+						call.Proc, call.Host)
+					ok := rfc1057.Xbool(false)
+					return &ok, nil
+				}
+				return h(args)
+			})
+	}
+}
+
+// isLoopback reports whether host is a loopback address
+func isLoopback(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (pm *Pmap) PMAPPROC_NULL() {
+}
+
+// PMAPPROC_SET maps m's program, version, and protocol to m's port,
+// unless they are mapped already
+func (pm *Pmap) PMAPPROC_SET(m rfc1057.Mapping) rfc1057.Xbool {
+	util.DPrintf(1, "PMAP Set %v\n", m)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, o := range pm.maps {
+		if o.Prog == m.Prog && o.Vers == m.Vers && o.Prot == m.Prot {
+			return false
+		}
+	}
+	pm.maps = append(pm.maps, m)
+	return true
+}
+
+// PMAPPROC_UNSET removes the mappings of m's program and version, for
+// any protocol and port
+func (pm *Pmap) PMAPPROC_UNSET(m rfc1057.Mapping) rfc1057.Xbool {
+	util.DPrintf(1, "PMAP Unset %v\n", m)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var keep []rfc1057.Mapping
+	for _, o := range pm.maps {
+		if o.Prog != m.Prog || o.Vers != m.Vers {
+			keep = append(keep, o)
+		}
+	}
+	found := len(keep) < len(pm.maps)
+	pm.maps = keep
+	return rfc1057.Xbool(found)
+}
+
+// PMAPPROC_GETPORT returns the port of m's program, version, and
+// protocol, or 0 if they aren't mapped
+func (pm *Pmap) PMAPPROC_GETPORT(m rfc1057.Mapping) rfc1057.Uint32 {
+	util.DPrintf(1, "PMAP GetPort %v\n", m)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, o := range pm.maps {
+		if o.Prog == m.Prog && o.Vers == m.Vers && o.Prot == m.Prot {
+			return rfc1057.Uint32(o.Port)
+		}
+	}
+	return 0
+}
+
+// PMAPPROC_DUMP returns all mappings, in the order they were set
+func (pm *Pmap) PMAPPROC_DUMP() rfc1057.Pmaplist {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var l rfc1057.Pmaplist
+	for i := len(pm.maps) - 1; i >= 0; i-- {
+		l = rfc1057.Pmaplist{P: &rfc1057.Pmaplistelem{Map: pm.maps[i], Next: l}}
+	}
+	return l
+}
+
+func (pm *Pmap) PMAPPROC_CALLIT(args rfc1057.Call_args) rfc1057.Call_result {
+	util.DPrintf(1, "PMAP Callit %d %d %d unsupported\n", args.Prog, args.Vers, args.Proc)
+	return rfc1057.Call_result{}
+}
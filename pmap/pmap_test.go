@@ -0,0 +1,105 @@
+package pmap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+
+	"github.com/mit-pdos/go-nfsd/rpcsrv"
+)
+
+func TestPmap(t *testing.T) {
+	srv := rpcsrv.MakeServer()
+	MkPmap(rfc1057.PMAP_PORT, []uint32{rfc1057.IPPROTO_TCP}).Register(srv)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no TCP: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.Run(conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	clnt := rfc1057.MakeClient(conn, rfc1057.PMAP_PROG, rfc1057.PMAP_VERS)
+	none := rfc1057.Opaque_auth{Flavor: rfc1057.AUTH_NONE}
+
+	call := func(proc uint32, m rfc1057.Mapping, res xdr.Xdrable) {
+		err := clnt.Call(proc, none, none, &m, res)
+		assert.Nil(t, err)
+	}
+	getport := func(prog, vers, prot uint32) uint32 {
+		var port rfc1057.Uint32
+		call(rfc1057.PMAPPROC_GETPORT,
+			rfc1057.Mapping{Prog: prog, Vers: vers, Prot: prot}, &port)
+		return uint32(port)
+	}
+
+	tcp := rfc1057.Mapping{Prog: 100003, Vers: 3, Prot: rfc1057.IPPROTO_TCP, Port: 2049}
+	udp := tcp
+	udp.Prot = rfc1057.IPPROTO_UDP
+	var ok rfc1057.Xbool
+	call(rfc1057.PMAPPROC_SET, tcp, &ok)
+	assert.True(t, bool(ok))
+	call(rfc1057.PMAPPROC_SET, udp, &ok)
+	assert.True(t, bool(ok))
+	tcp.Port = 2050
+	call(rfc1057.PMAPPROC_SET, tcp, &ok)
+	assert.False(t, bool(ok), "already mapped")
+
+	assert.Equal(t, uint32(2049), getport(100003, 3, rfc1057.IPPROTO_TCP))
+	assert.Equal(t, uint32(2049), getport(100003, 3, rfc1057.IPPROTO_UDP))
+	assert.Equal(t, uint32(0), getport(100003, 2, rfc1057.IPPROTO_TCP))
+	assert.Equal(t, rfc1057.PMAP_PORT,
+		getport(rfc1057.PMAP_PROG, rfc1057.PMAP_VERS, rfc1057.IPPROTO_TCP))
+
+	var pl rfc1057.Pmaplist
+	err = clnt.Call(rfc1057.PMAPPROC_DUMP, none, none, &xdr.Void{}, &pl)
+	assert.Nil(t, err)
+	var maps []rfc1057.Mapping
+	for e := pl.P; e != nil; e = e.Next.P {
+		maps = append(maps, e.Map)
+	}
+	assert.Equal(t, 3, len(maps))
+	assert.Equal(t, rfc1057.PMAP_PROG, maps[0].Prog)
+	assert.Equal(t, udp, maps[2])
+
+	// UNSET removes the mappings for all protocols
+	call(rfc1057.PMAPPROC_UNSET, rfc1057.Mapping{Prog: 100003, Vers: 3}, &ok)
+	assert.True(t, bool(ok))
+	assert.Equal(t, uint32(0), getport(100003, 3, rfc1057.IPPROTO_TCP))
+	assert.Equal(t, uint32(0), getport(100003, 3, rfc1057.IPPROTO_UDP))
+	call(rfc1057.PMAPPROC_UNSET, rfc1057.Mapping{Prog: 100003, Vers: 3}, &ok)
+	assert.False(t, bool(ok))
+
+	// a caller on another host may look up mappings, but not change
+	// them; a pipe has no address, so it counts as one
+	call(rfc1057.PMAPPROC_SET, tcp, &ok)
+	assert.True(t, bool(ok))
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go srv.Run(c2)
+	remote := rfc1057.MakeClient(c1, rfc1057.PMAP_PROG, rfc1057.PMAP_VERS)
+	udp.Port = 2051
+	err = remote.Call(rfc1057.PMAPPROC_SET, none, none, &udp, &ok)
+	assert.Nil(t, err)
+	assert.False(t, bool(ok))
+	err = remote.Call(rfc1057.PMAPPROC_UNSET, none, none, &tcp, &ok)
+	assert.Nil(t, err)
+	assert.False(t, bool(ok))
+	var port rfc1057.Uint32
+	err = remote.Call(rfc1057.PMAPPROC_GETPORT, none, none, &tcp, &port)
+	assert.Nil(t, err)
+	assert.Equal(t, rfc1057.Uint32(tcp.Port), port)
+	assert.Equal(t, uint32(0), getport(100003, 3, rfc1057.IPPROTO_UDP))
+}
@@ -0,0 +1,150 @@
+package rpcsrv
+
+//
+// Duplicate request cache.  A client that doesn't get a reply in time
+// retransmits the call with the same xid, and running a call such as
+// REMOVE twice fails the second time, though the first one worked.  The
+// DRC keeps the replies of the last calls to procedures registered as
+// non-idempotent, keyed by the caller's host, xid, and procedure, and
+// replays the reply to a retransmission instead of running it again.  A
+// retransmission that arrives while the call still runs waits for its
+// reply.  The cache holds at most max replies, evicting the least
+// recently used.
+//
+
+import (
+	"container/list"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+)
+
+type drcKey struct {
+	host string
+	xid  uint32
+	prog uint32
+	vers uint32
+	proc uint32
+}
+
+type drcEntry struct {
+	key   drcKey
+	sum   uint32        // of the call, in case the xid is reused
+	reply []byte        // without the record mark; nil until done
+	done  chan struct{} // closed when the call is done
+	elem  *list.Element
+}
+
+type DRC struct {
+	mu      *sync.Mutex
+	max     int
+	entries map[drcKey]*drcEntry
+	lru     *list.List // of *drcEntry, most recently used first
+	hits    uint64
+	misses  uint64
+}
+
+// MkDRC makes a cache of at most max replies
+func MkDRC(max int) *DRC {
+	return &DRC{
+		mu:      new(sync.Mutex),
+		max:     max,
+		entries: make(map[drcKey]*drcEntry),
+		lru:     list.New(),
+	}
+}
+
+// hostOf returns the host of addr, since a client that reconnects to
+// retransmit may do so from another port
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// start looks up a call.  If it is a retransmission, start waits for
+// the first call to be done and returns its reply; otherwise it returns
+// nil and an entry, for finish to fill in.
+func (c *DRC) start(key drcKey, call []byte) ([]byte, *drcEntry) {
+	sum := crc32.ChecksumIEEE(call)
+	c.mu.Lock()
+	for {
+		e, ok := c.entries[key]
+		if !ok || e.sum != sum {
+			break
+		}
+		c.lru.MoveToFront(e.elem)
+		c.mu.Unlock()
+		<-e.done
+		c.mu.Lock()
+		if e.reply != nil {
+			c.hits++
+			c.mu.Unlock()
+			return e.reply, nil
+		}
+		// the first call failed, and finish removed it; look again,
+		// since another retransmission may be running the call by now
+	}
+	c.misses++
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+	e := &drcEntry{key: key, sum: sum, done: make(chan struct{})}
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back().Value.(*drcEntry))
+	}
+	c.mu.Unlock()
+	return nil, e
+}
+
+// finish records the reply to e's call, nil if it failed
+func (c *DRC) finish(e *drcEntry, reply []byte) {
+	c.mu.Lock()
+	if reply == nil {
+		c.remove(e)
+	} else {
+		e.reply = append([]byte{}, reply...)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// remove drops e, which finish and eviction may both try to drop
+func (c *DRC) remove(e *drcEntry) {
+	if c.entries[e.key] == e {
+		delete(c.entries, e.key)
+	}
+	if e.elem != nil {
+		c.lru.Remove(e.elem)
+		e.elem = nil
+	}
+}
+
+// Stats returns the number of retransmissions the cache replayed a
+// reply to, and of calls that ran
+func (c *DRC) Stats() (uint64, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *DRC) WriteStats(w io.Writer) {
+	hits, misses := c.Stats()
+	fmt.Fprintf(w, "drc: %d hits %d misses\n", hits, misses)
+}
+
+func (c *DRC) ResetStats() {
+	c.mu.Lock()
+	c.hits = 0
+	c.misses = 0
+	c.mu.Unlock()
+}
@@ -0,0 +1,50 @@
+package rpcsrv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Retransmissions that wait on a call that fails run it once between
+// them, and leave the cache consistent
+func TestDRCFailedCall(t *testing.T) {
+	c := MkDRC(1)
+	key := drcKey{host: "h", xid: 1}
+	call := []byte("call")
+	_, e := c.start(key, call)
+
+	type result struct {
+		reply []byte
+		e     *drcEntry
+	}
+	results := make(chan result)
+	for i := 0; i < 2; i++ {
+		go func() {
+			reply, e := c.start(key, call)
+			results <- result{reply, e}
+		}()
+	}
+	// let both wait on the first call
+	time.Sleep(100 * time.Millisecond)
+	c.finish(e, nil)
+
+	// one of them runs the call, and the other gets its reply
+	r := <-results
+	assert.Nil(t, r.reply)
+	assert.NotNil(t, r.e)
+	c.finish(r.e, []byte("reply"))
+	r = <-results
+	assert.Equal(t, []byte("reply"), r.reply)
+	hits, misses := c.Stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(2), misses)
+	assert.Equal(t, len(c.entries), c.lru.Len())
+
+	// evicting works
+	_, e = c.start(drcKey{host: "h", xid: 2}, call)
+	c.finish(e, []byte("reply2"))
+	assert.Equal(t, 1, c.lru.Len())
+	assert.Equal(t, 1, len(c.entries))
+}
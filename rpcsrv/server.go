@@ -0,0 +1,235 @@
+package rpcsrv
+
+//
+// rpcsrv is an ONC RPC (RFC 1057) server.  Unlike the rfc1057 server,
+// it passes each call's header, including the caller's credential, to
+// the procedure handler.
+//
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+)
+
+// Call is the header of an incoming call
+type Call struct {
+	Xid  uint32
+	Prog uint32
+	Vers uint32
+	Proc uint32
+	Cred rfc1057.Opaque_auth
+	// the caller's host, or "" if the connection has no address
+	Host string
+	// arrived in a datagram, so the reply must fit in MAXDATAGRAM bytes
+	Datagram bool
+}
+
+type ProcHandler func(call *Call, args *xdr.XdrState) (res xdr.Xdrable, err error)
+
+type Server struct {
+	handlers map[uint32]map[uint32]map[uint32]ProcHandler
+	// procedures whose replies the drc keeps
+	nonIdempotent map[drcKey]bool
+	drc           *DRC
+}
+
+// reqBufPool holds buffers for incoming requests
+var reqBufPool sync.Pool
+
+func getReqBuf(buflen int) []byte {
+	bufi := reqBufPool.Get()
+	if bufi != nil {
+		buf := bufi.([]byte)
+		if buflen <= cap(buf) {
+			return buf[:buflen]
+		}
+	}
+	return make([]byte, buflen)
+}
+
+func putReqBuf(buf []byte) {
+	reqBufPool.Put(buf)
+}
+
+func MakeServer() *Server {
+	return &Server{
+		handlers:      make(map[uint32]map[uint32]map[uint32]ProcHandler),
+		nonIdempotent: make(map[drcKey]bool),
+	}
+}
+
+// SetDRC makes s replay the replies that drc keeps to retransmitted
+// calls of non-idempotent procedures
+func (s *Server) SetDRC(drc *DRC) {
+	s.drc = drc
+}
+
+// NonIdempotent marks a procedure as one that fails or does something
+// else if it runs again, so that the DRC keeps its replies
+func (s *Server) NonIdempotent(prog, vers, proc uint32) {
+	s.nonIdempotent[drcKey{prog: prog, vers: vers, proc: proc}] = true
+}
+
+func (s *Server) Register(prog, vers, proc uint32, handler ProcHandler) {
+	_, progok := s.handlers[prog]
+	if !progok {
+		s.handlers[prog] = make(map[uint32]map[uint32]ProcHandler)
+	}
+	_, versok := s.handlers[prog][vers]
+	if !versok {
+		s.handlers[prog][vers] = make(map[uint32]ProcHandler)
+	}
+	s.handlers[prog][vers][proc] = handler
+}
+
+// RegisterMany registers handlers that don't care about the call header,
+// such as those generated by go-rpcgen.
+func (s *Server) RegisterMany(regs []xdr.ProcRegistration) {
+	for _, r := range regs {
+		h := r.Handler
+		s.Register(r.Prog, r.Vers, r.Proc,
+			func(call *Call, args *xdr.XdrState) (xdr.Xdrable, error) {
+				return h(args)
+			})
+	}
+}
+
+// Run serves the calls arriving on rw, a stream connection, until it
+// fails.  Calls run concurrently.
+func (s *Server) Run(rw io.ReadWriter) error {
+	var host = ""
+	if c, ok := rw.(net.Conn); ok {
+		host = hostOf(c.RemoteAddr())
+	}
+	for {
+		var hdr [4]byte
+		_, err := io.ReadFull(rw, hdr[:])
+		if err != nil {
+			return err
+		}
+		hlen := binary.BigEndian.Uint32(hdr[:])
+		if hlen&(1<<31) == 0 {
+			return fmt.Errorf("fragments not supported")
+		}
+		buf := getReqBuf(int(hlen & 0x7fffffff))
+		_, err = io.ReadFull(rw, buf)
+		if err != nil {
+			return err
+		}
+		go s.serveStream(rw, buf, host)
+	}
+}
+
+func (s *Server) serveStream(w io.Writer, buf []byte, host string) {
+	defer putReqBuf(buf)
+	// reserve 4 bytes at the front for the record mark
+	reply, err := s.handle(buf, make([]byte, 4), host, false)
+	if err == nil {
+		binary.BigEndian.PutUint32(reply[0:4], (1<<31)|uint32(len(reply)-4))
+		_, err = w.Write(reply)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// handle runs the call in buf, from host, and returns the reply,
+// appended to prefix
+func (s *Server) handle(buf []byte, prefix []byte, host string, datagram bool) ([]byte, error) {
+	rd := xdr.MakeReader(buf)
+	var req rfc1057.Rpc_msg
+	req.Xdr(rd)
+	err := rd.Error()
+	if err != nil {
+		return nil, err
+	}
+	if req.Body.Mtype != rfc1057.CALL {
+		return nil, fmt.Errorf("request mtype %d != CALL", req.Body.Mtype)
+	}
+
+	cbody := &req.Body.Cbody
+	key := drcKey{prog: cbody.Prog, vers: cbody.Vers, proc: cbody.Proc}
+	if s.drc == nil || !s.nonIdempotent[key] {
+		return s.reply(&req, rd, prefix, host, datagram)
+	}
+	key.host = host
+	key.xid = req.Xid
+	cached, e := s.drc.start(key, buf)
+	if cached != nil {
+		return append(prefix, cached...), nil
+	}
+	reply, err := s.reply(&req, rd, prefix, host, datagram)
+	if err != nil {
+		s.drc.finish(e, nil)
+	} else {
+		s.drc.finish(e, reply[len(prefix):])
+	}
+	return reply, err
+}
+
+// reply runs req, from host, whose arguments are in rd, and returns the
+// reply, appended to prefix
+func (s *Server) reply(req *rfc1057.Rpc_msg, rd *xdr.XdrState, prefix []byte,
+	host string, datagram bool) ([]byte, error) {
+	var res rfc1057.Rpc_msg
+	var resdata xdr.Xdrable
+	res.Xid = req.Xid
+	res.Body.Mtype = rfc1057.REPLY
+	cbody := &req.Body.Cbody
+	if cbody.Rpcvers != 2 {
+		res.Body.Rbody.Stat = rfc1057.MSG_DENIED
+		res.Body.Rbody.Rreply.Stat = rfc1057.RPC_MISMATCH
+		res.Body.Rbody.Rreply.Mismatch_info.Low = 2
+		res.Body.Rbody.Rreply.Mismatch_info.High = 2
+	} else {
+		res.Body.Rbody.Stat = rfc1057.MSG_ACCEPTED
+		res.Body.Rbody.Areply.Reply_data.Stat = s.dispatch(&Call{
+			Xid:      req.Xid,
+			Prog:     cbody.Prog,
+			Vers:     cbody.Vers,
+			Proc:     cbody.Proc,
+			Cred:     cbody.Cred,
+			Host:     host,
+			Datagram: datagram,
+		}, rd, &resdata)
+	}
+
+	wr := xdr.MakeWriter(prefix)
+	res.Xdr(wr)
+	if resdata != nil {
+		resdata.Xdr(wr)
+	}
+	err := wr.Error()
+	if err != nil {
+		return nil, err
+	}
+	return wr.WriteBuf(), nil
+}
+
+func (s *Server) dispatch(call *Call, args *xdr.XdrState, resdata *xdr.Xdrable) rfc1057.Accept_stat {
+	vermap, progok := s.handlers[call.Prog]
+	if !progok {
+		return rfc1057.PROG_UNAVAIL
+	}
+	procmap, verok := vermap[call.Vers]
+	if !verok {
+		return rfc1057.PROG_MISMATCH
+	}
+	h, procok := procmap[call.Proc]
+	if !procok {
+		return rfc1057.PROC_UNAVAIL
+	}
+	res, err := h(call, args)
+	if err != nil {
+		return rfc1057.GARBAGE_ARGS
+	}
+	*resdata = res
+	return rfc1057.SUCCESS
+}
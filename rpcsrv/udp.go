@@ -0,0 +1,92 @@
+package rpcsrv
+
+//
+// RPC over UDP.  Each datagram holds one call, without a record mark,
+// and the reply goes back in one datagram to the address the call came
+// from.  Clients retransmit calls that they get no reply to, so with a
+// DRC a retransmitted non-idempotent call gets the first call's reply.
+//
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/zeldovich/go-rpcgen/rfc1057"
+	"github.com/zeldovich/go-rpcgen/xdr"
+)
+
+// MAXDATAGRAM is the largest reply that fits in a UDP datagram over IPv4
+const MAXDATAGRAM = 65535 - 20 - 8
+
+// SYSTEM_ERR is the accept_stat, added after RFC 1057, for a server
+// that fails to run a call for a reason other than its arguments
+const SYSTEM_ERR rfc1057.Accept_stat = 5
+
+// datagramPool holds buffers for incoming datagrams, all MAXDATAGRAM+1
+// bytes, apart from reqBufPool, whose buffers fit the TCP calls they
+// held
+var datagramPool sync.Pool
+
+func getDatagramBuf() []byte {
+	bufi := datagramPool.Get()
+	if bufi != nil {
+		return bufi.([]byte)
+	}
+	return make([]byte, MAXDATAGRAM+1)
+}
+
+func putDatagramBuf(buf []byte) {
+	datagramPool.Put(buf[:cap(buf)])
+}
+
+// RunUDP serves the calls arriving on conn, a datagram connection, until
+// it fails.  Calls run concurrently.
+func (s *Server) RunUDP(conn net.PacketConn) error {
+	for {
+		// one byte more than a call may have, to catch truncated ones
+		buf := getDatagramBuf()
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			putDatagramBuf(buf)
+			return err
+		}
+		if n > MAXDATAGRAM {
+			putDatagramBuf(buf)
+			fmt.Fprintf(os.Stderr, "rpcsrv: dropping %d-byte datagram from %v\n", n, addr)
+			continue
+		}
+		go s.serveDatagram(conn, addr, buf[:n])
+	}
+}
+
+func (s *Server) serveDatagram(conn net.PacketConn, addr net.Addr, buf []byte) {
+	defer putDatagramBuf(buf)
+	reply, err := s.handle(buf, nil, hostOf(addr), true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rpcsrv: datagram from %v: %v\n", addr, err)
+		return
+	}
+	if len(reply) > MAXDATAGRAM {
+		// let the client know instead of leaving it to retransmit
+		reply = systemErr(binary.BigEndian.Uint32(buf[0:4]))
+	}
+	_, err = conn.WriteTo(reply, addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rpcsrv: reply to %v: %v\n", addr, err)
+	}
+}
+
+// systemErr returns a reply to call xid that says the server failed
+func systemErr(xid uint32) []byte {
+	var res rfc1057.Rpc_msg
+	res.Xid = xid
+	res.Body.Mtype = rfc1057.REPLY
+	res.Body.Rbody.Stat = rfc1057.MSG_ACCEPTED
+	res.Body.Rbody.Areply.Reply_data.Stat = SYSTEM_ERR
+	wr := xdr.MakeWriter(nil)
+	res.Xdr(wr)
+	return wr.WriteBuf()
+}
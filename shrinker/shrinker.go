@@ -8,12 +8,17 @@ import (
 	"github.com/mit-pdos/go-nfsd/fstxn"
 )
 
+// NRESUMER is the number of threads that resume the shrinks that were
+// in progress when the server stopped
+const NRESUMER = 4
+
 type ShrinkerSt struct {
 	mu       *sync.Mutex
 	condShut *sync.Cond
 	nthread  uint32
 	fsstate  *fstxn.FsState
 	crash    bool
+	resume   []common.Inum // for the resumers to shrink
 }
 
 func MkShrinkerSt(st *fstxn.FsState) *ShrinkerSt {
@@ -69,6 +74,19 @@ func (shrinker *ShrinkerSt) Shutdown() {
 	shrinker.mu.Unlock()
 }
 
+// Wait for running shrinker threads to finish, for example, to free up
+// space.  Returns false if no threads were running.
+func (shrinker *ShrinkerSt) Wait() bool {
+	shrinker.mu.Lock()
+	running := shrinker.nthread > 0
+	for shrinker.nthread > 0 {
+		util.DPrintf(1, "Wait: shrinker wait %d\n", shrinker.nthread)
+		shrinker.condShut.Wait()
+	}
+	shrinker.mu.Unlock()
+	return running
+}
+
 func (shrinker *ShrinkerSt) Crash() {
 	shrinker.mu.Lock()
 	shrinker.crash = true
@@ -94,8 +112,49 @@ func (shrinkst *ShrinkerSt) shrinker(inum common.Inum) {
 		panic("shrink")
 	}
 	util.DPrintf(1, "Shrinker: done shrinking # %d\n", inum)
+	shrinkst.exit()
+}
+
+func (shrinkst *ShrinkerSt) exit() {
 	shrinkst.mu.Lock()
 	shrinkst.nthread = shrinkst.nthread - 1
 	shrinkst.condShut.Signal()
 	shrinkst.mu.Unlock()
 }
+
+// ResumeShrinkers shrinks inums, which were shrinking when the server
+// stopped, with at most NRESUMER threads
+func (shrinkst *ShrinkerSt) ResumeShrinkers(inums []common.Inum) {
+	var n = uint32(len(inums))
+	if n > NRESUMER {
+		n = NRESUMER
+	}
+	shrinkst.mu.Lock()
+	shrinkst.resume = append(shrinkst.resume, inums...)
+	shrinkst.nthread = shrinkst.nthread + n
+	shrinkst.mu.Unlock()
+	for i := uint32(0); i < n; i++ {
+		go func() { shrinkst.resumer() }()
+	}
+}
+
+// resumer shrinks the inodes queued for resuming until there are none
+// left, or the server crashes
+func (shrinkst *ShrinkerSt) resumer() {
+	for {
+		shrinkst.mu.Lock()
+		if shrinkst.crash || len(shrinkst.resume) == 0 {
+			shrinkst.mu.Unlock()
+			break
+		}
+		inum := shrinkst.resume[0]
+		shrinkst.resume = shrinkst.resume[1:]
+		shrinkst.mu.Unlock()
+		ok := shrinkst.DoShrink(inum)
+		if !ok {
+			panic("shrink")
+		}
+		util.DPrintf(1, "Resumer: done shrinking # %d\n", inum)
+	}
+	shrinkst.exit()
+}
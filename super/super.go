@@ -2,43 +2,273 @@ package super
 
 import (
 	"github.com/goose-lang/primitive/disk"
+	"github.com/tchajed/marshal"
 
 	"github.com/mit-pdos/go-journal/addr"
 	"github.com/mit-pdos/go-journal/common"
 )
 
+//
+// On-disk layout: the log, the superblock, the block bitmap, the inode
+// bitmap, the inodes, and then data blocks.  VERSION0 file systems
+// predate the superblock: their block bitmap starts right after the
+// log and their inodes are common.INODESZ bytes, without room for mode,
+// uid, gid, ctime, a create verifier, or rdev.
+//
+// Since VERSION2 the superblock records the layout, so that it doesn't
+// depend on the size of the disk the file system is opened on, and
+// identifies the file system by a creation time, a UUID, and an
+// optional label.  The number of inodes, and so the sizes of the inode
+// bitmap and inodes, is chosen when the file system is made.  A
+// VERSION1 superblock has just the magic number and version; the
+// layout follows from the size of the disk, as for VERSION0.
+//
+
+const (
+	VERSION0 uint64 = 0
+	VERSION1 uint64 = 1
+	VERSION2 uint64 = 2
+	VERSION  uint64 = VERSION2 // version of new file systems
+
+	MAGIC uint64 = 0x6473666e6f67 // "gonfsd", little endian
+
+	INODESZ uint64 = 256 // on-disk inode size, since VERSION1
+
+	UUIDSZ  uint64 = 16
+	LABELSZ uint64 = 32
+)
+
+// Problems ReadFsSuper may find with a disk
+const (
+	OK        uint64 = 0
+	ENOFS     uint64 = 1 // not a file system
+	EVERSION  uint64 = 2 // unsupported version
+	ESIZE     uint64 = 3 // disk size doesn't match the file system's
+	EGEOMETRY uint64 = 4 // inconsistent layout
+)
+
 type FsSuper struct {
 	Disk         disk.Disk
 	Size         uint64
+	Version      uint64
 	nLog         uint64 // including commit block
+	nSuper       uint64
 	NBlockBitmap uint64
 	NInodeBitmap uint64
+	inodeSz      uint64
 	nInodeBlk    uint64
 	Maxaddr      uint64
+	Created      uint64 // unix time; set by the creator before WriteSuper
+	UUID         []byte // UUIDSZ bytes; likewise
+	Label        []byte // LABELSZ bytes, zero-padded; likewise
+	formatted    bool   // is there a file system on Disk?
 }
 
-func MkFsSuper(d disk.Disk) *FsSuper {
+// DEFNINODE is the number of inodes in a file system if its creator
+// doesn't ask for a particular number
+const DEFNINODE uint64 = common.NINODEBITMAP * common.NBITBLOCK
+
+func mkFsSuper(d disk.Disk, version uint64, ninode uint64) *FsSuper {
 	sz := d.Size()
 	nblockbitmap := (sz / common.NBITBLOCK) + 1
+	var nsuper = uint64(1)
+	var inodesz = INODESZ
+	if version == VERSION0 {
+		nsuper = 0
+		inodesz = common.INODESZ
+	}
+	inodeblk := disk.BlockSize / inodesz
+	ninodeblk := (ninode + inodeblk - 1) / inodeblk
+	ninodebitmap := (ninodeblk*inodeblk + common.NBITBLOCK - 1) / common.NBITBLOCK
 
 	return &FsSuper{
 		Disk:         d,
 		Size:         sz,
+		Version:      version,
 		nLog:         common.LOGSIZE,
+		nSuper:       nsuper,
 		NBlockBitmap: nblockbitmap,
-		NInodeBitmap: common.NINODEBITMAP,
-		nInodeBlk:    (common.NINODEBITMAP * common.NBITBLOCK * common.INODESZ) / disk.BlockSize,
-		Maxaddr:      sz}
+		NInodeBitmap: ninodebitmap,
+		inodeSz:      inodesz,
+		nInodeBlk:    ninodeblk,
+		Maxaddr:      sz,
+		UUID:         make([]byte, UUIDSZ),
+		Label:        make([]byte, LABELSZ),
+	}
+}
+
+// MkFsSuper computes the layout of a new file system on d
+func MkFsSuper(d disk.Disk) *FsSuper {
+	return mkFsSuper(d, VERSION, DEFNINODE)
+}
+
+// MkFsSuperInodes computes the layout of a new file system on d with
+// room for at least ninode inodes (including the unused inode 0).  It
+// fails with EGEOMETRY if they leave no room for data.
+func MkFsSuperInodes(d disk.Disk, ninode uint64) (*FsSuper, uint64) {
+	if ninode <= uint64(common.ROOTINUM) {
+		return nil, EGEOMETRY
+	}
+	fs := mkFsSuper(d, VERSION, ninode)
+	if uint64(fs.DataStart()) >= fs.Size {
+		return nil, EGEOMETRY
+	}
+	return fs, OK
+}
+
+// NInodeForBytes returns the number of inodes that gives a disk of sz
+// blocks one inode per bytesPerInode bytes
+func NInodeForBytes(sz uint64, bytesPerInode uint64) uint64 {
+	return sz * disk.BlockSize / bytesPerInode
+}
+
+// MkLegacyFsSuper computes the layout of a VERSION0 file system on d
+func MkLegacyFsSuper(d disk.Disk) *FsSuper {
+	return mkFsSuper(d, VERSION0, DEFNINODE)
+}
+
+// ReadFsSuper reads the layout of the file system on d, and checks that
+// it is sensible.  The superblock is written directly to disk rather
+// than through the log, so it can be read before recovery.  A blank
+// disk has no file system, like one with anything else on it.
+func ReadFsSuper(d disk.Disk) (*FsSuper, uint64) {
+	blk := d.Read(common.LOGSIZE)
+	dec := marshal.NewDec(blk)
+	magic := dec.GetInt()
+	if magic == MAGIC {
+		fs := decodeSuper(d, dec)
+		return fs, fs.check()
+	}
+	// A VERSION0 file system has its first bitmap block where the
+	// superblock would be, and that block always starts with the
+	// (allocated) bits for the log.
+	if isLegacyBitmap(blk) {
+		fs := MkLegacyFsSuper(d)
+		fs.formatted = true
+		return fs, OK
+	}
+	return nil, ENOFS
+}
+
+func isLegacyBitmap(blk disk.Block) bool {
+	for i := uint64(0); i < common.LOGSIZE/8; i++ {
+		if blk[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeSuper(d disk.Disk, dec marshal.Dec) *FsSuper {
+	version := dec.GetInt()
+	if version == VERSION1 {
+		fs := mkFsSuper(d, VERSION1, DEFNINODE)
+		fs.formatted = true
+		return fs
+	}
+	fs := new(FsSuper)
+	fs.Disk = d
+	fs.Version = version
+	fs.Size = dec.GetInt()
+	fs.nLog = dec.GetInt()
+	fs.nSuper = 1
+	fs.NBlockBitmap = dec.GetInt()
+	fs.NInodeBitmap = dec.GetInt()
+	fs.inodeSz = dec.GetInt()
+	fs.nInodeBlk = dec.GetInt()
+	fs.Maxaddr = fs.Size
+	fs.Created = dec.GetInt()
+	fs.UUID = dec.GetBytes(UUIDSZ)
+	fs.Label = dec.GetBytes(LABELSZ)
+	fs.formatted = true
+	return fs
+}
+
+// check that the layout fits the disk and the code
+func (fs *FsSuper) check() uint64 {
+	if fs.Version != VERSION1 && fs.Version != VERSION2 {
+		return EVERSION
+	}
+	if fs.Size != fs.Disk.Size() {
+		return ESIZE
+	}
+	if fs.nLog != common.LOGSIZE || fs.inodeSz != INODESZ ||
+		fs.NBlockBitmap*common.NBITBLOCK < fs.Size ||
+		fs.nInodeBlk == 0 ||
+		fs.NInodeBitmap*common.NBITBLOCK < uint64(fs.NInode()) ||
+		uint64(fs.DataStart()) >= fs.Size {
+		return EGEOMETRY
+	}
+	return OK
+}
+
+// WriteSuper writes the superblock directly to disk, if the file
+// system has one.  Once it is written, there is a file system on the
+// disk.
+func (fs *FsSuper) WriteSuper() {
+	fs.formatted = true
+	if fs.nSuper == 0 {
+		return
+	}
+	enc := marshal.NewEnc(disk.BlockSize)
+	enc.PutInt(MAGIC)
+	enc.PutInt(fs.Version)
+	if fs.Version == VERSION1 {
+		fs.Disk.Write(uint64(fs.SuperStart()), enc.Finish())
+		return
+	}
+	enc.PutInt(fs.Size)
+	enc.PutInt(fs.nLog)
+	enc.PutInt(fs.NBlockBitmap)
+	enc.PutInt(fs.NInodeBitmap)
+	enc.PutInt(fs.inodeSz)
+	enc.PutInt(fs.nInodeBlk)
+	enc.PutInt(fs.Created)
+	enc.PutBytes(fs.UUID)
+	enc.PutBytes(fs.Label)
+	fs.Disk.Write(uint64(fs.SuperStart()), enc.Finish())
+}
+
+// Formatted reports whether there is a file system on the disk, rather
+// than fs being the layout for a new one
+func (fs *FsSuper) Formatted() bool {
+	return fs.formatted
+}
+
+// LabelString returns the label without its padding
+func (fs *FsSuper) LabelString() string {
+	var n = uint64(0)
+	for n < LABELSZ && fs.Label[n] != 0 {
+		n++
+	}
+	return string(fs.Label[:n])
+}
+
+// Legacy reports whether fs is a VERSION0 file system
+func (fs *FsSuper) Legacy() bool {
+	return fs.Version == VERSION0
+}
+
+// Extents reports whether new inodes of fs map their blocks with
+// extents and may keep their contents inline.  VERSION0 and VERSION1
+// file systems predate both, and new inodes on them keep using block
+// pointers, which servers from before extents can read.
+func (fs *FsSuper) Extents() bool {
+	return fs.Version >= VERSION2
 }
 
 func (fs *FsSuper) MaxBnum() common.Bnum {
 	return common.Bnum(fs.Maxaddr)
 }
 
-func (fs *FsSuper) BitmapBlockStart() common.Bnum {
+func (fs *FsSuper) SuperStart() common.Bnum {
 	return common.Bnum(fs.nLog)
 }
 
+func (fs *FsSuper) BitmapBlockStart() common.Bnum {
+	return fs.SuperStart() + common.Bnum(fs.nSuper)
+}
+
 func (fs *FsSuper) BitmapInodeStart() common.Bnum {
 	return fs.BitmapBlockStart() + common.Bnum(fs.NBlockBitmap)
 }
@@ -55,11 +285,20 @@ func (fs *FsSuper) Block2addr(blkno common.Bnum) addr.Addr {
 	return addr.MkAddr(blkno, 0)
 }
 
+// InodeSz returns the on-disk size of an inode in bytes
+func (fs *FsSuper) InodeSz() uint64 {
+	return fs.inodeSz
+}
+
+func (fs *FsSuper) inodeBlk() uint64 {
+	return disk.BlockSize / fs.inodeSz
+}
+
 func (fs *FsSuper) NInode() common.Inum {
-	return common.Inum(fs.nInodeBlk * common.INODEBLK)
+	return common.Inum(fs.nInodeBlk * fs.inodeBlk())
 }
 
 func (fs *FsSuper) Inum2Addr(inum common.Inum) addr.Addr {
-	return addr.MkAddr(fs.InodeStart()+common.Bnum(uint64(inum)/common.INODEBLK),
-		(uint64(inum)%common.INODEBLK)*common.INODESZ*8)
+	return addr.MkAddr(fs.InodeStart()+common.Bnum(uint64(inum)/fs.inodeBlk()),
+		(uint64(inum)%fs.inodeBlk())*fs.inodeSz*8)
 }